@@ -4,14 +4,17 @@ package gaio
 
 import (
 	"net"
+	"runtime"
 	"sync"
 	"syscall"
+	"unsafe"
 )
 
 type poller struct {
 	poolGeneric
-	mu sync.Mutex // mutex to protect fd closing
-	fd int        // kqueue fd
+	mu        sync.Mutex // mutex to protect fd closing
+	fd        int        // kqueue fd
+	maxEvents int        // max events returned by a wait
 
 	// awaiting for poll
 	awaiting      []int
@@ -21,22 +24,41 @@ type poller struct {
 	dieOnce sync.Once
 }
 
+// backend is the name of the poller
+const backend = "kqueue"
+
+// capabilities returns the optional operations supported on the BSDs, sendfile(2) is missing
+// on netbsd and openbsd, and the connections are balanced by SO_REUSEPORT_LB on freebsd only.
+func capabilities() Capabilities {
+	return Capabilities{
+		SendFile:         runtime.GOOS == "darwin" || runtime.GOOS == "freebsd" || runtime.GOOS == "dragonfly",
+		EdgeTriggered:    true,
+		ReusePortBalance: runtime.GOOS == "freebsd",
+	}
+}
+
+// soReusePort returns the socket option to share a port with load balancing, SO_REUSEPORT_LB
+// on freebsd, as SO_REUSEPORT there lets the last socket bound take all the connections.
+func soReusePort() int {
+	if runtime.GOOS == "freebsd" {
+		return 0x10000 // SO_REUSEPORT_LB
+	}
+	return syscall.SO_REUSEPORT
+}
+
 // dupconn use RawConn to dup() file descriptor
 func dupconn(conn net.Conn) (newfd int, err error) {
-	sc, ok := conn.(interface {
-		SyscallConn() (syscall.RawConn, error)
-	})
-	if !ok {
-		return -1, ErrUnsupported
-	}
-	rc, err := sc.SyscallConn()
+	rc, err := rawConn(conn)
 	if err != nil {
 		return -1, ErrUnsupported
 	}
 
 	// Control() guarantees the integrity of file descriptor
 	ec := rc.Control(func(fd uintptr) {
-		newfd, err = syscall.Dup(int(fd))
+		err = retryOnEINTR(func() (err error) {
+			newfd, err = syscall.Dup(int(fd))
+			return err
+		})
 	})
 
 	if ec != nil {
@@ -46,7 +68,8 @@ func dupconn(conn net.Conn) (newfd int, err error) {
 	return
 }
 
-func openPoll() (*poller, error) {
+// openPoll opens a poller returning at most 'maxEvents' events by a wait
+func openPoll(maxEvents int) (*poller, error) {
 	fd, err := syscall.Kqueue()
 	if err != nil {
 		return nil, err
@@ -64,6 +87,7 @@ func openPoll() (*poller, error) {
 
 	p := new(poller)
 	p.fd = fd
+	p.maxEvents = maxEvents
 	p.die = make(chan struct{})
 	return p, nil
 }
@@ -76,6 +100,17 @@ func (p *poller) Close() error {
 }
 
 func (p *poller) Watch(fd int) error {
+	// level-triggered descriptors are registered disabled, and enabled on demand by Interest
+	if p.levelTriggered {
+		return retryOnEINTR(func() error {
+			_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{
+				{Ident: uint64(fd), Flags: syscall.EV_ADD | syscall.EV_DISABLE, Filter: syscall.EVFILT_READ},
+				{Ident: uint64(fd), Flags: syscall.EV_ADD | syscall.EV_DISABLE, Filter: syscall.EVFILT_WRITE},
+			}, nil, nil)
+			return err
+		})
+	}
+
 	p.awaitingMutex.Lock()
 	p.awaiting = append(p.awaiting, fd)
 	p.awaitingMutex.Unlock()
@@ -83,16 +118,75 @@ func (p *poller) Watch(fd int) error {
 	return p.wakeup()
 }
 
+// Unwatch removes the descriptor from kqueue, without closing it
+func (p *poller) Unwatch(fd int) error {
+	// not registered yet
+	p.awaitingMutex.Lock()
+	for k := range p.awaiting {
+		if p.awaiting[k] == fd {
+			p.awaiting = append(p.awaiting[:k], p.awaiting[k+1:]...)
+			p.awaitingMutex.Unlock()
+			return nil
+		}
+	}
+	p.awaitingMutex.Unlock()
+
+	// filters are deleted one by one, as a missing filter fails the whole change list
+	for _, filter := range []int16{syscall.EVFILT_READ, syscall.EVFILT_WRITE} {
+		err := retryOnEINTR(func() error {
+			_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: filter}}, nil, nil)
+			return err
+		})
+		if err != nil && err != syscall.ENOENT {
+			return err
+		}
+	}
+	return nil
+}
+
+// Interest changes the events interested on a level-triggered descriptor from 'prev' to 'next'
+func (p *poller) Interest(fd int, prev, next int) error {
+	// out-of-band data is reported by EVFILT_READ
+	if prev&EV_OOB != 0 {
+		prev |= EV_READ
+	}
+	if next&EV_OOB != 0 {
+		next |= EV_READ
+	}
+
+	var changes []syscall.Kevent_t
+	for _, f := range []struct {
+		ev     int
+		filter int16
+	}{{EV_READ, syscall.EVFILT_READ}, {EV_WRITE, syscall.EVFILT_WRITE}} {
+		if prev&f.ev != next&f.ev {
+			var flags uint16 = syscall.EV_DISABLE
+			if next&f.ev != 0 {
+				flags = syscall.EV_ENABLE
+			}
+			changes = append(changes, syscall.Kevent_t{Ident: uint64(fd), Flags: flags, Filter: f.filter})
+		}
+	}
+
+	return retryOnEINTR(func() error {
+		_, err := syscall.Kevent(p.fd, changes, nil, nil)
+		return err
+	})
+}
+
 // wakeup interrupt kevent
 func (p *poller) wakeup() error {
 	p.mu.Lock()
 	if p.fd != -1 {
 		// notify poller
-		_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{
-			Ident:  0,
-			Filter: syscall.EVFILT_USER,
-			Fflags: syscall.NOTE_TRIGGER,
-		}}, nil, nil)
+		err := retryOnEINTR(func() error {
+			_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{
+				Ident:  0,
+				Filter: syscall.EVFILT_USER,
+				Fflags: syscall.NOTE_TRIGGER,
+			}}, nil, nil)
+			return err
+		})
 		p.mu.Unlock()
 		return err
 	}
@@ -100,9 +194,11 @@ func (p *poller) wakeup() error {
 	return ErrPollerClosed
 }
 
-func (p *poller) Wait(chEventNotify chan pollerEvents) {
+// Wait polls for events and notifies them to chEventNotify until the poller is closed,
+// a non-nil error is returned if the poller failed.
+func (p *poller) Wait(chEventNotify chan pollerEvents) error {
 	p.initCache(cap(chEventNotify) + 2)
-	events := make([]syscall.Kevent_t, maxEvents)
+	events := make([]syscall.Kevent_t, p.maxEvents)
 	defer func() {
 		p.mu.Lock()
 		syscall.Close(p.fd)
@@ -115,7 +211,7 @@ func (p *poller) Wait(chEventNotify chan pollerEvents) {
 	for {
 		select {
 		case <-p.die:
-			return
+			return nil
 		default:
 			p.awaitingMutex.Lock()
 			for _, fd := range p.awaiting {
@@ -133,7 +229,12 @@ func (p *poller) Wait(chEventNotify chan pollerEvents) {
 				continue
 			}
 			if err != nil {
-				return
+				select {
+				case <-p.die: // closed
+					return nil
+				default:
+					return err
+				}
 			}
 			changes = changes[:0]
 
@@ -145,7 +246,9 @@ func (p *poller) Wait(chEventNotify chan pollerEvents) {
 				if ev.Ident != 0 {
 					e := event{ident: int(ev.Ident)}
 					if ev.Filter == syscall.EVFILT_READ {
-						e.ev |= EV_READ
+						// out-of-band data is not reported distinctly by all
+						// kqueue implementations, try it on every read event
+						e.ev |= EV_READ | EV_OOB
 						// https://golang.org/src/runtime/netpoll_kqueue.go
 						// On some systems when the read end of a pipe
 						// is closed the write end will not get a
@@ -161,6 +264,19 @@ func (p *poller) Wait(chEventNotify chan pollerEvents) {
 						}
 					} else if ev.Filter == syscall.EVFILT_WRITE {
 						e.ev |= EV_WRITE
+						// the peer has closed the connection, EV_EOF on
+						// _EVFILT_READ alone is a half-close.
+						if ev.Flags&syscall.EV_EOF != 0 {
+							e.ev |= EV_HUP
+						}
+					}
+					// errno in data on error, or the socket error in fflags on EOF
+					if ev.Flags&syscall.EV_ERROR != 0 && ev.Data != 0 {
+						e.ev |= EV_ERR
+						e.err = syscall.Errno(ev.Data)
+					} else if ev.Flags&syscall.EV_EOF != 0 && ev.Fflags != 0 {
+						e.ev |= EV_ERR
+						e.err = syscall.Errno(ev.Fflags)
 					}
 
 					pe = append(pe, e)
@@ -170,7 +286,7 @@ func (p *poller) Wait(chEventNotify chan pollerEvents) {
 			select {
 			case chEventNotify <- pe:
 			case <-p.die:
-				return
+				return nil
 			}
 		}
 	}
@@ -183,3 +299,77 @@ func rawRead(fd int, p []byte) (n int, err error) {
 func rawWrite(fd int, p []byte) (n int, err error) {
 	return syscall.Write(fd, p)
 }
+
+// raw accept, accept4(2) is not available on darwin, the connection accepted is set
+// close-on-exec right after
+func rawAccept(fd int) (nfd int, err error) {
+	nfd, _, err = syscall.Accept(fd)
+	if err == nil {
+		syscall.CloseOnExec(nfd)
+	}
+	return nfd, err
+}
+
+// raw writev for nonblocking vector write
+func rawWritev(fd int, iovecs []syscall.Iovec) (n int, err error) {
+	r0, _, e1 := syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	n = int(r0)
+	if e1 != 0 {
+		err = e1
+	}
+	return
+}
+
+// raw readv for nonblocking vector read
+func rawReadv(fd int, iovecs []syscall.Iovec) (n int, err error) {
+	r0, _, e1 := syscall.Syscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	n = int(r0)
+	if e1 != 0 {
+		err = e1
+	}
+	return
+}
+
+// recvmmsg(2) is not available on all BSDs, the datagrams are received one per syscall
+// until EAGAIN or the buffers are filled, the error is reported only if none is received.
+func rawRecvmmsg(fd int, bufs [][]byte, sizes []int, addrs []net.Addr) (n int, err error) {
+	for n < len(bufs) {
+		nr, from, er := syscall.Recvfrom(fd, bufs[n], 0)
+		if er == syscall.EINTR {
+			continue
+		}
+		if er != nil {
+			if n == 0 {
+				return 0, er
+			}
+			return n, nil
+		}
+		sizes[n] = nr
+		addrs[n] = sockaddrToAddr(from)
+		n++
+	}
+	return n, nil
+}
+
+// _IOR('f', 127, int)
+const fionread = 0x4004667f
+
+// bytes available to read in the socket, FIONREAD
+func rawFionread(fd int) (n int, err error) {
+	var v int32
+	_, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(fionread), uintptr(unsafe.Pointer(&v)))
+	if e1 != 0 {
+		return 0, e1
+	}
+	return int(v), nil
+}
+
+// splice(2) is linux only
+func rawSplice(rfd int, wfd int, n int) (int, error) {
+	return 0, syscall.ENOSYS
+}
+
+// newSplicePipe fails with ErrUnsupported, as splice(2) is linux only
+func newSplicePipe() (p [2]int, err error) {
+	return p, ErrUnsupported
+}
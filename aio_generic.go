@@ -4,33 +4,116 @@ import (
 	"container/list"
 	"errors"
 	"net"
+	"os"
+	"strconv"
+	"syscall"
 	"time"
 )
 
 const (
-	// poller wait max events count
-	maxEvents = 4096
+	// default max events count of a poller wait, also the capacity of the
+	// submission and completion queues
+	defaultMaxEvents = 4096
+	// min max events count
+	minMaxEvents = 64
 	// default internal buffer size
 	defaultInternalBufferSize = 65536
+	// default number of internal swap buffers
+	defaultNumBuffers = 3
+	// min number of internal swap buffers, a result in swap buffer must stay
+	// valid until next WaitIO(), while the loop keeps on reading.
+	minNumBuffers = 3
+	// max buffers of a single writev(2), IOV_MAX
+	maxIovecs = 1024
+	// max bytes of a single sendfile(2)
+	maxSendfileSize = 1 << 30
+	// max bytes moved by a single splice, the default pipe capacity
+	maxSpliceSize = 65536
+	// max file descriptors received in a single read, SCM_MAX_FD
+	maxRecvFds = 253
+	// window to measure completion rate for adaptive notification
+	adaptiveWindow = 10 * time.Millisecond
+	// completions in a window to switch to batching mode
+	adaptiveThreshold = 256
 )
 
 var (
 	// ErrUnsupported means the watcher cannot support this type of connection
 	ErrUnsupported = errors.New("unsupported connection type")
 	// ErrNoRawConn means the connection has not implemented SyscallConn
-	ErrNoRawConn = errors.New("net.Conn does implement net.RawConn")
+	ErrNoRawConn = errors.New("net.Conn does not implement net.RawConn")
+	// ErrUnsupportedConn means the connection is not backed by a file descriptor, as it doesn't
+	// implement syscall.Conn, like a net.Pipe or a *tls.Conn, it's returned on submission
+	ErrUnsupportedConn = errors.New("connection is not a socket")
 	// ErrWatcherClosed means the watcher is closed
 	ErrWatcherClosed = errors.New("watcher closed")
 	// ErrPollerClosed suggest that poller has closed
 	ErrPollerClosed = errors.New("poller closed")
-	// ErrConnClosed means the user called Free() on related connection
+	// ErrConnClosed means the user called Free() on related connection, or the
+	// connection has hung up and been released, with the operation unable to complete
 	ErrConnClosed = errors.New("connection closed")
-	// ErrDeadline means the specific operation has exceeded deadline before completion
-	ErrDeadline = errors.New("operation exceeded deadline")
+	// ErrDeadline means the specific operation has exceeded deadline before completion,
+	// the bytes transferred before the deadline are reported in OpResult.Size.
+	// It's a net.Error with Timeout() == true.
+	ErrDeadline error = deadlineError{}
 	// ErrEmptyBuffer means the buffer is nil
 	ErrEmptyBuffer = errors.New("empty buffer")
 	// ErrCPUID indicates the given cpuid is invalid
 	ErrCPUID = errors.New("no such core")
+	// ErrSocketType means the type of socket is not supported by the watcher
+	ErrSocketType = errors.New("unsupported socket type")
+	// ErrCanceled means the operation has been cancelled before completion
+	ErrCanceled = errors.New("operation canceled")
+	// ErrMemLimit means the submission exceeds the limit of bytes in-flight
+	ErrMemLimit = errors.New("outstanding bytes exceed limit")
+	// ErrInflightLimit is ErrMemLimit, for the bound set by SetMaxInflightBytes
+	ErrInflightLimit = ErrMemLimit
+	// ErrPollerFailed means the poller has failed with an error, and the watcher is shut down
+	ErrPollerFailed = errors.New("poller failed")
+	// ErrInvalidOp means the operation type is invalid for the request
+	ErrInvalidOp = errors.New("invalid operation type")
+	// ErrWaitTimeout means no completion arrived within the timeout of WaitIOTimeout
+	ErrWaitTimeout = errors.New("wait timeout")
+	// ErrInvalidMin means the minimum bytes to read is out of the range of buffer
+	ErrInvalidMin = errors.New("invalid minimum bytes to read")
+	// ErrNotWatched means the connection is not being watched by the watcher
+	ErrNotWatched = errors.New("connection not watched")
+	// ErrBufferSize means the size of buffer is invalid
+	ErrBufferSize = errors.New("invalid buffer size")
+	// ErrMaxEvents means the max events count is below the minimum
+	ErrMaxEvents = errors.New("invalid max events count")
+	// ErrIncomparable means the context cannot be used to match operations
+	ErrIncomparable = errors.New("context is nil or incomparable")
+	// ErrTooManyConns means the number of connections being watched has reached the limit
+	ErrTooManyConns = errors.New("too many connections")
+	// ErrInvalidOffset means the offset of file is negative
+	ErrInvalidOffset = errors.New("invalid file offset")
+	// ErrInvalidAddr means the destination address of WriteTo is not a *net.UDPAddr or a *net.UnixAddr
+	ErrInvalidAddr = errors.New("invalid destination address")
+	// ErrInvalidBufferPool means the hooks of buffer pool are not both set or both nil
+	ErrInvalidBufferPool = errors.New("invalid buffer pool")
+	// ErrDetached means the connection has been detached from the watcher, the operation
+	// can be resubmitted on the watcher the connection is attached to
+	ErrDetached = errors.New("connection detached")
+	// ErrBufferInUse means the buffer overlaps the one of an in-flight operation on the conn
+	ErrBufferInUse = errors.New("buffer in use")
+	// ErrNoDup means the operation requires a duplicated file descriptor, unavailable in NoDup mode
+	ErrNoDup = errors.New("unsupported in NoDup mode")
+	// ErrNoPendingRead means there is no read queued on the connection
+	ErrNoPendingRead = errors.New("no pending read")
+	// ErrInvalidShard means there is no such result shard in the watcher
+	ErrInvalidShard = errors.New("no such result shard")
+	// ErrMixedConsumers means the results of a WatcherPool are consumed by both WaitIO and
+	// WaitIOShard, only one of them can be used for a pool
+	ErrMixedConsumers = errors.New("results consumed by both WaitIO and WaitIOShard")
+	// ErrCallbackMode means the results are delivered to Options.OnComplete, not WaitIO
+	ErrCallbackMode = errors.New("results delivered to OnComplete")
+	// ErrConnReset means the connection was reset or closed by peer(ECONNRESET, EPIPE),
+	// the errno is wrapped and retrievable with errors.Unwrap
+	ErrConnReset = errors.New("connection reset by peer")
+	// ErrNoFileDescriptors means the process or system is out of file descriptors(EMFILE, ENFILE)
+	// to duplicate the connection, the errno is wrapped and retrievable with errors.Unwrap
+	ErrNoFileDescriptors = errors.New("no file descriptors")
 )
 
 var (
@@ -45,19 +128,56 @@ const (
 	OpRead OpType = iota
 	// OpWrite means the aiocb is a write operation
 	OpWrite
+	// OpIdle means the connection has had no completed IO for the idle timeout
+	OpIdle
+	// OpReadOOB means the aiocb is a read operation of out-of-band(urgent) data
+	OpReadOOB
+	// OpWriteOOB means the aiocb is a write operation of out-of-band(urgent) data
+	OpWriteOOB
+	// OpSplice means the aiocb is a splice operation between connections
+	OpSplice
+	// OpAccept means the aiocb is an accept operation on a listener
+	OpAccept
+	// OpFlush means the aiocb is a write barrier completed after the writes before
+	OpFlush
+	// OpProbe means the aiocb is a liveness check of a connection
+	OpProbe
+	// OpConnect means the aiocb is a non-blocking connect, the Conn of the result is the
+	// connection established
+	OpConnect
 	// internal operation to delete an related resource
 	opDelete
+	// internal operation to cancel operations by context
+	opCancelContext
+	// internal operation to cancel operations on a conn
+	opCancel
+	// internal operation to modify the deadline of an operation
+	opSetDeadline
+	// internal operation to submit a batch of operations
+	opBatch
+	// internal operation to cancel a single operation by context.Context
+	opCancelOp
+	// internal operation to set the idle timeout of a conn
+	opSetIdle
+	// internal operation to set the byte-rate limit of a conn
+	opSetRate
+	// internal operation to shut down a direction of a conn
+	opShutdown
 )
 
 const (
 	EV_READ  = 0x1
 	EV_WRITE = 0x2
+	EV_HUP   = 0x4
+	EV_OOB   = 0x8
+	EV_ERR   = 0x10
 )
 
 // event represent a file descriptor event
 type event struct {
-	ident int // identifier of this event, usually file descriptor
-	ev    int // event mark
+	ident int   // identifier of this event, usually file descriptor
+	ev    int   // event mark
+	err   error // errno carried by the event, if the poller reports it with EV_ERR
 }
 
 // events from epoll_wait passing to loop,should be in batch for atomicity.
@@ -67,9 +187,10 @@ type pollerEvents []event
 
 // generic poll struct
 type poolGeneric struct {
-	cpuid        int32
-	cachedEvents []pollerEvents
-	cacheIndex   uint
+	cpuid          int32
+	cachedEvents   []pollerEvents
+	cacheIndex     uint
+	levelTriggered bool // register file descriptors level-triggered
 }
 
 func (pg *poolGeneric) initCache(numCache int) {
@@ -96,18 +217,214 @@ type OpResult struct {
 	Operation OpType
 	// User context associated with this requests
 	Context interface{}
-	// Related net.Conn to this result
+	// Related net.Conn to this result, or the connection accepted for OpAccept
 	Conn net.Conn
 	// Buffer points to user's supplied buffer or watcher's internal swap buffer
 	Buffer []byte
 	// IsSwapBuffer marks true if the buffer internal one
 	IsSwapBuffer bool
+	// Buffers points to user's supplied buffers of ReadVector or WriteVector, Buffer is nil
+	Buffers [][]byte
 	// Number of bytes sent or received, Buffer[:Size] is the content sent or received.
+	// For writes, it's exactly the bytes written, accumulated across the partial writes
+	// resumed after EAGAIN: len(Buffer) on success, and the bytes written before the
+	// error, deadline or cancellation otherwise, so it can be summed for accounting.
 	Size int
+	// File descriptor duplicated from Conn which the operation performed on,
+	// -1 if the conn has failed to be watched. It's for diagnosis only, and
+	// it's closed once the conn is freed.
+	Fd int
+	// Source address of the datagram received, for OpRead on datagram
+	// sockets only.
+	Addr net.Addr
+	// Sizes and source addresses of the datagrams received by ReadMulti, the datagram i is
+	// Buffers[i][:Sizes[i]] from Addrs[i], len(Sizes) is the number of datagrams received
+	// and Size is the total bytes of them.
+	Sizes []int
+	Addrs []net.Addr
+	// Local and remote addresses of Conn captured on submission, safe to use
+	// after the conn has been freed.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// Bytes remaining buffered in the socket after a successful read, it's a
+	// hint for issuing another read eagerly, reported only if enabled by
+	// SetReportPending.
+	Pending int
+	// File descriptors received by ReadWithFds, the caller owns and must
+	// close them; or the ones sent by WriteWithFds.
+	Fds []int
+	// Control messages buffer supplied to ReadMsg, OOB[:OOBn] are the bytes received,
+	// Flags are the flags of the message received, such as MSG_TRUNC and MSG_CTRUNC.
+	OOB   []byte
+	OOBn  int
+	Flags int
+	// Submission sequence of the operation, assigned from 1 in the order the operations
+	// are submitted to the watcher, a single submitter can track its operations in a
+	// flat array indexed by it. Results of a persistent read share the same sequence,
+	// and it's 0 for OpIdle.
+	Seq uint64
 	// IO error,timeout error
+	// system errors are reported as is(syscall.Errno), except ECONNRESET and EPIPE
+	// wrapped in ErrConnReset, and can be classified with IsConnReset, IsBrokenPipe
+	// and IsNotConnected.
 	Error error
 }
 
+// Copy returns the content of Buffer[:Size] which is safe to retain, a copy is made
+// if the buffer is an internal swap buffer, which is only valid before next call to
+// WaitIO, otherwise the buffer itself is returned.
+func (r *OpResult) Copy() []byte {
+	if r.IsSwapBuffer {
+		return append([]byte(nil), r.Buffer[:r.Size]...)
+	}
+	return r.Buffer[:r.Size]
+}
+
+// Options for creating a watcher with NewWatcherOpts
+type Options struct {
+	// BufferSize sets the internal swap buffer size, 0 means the default size
+	BufferSize int
+	// NumBuffers sets the number of internal swap buffers in the ring, 0 means the
+	// default 3, which is also the minimum. More buffers give more slack for a slow
+	// consumer before the buffers in the ring are reused.
+	NumBuffers int
+	// LevelTriggered registers file descriptors level-triggered instead of the default
+	// edge-triggered, the events on a descriptor are interested only if there are
+	// operations queued on it.
+	LevelTriggered bool
+	// MaxEvents sets the max events count returned by a poller wait, also the capacity
+	// of the submission and completion queues, 0 means the default 4096, the minimum is 64.
+	// A larger batch reduces the poller syscalls with a very large number of active
+	// connections, at the cost of memory, a smaller one saves memory for small deployments,
+	// and fewer completions are held before the loop blocks on a slow consumer.
+	MaxEvents int
+	// OnBackpressure is called when the loop is about to block on delivering a completion,
+	// as the results returned by WaitIO are not consumed in time, with the number of
+	// completions waiting. It runs on its own goroutine, and is skipped while it's running,
+	// so a slow callback never blocks the loop.
+	OnBackpressure func(waiting int)
+	// OnPollerError is called on the loop when the poller reports an error or hangup on the
+	// file descriptor 'fd' of a conn, before the operations on it are attempted, for logging
+	// the poller errors per fd. 'err' is the errno of the socket error, from the event data
+	// of kqueue, or SO_ERROR for EPOLLERR, which clears it, so it's kept for the next read or
+	// write on the conn as the kernel would report it; it's io.EOF for a hangup without error.
+	OnPollerError func(fd int, err error)
+	// NoDup operates on the original file descriptors of the conns, instead of duplicating
+	// them and closing the conns, which halves the fds consumed, and the conns remain usable
+	// for properties like the addresses and socket options, the deadlines of the conns have
+	// no effect on the operations of the watcher. It's unsafe, the duplication protects the
+	// watcher from fd reuse: a conn must not be closed, nor dropped for gc, before it has been
+	// freed and the Free has taken effect, as observed by its pending operations delivered with
+	// ErrConnClosed, or WriteQueueLen returning ErrNotWatched, otherwise the fd number can be
+	// reused by a new fd in the meantime, and the operations go to it.
+	// The conns are left open after Free, to be closed by the user.
+	NoDup bool
+	// ResultShards partitions the completions into 'n' shards by the fd of their conns
+	// modulo 'n', each consumed by WaitIOShard with its own queue of MaxEvents, so that the
+	// results can be processed by 'n' worker goroutines in parallel, 0 or 1 means a single
+	// queue consumed by WaitIO, which is also shard 0. Every shard must be consumed, as the
+	// loop blocks on a full shard, and the swap buffers are reused only after the results
+	// returned have been acknowledged on all shards.
+	ResultShards int
+	// OnComplete switches the watcher to push-style delivery, every completion is passed to
+	// OnComplete instead of being returned by WaitIO, which fails with ErrCallbackMode. The
+	// callbacks of a result shard are run one by one on a goroutine of the watcher, and the
+	// swap buffers of the results are valid until the callbacks return.
+	OnComplete func(res OpResult)
+	// Dispatcher runs the OnComplete callbacks, e.g. submitting them to a worker pool, 'f'
+	// may run asynchronously, so the swap buffers are copied for it, nil runs them in order
+	// on the goroutine of the result shard.
+	Dispatcher func(f func())
+}
+
+// Op describes an async-io request submitted in batch with Submit
+type Op struct {
+	// Operation Type, OpRead or OpWrite
+	Operation OpType
+	// User context associated with this request
+	Context interface{}
+	// Related net.Conn to this request
+	Conn net.Conn
+	// Buffer to read into or write from, it can be nil for OpRead
+	// to use internal buffer.
+	Buffer []byte
+	// Deadline of this request, a zero Deadline means no deadline
+	Deadline time.Time
+	// ReadFull marks true to fill the whole Buffer for OpRead
+	ReadFull bool
+	// Err is set by Submit if this request failed to be submitted
+	Err error
+	// Seq is set by Submit to the submission sequence of this request, see OpResult.Seq
+	Seq uint64
+}
+
+// ConnInfo describes a connection being watched, returned by Connections
+type ConnInfo struct {
+	// The conn, it's held by the watcher only while operations are queued on it or
+	// an idle timeout is set, nil otherwise, as the watcher never keeps an unused conn
+	// from being garbage collected.
+	Conn net.Conn
+	// File descriptor duplicated from the conn
+	Fd int
+	// Addresses of the conn
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// Number of read(including out-of-band) and write operations queued
+	Readers int
+	Writers int
+	// Time of the last operation completed successfully, or the conn is watched
+	LastActive time.Time
+}
+
+// Stats contains the statistics of a watcher
+type Stats struct {
+	// Number of operations completed
+	Completions int64
+	// Number of bytes read from connections
+	BytesRead int64
+	// Number of bytes written to connections
+	BytesWritten int64
+	// Number of read/write syscalls made
+	Syscalls int64
+	// Number of read operations completed
+	Reads int64
+	// Number of write operations completed
+	Writes int64
+	// Number of operations completed with ErrDeadline
+	Timeouts int64
+	// Number of read/write syscalls returned EAGAIN and waited for readiness again
+	Retries int64
+	// Number of times the deadline timer is reset
+	TimerResets int64
+	// Number of times the loop blocked on delivering a completion, as the results
+	// returned by WaitIO were not consumed in time
+	Backpressure int64
+	// Number of connections being watched currently
+	Conns int
+	// Number of operations submitted and not yet completed currently
+	Pending int
+	// Batching marks true if completions are coalesced for throughput under high
+	// completion rate, false if completions are delivered immediately for latency.
+	Batching bool
+}
+
+// counters for statistics, updated atomically
+type counters struct {
+	completions  int64
+	bytesRead    int64
+	bytesWritten int64
+	syscalls     int64
+	reads        int64
+	writes       int64
+	timeouts     int64
+	retries      int64
+	timerResets  int64
+	backpressure int64
+	pending      int64
+	conns        int32
+	batching     int32
+}
+
 // aiocb contains all info for a single request
 type aiocb struct {
 	l          *list.List // list where this request belongs to
@@ -119,11 +436,92 @@ type aiocb struct {
 	err        error       // error for last operation
 	size       int         // size received or sent
 	buffer     []byte
-	backBuffer [1]byte // one byte buffer used when internal buffer exhausted
-	readFull   bool    // requests will read full or error
-	useSwap    bool    // mark if the buffer is internal swap buffer
-	idx        int     // index for heap op
+	backBuffer [1]byte   // one byte buffer used when internal buffer exhausted
+	readFull   bool      // requests will read full or error
+	useSwap    bool      // mark if the buffer is internal swap buffer
+	pooled     bool      // mark if the buffer is taken from the buffer pool
+	priority   bool      // queued ahead of the normal operations
+	track      *bufRange // buffer tracked by SetBufferCheck
+	idx        int       // index for heap op
 	deadline   time.Time
+
+	maxSyscalls int    // max read syscalls on every readiness event, 0 means unlimited
+	min         int    // min bytes to complete a read full operation, 0 means the whole buffer
+	replace     bool   // replace the buffer of the oldest unstarted write
+	seq         uint64 // delivery sequence
+	next        *aiocb // next result in the batch delivered together
+	opSeq       uint64 // submission sequence
+	pending     int    // bytes remaining buffered in the socket after read
+	fd          int    // file descriptor of the delivered result
+	charge      int64  // bytes charged to the outstanding bytes limit
+
+	deadlineFunc func(soFar int) time.Time // computes deadline by progress
+
+	bufs    [][]byte // buffers of vector read/write
+	bufsLen int      // total bytes of bufs
+
+	batch []*aiocb // requests submitted in batch
+
+	notify chan OpResult // result is sent here instead of WaitIO
+	done   chan struct{} // closed once settled, for cancellation by context.Context
+	// the deadline is of context.Context, expired with context.DeadlineExceeded
+	ctxDeadline bool
+
+	file   *os.File // source file of sendfile, held until completion
+	fileFd int      // file descriptor of the source file
+	offset int64    // starting offset in the source file
+	count  int64    // bytes to transfer from the source file, or to splice
+
+	dstPtr  uintptr  // pointer to destination conn of splice
+	dstConn net.Conn // destination conn of splice
+	pipe    [2]int   // pipe of splice, read and write ends
+	inPipe  int      // bytes spliced into the pipe, not yet to destination
+
+	datagram bool     // read on datagram socket
+	addr     net.Addr // source address of datagram
+
+	laddr net.Addr // local address of conn on submission
+	raddr net.Addr // remote address of conn on submission
+
+	peek     bool             // read with MSG_PEEK, data is left in the socket
+	multi    bool             // batched datagram receive into bufs, one datagram per buffer
+	to       syscall.Sockaddr // destination of the datagram sent by WriteTo
+	sizes    []int            // sizes of the datagrams received by ReadMulti
+	addrs    []net.Addr       // source addresses of the datagrams received by ReadMulti
+	readable bool             // readiness only, completes when readable without reading
+
+	withFds bool  // read/write with SCM_RIGHTS ancillary data
+	fds     []int // file descriptors to send, or received
+
+	withOOB bool   // read with recvmsg into a secondary out-of-band buffer
+	oob     []byte // user buffer of control messages
+	oobn    int    // bytes of control messages received
+	flags   int    // flags of the message received
+
+	persist    bool   // persistent read
+	persistBuf []byte // user buffer of persistent read
+	parked     bool   // persistent read waits for acknowledgement
+	parkSeq    uint64 // delivery sequence to be acknowledged
+
+	ringID   uint64 // id of the operation in flight on io_uring, 0 if none
+	ringRes  int32  // result of the io_uring completion reaped
+	ringDone bool   // the io_uring completion is reaped, to be applied
+}
+
+// result converts the aiocb to OpResult
+func (pcb *aiocb) result() OpResult {
+	return OpResult{Operation: pcb.op, Conn: pcb.conn, IsSwapBuffer: pcb.useSwap, Buffer: pcb.buffer, Buffers: pcb.bufs, Size: pcb.size, Error: pcb.err, Context: pcb.ctx, Fd: pcb.fd, Addr: pcb.addr, Sizes: pcb.sizes, Addrs: pcb.addrs, LocalAddr: pcb.laddr, RemoteAddr: pcb.raddr, Pending: pcb.pending, Fds: pcb.fds, OOB: pcb.oob, OOBn: pcb.oobn, Flags: pcb.flags, Seq: pcb.opSeq}
+}
+
+// unwritten returns the bytes of a write operation not yet written
+func (pcb *aiocb) unwritten() int {
+	switch {
+	case pcb.bufs != nil:
+		return pcb.bufsLen - pcb.size
+	case pcb.file != nil:
+		return int(pcb.count) - pcb.size
+	}
+	return len(pcb.buffer) - pcb.size
 }
 
 // Watcher will monitor events and process async-io request(s),
@@ -131,3 +529,150 @@ type Watcher struct {
 	// a wrapper for watcher for gc purpose
 	*watcher
 }
+
+// sockaddrToAddr converts the source address of a datagram
+func sockaddrToAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		var zone string
+		if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+			zone = ifi.Name
+		}
+		return &net.UDPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port, Zone: zone}
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Name: sa.Name, Net: "unixgram"}
+	}
+	return nil
+}
+
+// addrToSockaddr converts the destination address of a datagram, IPv4 addresses are
+// mapped to IPv6 for the sockets of 'inet6' family, like dual-stack ones.
+func addrToSockaddr(addr net.Addr, inet6 bool) (syscall.Sockaddr, error) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		if ip4 := addr.IP.To4(); ip4 != nil && !inet6 {
+			sa := &syscall.SockaddrInet4{Port: addr.Port}
+			copy(sa.Addr[:], ip4)
+			return sa, nil
+		}
+		if ip6 := addr.IP.To16(); ip6 != nil {
+			sa := &syscall.SockaddrInet6{Port: addr.Port}
+			copy(sa.Addr[:], ip6)
+			if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+				sa.ZoneId = uint32(ifi.Index)
+			}
+			return sa, nil
+		}
+	case *net.TCPAddr:
+		if addr != nil {
+			return addrToSockaddr(&net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}, inet6)
+		}
+	case *net.UnixAddr:
+		if addr != nil {
+			return &syscall.SockaddrUnix{Name: addr.Name}, nil
+		}
+	}
+	return nil, ErrInvalidAddr
+}
+
+// connResetError is ErrConnReset wrapping the errno of the syscall
+type connResetError struct {
+	errno syscall.Errno
+}
+
+func (e *connResetError) Error() string        { return ErrConnReset.Error() + ": " + e.errno.Error() }
+func (e *connResetError) Unwrap() error        { return e.errno }
+func (e *connResetError) Is(target error) bool { return target == ErrConnReset }
+
+// retryOnEINTR calls 'f' again while it's interrupted by a signal(EINTR), the handlers
+// of Go are installed with SA_RESTART, but some syscalls are not restarted, like on
+// darwin under signals. close(2) must never be retried, the fd is released on EINTR.
+func retryOnEINTR(f func() error) error {
+	for {
+		if err := f(); err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// noFdsError is ErrNoFileDescriptors with the errno, and the number of connections
+// being watched when it happened for diagnostics
+type noFdsError struct {
+	errno syscall.Errno
+	conns int
+}
+
+func (e *noFdsError) Error() string {
+	return ErrNoFileDescriptors.Error() + ": " + e.errno.Error() + ", " + strconv.Itoa(e.conns) + " connections watched"
+}
+func (e *noFdsError) Unwrap() error        { return e.errno }
+func (e *noFdsError) Is(target error) bool { return target == ErrNoFileDescriptors }
+
+// connError normalizes the errors of a terminated connection into ErrConnReset
+func connError(err error) error {
+	if errno, ok := err.(syscall.Errno); ok && (errno == syscall.ECONNRESET || errno == syscall.EPIPE) {
+		return &connResetError{errno}
+	}
+	return err
+}
+
+// deadlineError is the type of ErrDeadline, a net.Error for the libraries
+// checking timeouts on net.Conn
+type deadlineError struct{}
+
+func (deadlineError) Error() string   { return "operation exceeded deadline" }
+func (deadlineError) Timeout() bool   { return true }
+func (deadlineError) Temporary() bool { return true }
+
+// IsConnReset reports whether err means the connection was reset by peer(ECONNRESET),
+// the connection is terminated.
+func IsConnReset(err error) bool { return errors.Is(err, syscall.ECONNRESET) }
+
+// IsBrokenPipe reports whether err means writing on a connection closed by peer(EPIPE),
+// the connection is terminated.
+func IsBrokenPipe(err error) bool { return errors.Is(err, syscall.EPIPE) }
+
+// IsNotConnected reports whether err means the socket is not connected(ENOTCONN),
+// it may be retried on a socket still connecting.
+func IsNotConnected(err error) bool { return errors.Is(err, syscall.ENOTCONN) }
+
+// Capabilities are the optional operations supported by a watcher on the current platform,
+// the operations unsupported fail with ErrUnsupported, or fall back as documented.
+type Capabilities struct {
+	// Splice reports whether Splice moves data between conns in kernel with splice(2)
+	Splice bool
+	// SendFile reports whether SendFile transfers files in kernel with sendfile(2)
+	SendFile bool
+	// Recvmmsg reports whether ReadMulti receives many datagrams per syscall with
+	// recvmmsg(2), otherwise one datagram is received per syscall
+	Recvmmsg bool
+	// EdgeTriggered reports whether the descriptors are registered edge-triggered by default
+	EdgeTriggered bool
+	// ReusePortBalance reports whether the connections to the listeners of ListenReusePort
+	// are balanced across them by the kernel
+	ReusePortBalance bool
+}
+
+// wrappedError annotates a sentinel error with its cause, so both can be
+// checked by errors.Is.
+type wrappedError struct {
+	sentinel error
+	cause    error
+}
+
+func (e *wrappedError) Error() string        { return e.sentinel.Error() + ": " + e.cause.Error() }
+func (e *wrappedError) Is(target error) bool { return target == e.sentinel }
+func (e *wrappedError) Unwrap() error        { return e.cause }
+
+// rawSendfile transfers the file region starting from 'offset' to fd, the offset is passed
+// by value since linux advances it while BSDs don't, bytes written might be reported along
+// with EAGAIN on BSDs, and is never negative.
+func rawSendfile(fd int, src int, offset int64, count int) (n int, err error) {
+	n, err = syscall.Sendfile(fd, src, &offset, count)
+	if n < 0 {
+		n = 0
+	}
+	return
+}
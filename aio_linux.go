@@ -4,6 +4,7 @@ package gaio
 
 import (
 	"net"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -23,6 +24,8 @@ type poller struct {
 	efd    int        // eventfd
 	efdbuf []byte
 
+	maxEvents int // max events returned by a wait
+
 	// closing signal
 	die     chan struct{}
 	dieOnce sync.Once
@@ -30,20 +33,17 @@ type poller struct {
 
 // dupconn use RawConn to dup() file descriptor
 func dupconn(conn net.Conn) (newfd int, err error) {
-	sc, ok := conn.(interface {
-		SyscallConn() (syscall.RawConn, error)
-	})
-	if !ok {
-		return -1, ErrUnsupported
-	}
-	rc, err := sc.SyscallConn()
+	rc, err := rawConn(conn)
 	if err != nil {
 		return -1, ErrUnsupported
 	}
 
 	// Control() guarantees the integrity of file descriptor
 	ec := rc.Control(func(fd uintptr) {
-		newfd, err = syscall.Dup(int(fd))
+		err = retryOnEINTR(func() (err error) {
+			newfd, err = syscall.Dup(int(fd))
+			return err
+		})
 	})
 
 	if ec != nil {
@@ -53,7 +53,31 @@ func dupconn(conn net.Conn) (newfd int, err error) {
 	return
 }
 
-func openPoll() (*poller, error) {
+// backend is the name of the poller
+const backend = "epoll"
+
+// capabilities returns the optional operations supported on linux
+func capabilities() Capabilities {
+	return Capabilities{
+		Splice:           true,
+		SendFile:         true,
+		Recvmmsg:         true,
+		EdgeTriggered:    true,
+		ReusePortBalance: true,
+	}
+}
+
+// soReusePort returns the value of SO_REUSEPORT, which is missing in syscall on linux
+func soReusePort() int {
+	switch runtime.GOARCH {
+	case "mips", "mipsle", "mips64", "mips64le":
+		return 0x200
+	}
+	return 0xf
+}
+
+// openPoll opens a poller returning at most 'maxEvents' events by a wait
+func openPoll(maxEvents int) (*poller, error) {
 	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
 	if err != nil {
 		return nil, err
@@ -78,6 +102,7 @@ func openPoll() (*poller, error) {
 	p.pfd = fd
 	p.efd = int(r0)
 	p.efdbuf = make([]byte, 8)
+	p.maxEvents = maxEvents
 	p.die = make(chan struct{})
 	p.cpuid = -1
 
@@ -93,7 +118,51 @@ func (p *poller) Close() error {
 }
 
 func (p *poller) Watch(fd int) error {
-	return syscall.EpollCtl(p.pfd, syscall.EPOLL_CTL_ADD, int(fd), &syscall.EpollEvent{Fd: int32(fd), Events: syscall.EPOLLRDHUP | syscall.EPOLLIN | syscall.EPOLLOUT | _EPOLLET})
+	// level-triggered descriptors are registered on demand by Interest
+	if p.levelTriggered {
+		return nil
+	}
+	return retryOnEINTR(func() error {
+		return syscall.EpollCtl(p.pfd, syscall.EPOLL_CTL_ADD, int(fd), &syscall.EpollEvent{Fd: int32(fd), Events: syscall.EPOLLRDHUP | syscall.EPOLLIN | syscall.EPOLLOUT | syscall.EPOLLPRI | _EPOLLET})
+	})
+}
+
+// Unwatch removes the descriptor from epoll, without closing it
+func (p *poller) Unwatch(fd int) error {
+	err := retryOnEINTR(func() error {
+		return syscall.EpollCtl(p.pfd, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{})
+	})
+	// level-triggered descriptors without interest are not registered
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// Interest changes the events interested on a level-triggered descriptor from 'prev' to 'next',
+// the descriptor is removed from epoll if nothing is interested, as EPOLLHUP and EPOLLERR
+// cannot be masked.
+func (p *poller) Interest(fd int, prev, next int) error {
+	var events uint32
+	if next&EV_READ != 0 {
+		events |= syscall.EPOLLIN | syscall.EPOLLRDHUP
+	}
+	if next&EV_WRITE != 0 {
+		events |= syscall.EPOLLOUT
+	}
+	if next&EV_OOB != 0 {
+		events |= syscall.EPOLLPRI
+	}
+
+	op := syscall.EPOLL_CTL_MOD
+	if prev == 0 {
+		op = syscall.EPOLL_CTL_ADD
+	} else if next == 0 {
+		op = syscall.EPOLL_CTL_DEL
+	}
+	return retryOnEINTR(func() error {
+		return syscall.EpollCtl(p.pfd, op, fd, &syscall.EpollEvent{Fd: int32(fd), Events: events})
+	})
 }
 
 // wakeup interrupt epoll_wait
@@ -102,7 +171,10 @@ func (p *poller) wakeup() error {
 	if p.efd != -1 {
 		var x uint64 = 1
 		// eventfd has set with EFD_NONBLOCK
-		_, err := syscall.Write(p.efd, (*(*[8]byte)(unsafe.Pointer(&x)))[:])
+		err := retryOnEINTR(func() error {
+			_, err := syscall.Write(p.efd, (*(*[8]byte)(unsafe.Pointer(&x)))[:])
+			return err
+		})
 		p.mu.Unlock()
 		return err
 	}
@@ -110,9 +182,11 @@ func (p *poller) wakeup() error {
 	return ErrPollerClosed
 }
 
-func (p *poller) Wait(chEventNotify chan pollerEvents) {
+// Wait polls for events and notifies them to chEventNotify until the poller is closed,
+// a non-nil error is returned if the poller failed.
+func (p *poller) Wait(chEventNotify chan pollerEvents) error {
 	p.initCache(cap(chEventNotify) + 2)
-	events := make([]syscall.EpollEvent, maxEvents)
+	events := make([]syscall.EpollEvent, p.maxEvents)
 	// close poller fd & eventfd in defer
 	defer func() {
 		p.mu.Lock()
@@ -127,14 +201,19 @@ func (p *poller) Wait(chEventNotify chan pollerEvents) {
 	for {
 		select {
 		case <-p.die:
-			return
+			return nil
 		default:
 			n, err := syscall.EpollWait(p.pfd, events, -1)
 			if err == syscall.EINTR {
 				continue
 			}
 			if err != nil {
-				return
+				select {
+				case <-p.die: // closed
+					return nil
+				default:
+					return err
+				}
 			}
 
 			// load from cache
@@ -163,6 +242,19 @@ func (p *poller) Wait(chEventNotify chan pollerEvents) {
 					if ev.Events&(syscall.EPOLLOUT|syscall.EPOLLERR|syscall.EPOLLHUP) != 0 {
 						e.ev |= EV_WRITE
 					}
+					// exceptional condition, out-of-band data
+					if ev.Events&syscall.EPOLLPRI != 0 {
+						e.ev |= EV_OOB
+					}
+					// both directions are closed, or error, EPOLLRDHUP alone is
+					// a half-close, the socket is still writable.
+					if ev.Events&(syscall.EPOLLERR|syscall.EPOLLHUP) != 0 {
+						e.ev |= EV_HUP
+					}
+					// the errno is retrieved by the loop with SO_ERROR on demand
+					if ev.Events&syscall.EPOLLERR != 0 {
+						e.ev |= EV_ERR
+					}
 
 					pe = append(pe, e)
 				}
@@ -171,7 +263,7 @@ func (p *poller) Wait(chEventNotify chan pollerEvents) {
 			select {
 			case chEventNotify <- pe:
 			case <-p.die:
-				return
+				return nil
 			}
 		}
 	}
@@ -233,3 +325,115 @@ func rawWrite(fd int, p []byte) (n int, err error) {
 	}
 	return
 }
+
+// raw accept with accept4(2), the connection accepted is close-on-exec atomically, so
+// it never leaks to a child forked in the meantime
+func rawAccept(fd int) (nfd int, err error) {
+	nfd, _, err = syscall.Accept4(fd, syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK)
+	return nfd, err
+}
+
+// raw writev for nonblocking vector write
+func rawWritev(fd int, iovecs []syscall.Iovec) (n int, err error) {
+	r0, _, e1 := syscall.RawSyscall(syscall.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	n = int(r0)
+	if e1 != 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+// raw readv for nonblocking vector read
+func rawReadv(fd int, iovecs []syscall.Iovec) (n int, err error) {
+	r0, _, e1 := syscall.RawSyscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+	n = int(r0)
+	if e1 != 0 {
+		err = errnoErr(e1)
+	}
+	return
+}
+
+// mmsghdr is struct mmsghdr of recvmmsg(2)
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// raw recvmmsg for nonblocking batched receive, up to len(bufs) datagrams are received
+// in a single syscall, the size and the source address of each datagram received are
+// stored in 'sizes' and 'addrs'.
+func rawRecvmmsg(fd int, bufs [][]byte, sizes []int, addrs []net.Addr) (n int, err error) {
+	if len(bufs) > maxIovecs {
+		bufs = bufs[:maxIovecs]
+	}
+	msgs := make([]mmsghdr, len(bufs))
+	iovecs := make([]syscall.Iovec, len(bufs))
+	names := make([]syscall.RawSockaddrAny, len(bufs))
+	for i, b := range bufs {
+		if len(b) > 0 {
+			iovecs[i].Base = &b[0]
+			iovecs[i].SetLen(len(b))
+		}
+		msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		msgs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		msgs[i].hdr.Iov = &iovecs[i]
+		msgs[i].hdr.Iovlen = 1
+	}
+
+	r0, _, e1 := syscall.Syscall6(syscall.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+	if e1 != 0 {
+		return 0, errnoErr(e1)
+	}
+	n = int(r0)
+	for i := 0; i < n; i++ {
+		sizes[i] = int(msgs[i].len)
+		addrs[i] = rawSockaddrToUDPAddr(&names[i])
+	}
+	return n, nil
+}
+
+// rawSockaddrToUDPAddr converts the source address of a datagram received by recvmmsg
+func rawSockaddrToUDPAddr(rsa *syscall.RawSockaddrAny) net.Addr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return sockaddrToAddr(&syscall.SockaddrInet4{Port: int(p[0])<<8 + int(p[1]), Addr: pp.Addr})
+	case syscall.AF_INET6:
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return sockaddrToAddr(&syscall.SockaddrInet6{Port: int(p[0])<<8 + int(p[1]), ZoneId: pp.Scope_id, Addr: pp.Addr})
+	}
+	return nil
+}
+
+// bytes available to read in the socket, FIONREAD
+func rawFionread(fd int) (n int, err error) {
+	var v int32
+	_, _, e1 := syscall.RawSyscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCINQ), uintptr(unsafe.Pointer(&v)))
+	if e1 != 0 {
+		return 0, errnoErr(e1)
+	}
+	return int(v), nil
+}
+
+const (
+	spliceMove     = 0x1 // SPLICE_F_MOVE
+	spliceNonblock = 0x2 // SPLICE_F_NONBLOCK
+)
+
+// raw splice moves up to 'n' bytes between descriptors without copying to userspace,
+// one of them must be a pipe
+func rawSplice(rfd int, wfd int, n int) (int, error) {
+	r0, _, e1 := syscall.RawSyscall6(syscall.SYS_SPLICE, uintptr(rfd), 0, uintptr(wfd), 0, uintptr(n), spliceMove|spliceNonblock)
+	if e1 != 0 {
+		return 0, errnoErr(e1)
+	}
+	return int(r0), nil
+}
+
+// newSplicePipe creates the nonblocking pipe of a splice operation
+func newSplicePipe() (p [2]int, err error) {
+	err = syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	return
+}
@@ -0,0 +1,203 @@
+// +build linux
+
+package gaio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPollerFailed(t *testing.T) {
+	w, err := NewWatcherManual(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// inject a poller error by replacing epoll fd with a non-epoll one
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	epfd := w.pfd.pfd
+	w.pfd.pfd = fds[0]
+	defer syscall.Close(epfd)
+	go w.Run()
+
+	_, err = w.WaitIO()
+	if !errors.Is(err, ErrPollerFailed) || !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("expected ErrPollerFailed wrapping EINVAL, got", err)
+	}
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+	if err := w.Read(nil, local, nil); err != ErrWatcherClosed {
+		t.Fatal("expected ErrWatcherClosed after poller failed, got", err)
+	}
+}
+
+func TestLevelTriggeredInterest(t *testing.T) {
+	w, err := NewWatcherOpts(Options{LevelTriggered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// interests are updated at the end of a loop round, wait for it
+	registered := func(fd int, expected bool) bool {
+		for i := 0; i < 100; i++ {
+			err := syscall.EpollCtl(w.pfd.pfd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Fd: int32(fd), Events: syscall.EPOLLIN | syscall.EPOLLRDHUP})
+			if (err == nil) == expected {
+				return expected
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return !expected
+	}
+
+	// the descriptor is registered only with operations queued
+	w.Read("read", local, make([]byte, 16))
+	w.Write("write", local, []byte("x"))
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			switch res.Context {
+			case "write":
+				if !registered(res.Fd, true) {
+					t.Fatal("descriptor with read queued is not registered")
+				}
+				remote.Write([]byte("y"))
+			case "read":
+				if registered(res.Fd, false) {
+					t.Fatal("idle descriptor is registered")
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestSplice(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// client -> (in, src) splice (dst, out) -> server
+	in, src := tcpPair(t)
+	dst, out := tcpPair(t)
+	defer out.Close()
+
+	tx := make([]byte, 1<<20)
+	rand.Read(tx)
+	go func() {
+		in.Write(tx)
+		in.Write([]byte("tail"))
+		in.Close()
+	}()
+
+	// a slow server blocks the splice on the destination
+	dst.(*net.TCPConn).SetWriteBuffer(4096)
+	rx := make(chan []byte)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		data, _ := ioutil.ReadAll(out)
+		rx <- data
+	}()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	if err := w.Splice("count", src, dst, len(tx), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	res := waitResult()
+	if res.Operation != OpSplice || res.Error != nil || res.Size != len(tx) {
+		t.Fatal("incorrect splice", res.Operation, res.Error, res.Size)
+	}
+
+	// splice the rest until EOF
+	w.Splice("eof", src, dst, 0, time.Time{})
+	res = waitResult()
+	if res.Error != io.EOF || res.Size != 4 {
+		t.Fatal("incorrect splice until EOF", res.Error, res.Size)
+	}
+
+	w.Free(dst)
+	if data := <-rx; !bytes.Equal(data, append(tx, "tail"...)) {
+		t.Fatal("incorrect content spliced", len(data))
+	}
+}
+
+func TestNoFileDescriptors(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+
+	// limit the fds below the lowest free one, dup(2) fails with EMFILE
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+	limited := rlim
+	limited.Cur = uint64(fd)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limited); err != nil {
+		t.Skip("cannot set rlimit", err)
+	}
+
+	w.Read(nil, local, make([]byte, 1))
+	var res OpResult
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			res = results[0]
+			break
+		}
+	}
+	syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
+
+	if !errors.Is(res.Error, ErrNoFileDescriptors) || errors.Unwrap(res.Error) != syscall.EMFILE {
+		t.Fatal("expected ErrNoFileDescriptors wrapping EMFILE, got", res.Error)
+	}
+}
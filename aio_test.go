@@ -1,14 +1,33 @@
 package gaio
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
+	mrand "math/rand"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -113,6 +132,34 @@ func hangupServer(t testing.TB, bufsize int) net.Listener {
 	return ln
 }
 
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	chConn := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println(err)
+		}
+		chConn <- conn
+	}()
+
+	local, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-chConn
+	if remote == nil {
+		t.Fatal("accept failed")
+	}
+	return local, remote
+}
+
 func TestEchoTiny(t *testing.T) {
 	ln := echoServer(t, 1)
 	defer ln.Close()
@@ -185,35 +232,318 @@ func TestUnsupportedConn(t *testing.T) {
 		t.Fatal("incorrect empty conn handling")
 	}
 
-	//
+	// conns without file descriptors are rejected on submission
 	p1, p2 := net.Pipe()
-	w.Write(nil, p1, make([]byte, 1))
-	w.Read(nil, p2, make([]byte, 1))
+	defer p1.Close()
+	defer p2.Close()
+	if err := w.Write(nil, p1, make([]byte, 1)); err != ErrUnsupportedConn {
+		t.Fatal("expected ErrUnsupportedConn, got", err)
+	}
+	if err := w.Read(nil, p2, make([]byte, 1)); err != ErrUnsupportedConn {
+		t.Fatal("expected ErrUnsupportedConn, got", err)
+	}
+
+	// a *tls.Conn is pointed to the conn underneath
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+	err = w.Read(nil, tls.Client(local, &tls.Config{}), make([]byte, 1))
+	if !errors.Is(err, ErrUnsupportedConn) || !strings.Contains(err.Error(), "tls") {
+		t.Fatal("expected ErrUnsupportedConn for *tls.Conn, got", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	if err := Validate(local); err != nil {
+		t.Fatal(err)
+	}
+
+	local.Close()
+	if err := Validate(local); err == nil {
+		t.Fatal("closed conn validated")
+	}
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	if err := Validate(p1); err != ErrNoRawConn {
+		t.Fatal("incorrect error for pipe", err)
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	if err := Validate(udp); err != nil {
+		t.Fatal("incorrect error for udp", err)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	f := os.NewFile(uintptr(fds[0]), "seqpacket")
+	seqpacket, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seqpacket.Close()
+	if err := Validate(seqpacket); err != ErrSocketType {
+		t.Fatal("incorrect error for seqpacket", err)
+	}
+}
+
+func TestSetSockOpt(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	if err := w.SetSockOpt(local, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0); err != ErrNotWatched {
+		t.Fatal("expected ErrNotWatched, got", err)
+	}
+
+	w.Write(nil, local, []byte("hello"))
+	if err := w.SetSockOpt(local, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetSockOpt(local, syscall.SOL_SOCKET, -1, 0); err == nil {
+		t.Fatal("invalid option should fail")
+	}
 
 	for {
 		results, err := w.WaitIO()
 		if err != nil {
-			t.Log(err)
+			t.Fatal(err)
+		}
+		if len(results) == 0 {
+			continue
+		}
+
+		nodelay, err := syscall.GetsockoptInt(results[0].Fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		if err != nil || nodelay != 0 {
+			t.Fatal("option not set on the watched fd", nodelay, err)
+		}
+		return
+	}
+}
+
+func TestUDP(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Read("datagram", server, nil)
+	w.Read("empty", server, make([]byte, 16))
+	w.Write("sent", client, []byte("hello"))
+
+	var completed int
+	for completed < 3 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		var count int
 		for _, res := range results {
-			switch res.Operation {
-			case OpRead:
-				if res.Error == ErrUnsupported {
-					count++
-					if count == 2 {
-						return
-					}
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			switch res.Context {
+			case "sent":
+				if res.Size != 5 {
+					t.Fatal("incorrect size sent", res.Size)
 				}
-			case OpWrite:
-				if res.Error == ErrUnsupported {
-					count++
-					if count == 2 {
-						return
-					}
+				// an empty datagram
+				if _, err := syscall.Write(res.Fd, nil); err != nil {
+					t.Fatal(err)
+				}
+			case "datagram":
+				if string(res.Buffer[:res.Size]) != "hello" {
+					t.Fatal("incorrect datagram", string(res.Buffer[:res.Size]))
+				}
+				if res.Addr == nil || res.Addr.String() != client.LocalAddr().String() {
+					t.Fatal("incorrect source address", res.Addr)
+				}
+			case "empty":
+				if res.Size != 0 || res.Addr == nil {
+					t.Fatal("empty datagram should be delivered", res.Size, res.Addr)
 				}
+			default:
+				continue
+			}
+			completed++
+		}
+	}
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// an unconnected dual-stack server replies to the source of the datagram
+	server, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: server.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := w.WriteTo(nil, server, []byte("x"), &net.TCPAddr{}, time.Time{}); err != ErrInvalidAddr {
+		t.Fatal("expected ErrInvalidAddr, got", err)
+	}
+
+	client.Write([]byte("ping"))
+	w.ReadFrom(nil, server, nil, time.Time{})
+	res := waitResult()
+	if res.Error != nil || string(res.Buffer[:res.Size]) != "ping" || res.Addr == nil {
+		t.Fatal("incorrect datagram", res.Error, res.Addr)
+	}
+	w.WriteTo(nil, server, []byte("pong"), res.Addr, time.Time{})
+	if res := waitResult(); res.Error != nil || res.Size != 4 {
+		t.Fatal("incorrect datagram sent", res.Error, res.Size)
+	}
+	buf := make([]byte, 16)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatal("incorrect reply", err, string(buf[:n]))
+	}
+
+	// unixgram
+	dir, err := ioutil.TempDir("", "gaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	laddr := &net.UnixAddr{Name: dir + "/server", Net: "unixgram"}
+	raddr := &net.UnixAddr{Name: dir + "/client", Net: "unixgram"}
+	userver, err := net.ListenUnixgram("unixgram", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uclient, err := net.ListenUnixgram("unixgram", raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uclient.Close()
+
+	w.WriteTo(nil, userver, []byte("hello"), raddr, time.Time{})
+	if res := waitResult(); res.Error != nil || res.Size != 5 {
+		t.Fatal("incorrect unixgram sent", res.Error, res.Size)
+	}
+	uclient.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := uclient.ReadFromUnix(buf)
+	if err != nil || string(buf[:n]) != "hello" || from.Name != laddr.Name {
+		t.Fatal("incorrect unixgram received", err, from)
+	}
+	uclient.WriteToUnix([]byte("back"), laddr)
+	w.ReadFrom(nil, userver, nil, time.Time{})
+	res = waitResult()
+	if res.Error != nil || string(res.Buffer[:res.Size]) != "back" || res.Addr.String() != raddr.Name {
+		t.Fatal("incorrect unixgram", res.Error, res.Addr)
+	}
+}
+
+func TestReadMulti(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := w.ReadMulti(nil, server, make([][]byte, 4), time.Time{}); err != ErrEmptyBuffer {
+		t.Fatal("expected ErrEmptyBuffer, got", err)
+	}
+
+	const count = 5
+	for i := 0; i < count; i++ {
+		if _, err := client.Write([]byte(fmt.Sprint("datagram", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bufs := make([][]byte, 8)
+	for i := range bufs {
+		bufs[i] = make([]byte, 64)
+	}
+	if err := w.ReadMulti("multi", server, bufs, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the datagrams queued are received in a single result
+	var received int
+	for received < count {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := results[0]
+		if res.Error != nil || len(res.Sizes) != len(res.Addrs) || len(res.Sizes) == 0 {
+			t.Fatal("unexpected result", res.Error, len(res.Sizes), len(res.Addrs))
+		}
+		var total int
+		for i, size := range res.Sizes {
+			if msg := string(res.Buffers[i][:size]); msg != fmt.Sprint("datagram", received) {
+				t.Fatal("incorrect datagram", msg)
+			}
+			if res.Addrs[i].String() != client.LocalAddr().String() {
+				t.Fatal("incorrect source address", res.Addrs[i])
 			}
+			total += size
+			received++
+		}
+		if res.Size != total {
+			t.Fatal("incorrect total size", res.Size, total)
+		}
+		if received < count {
+			w.ReadMulti("multi", server, bufs[received:], time.Time{})
 		}
 	}
 }
@@ -332,6 +662,97 @@ func TestBidirectionWatcher(t *testing.T) {
 	testBidirectionWatcher(t, w)
 }
 
+func testQueuedOperations(t *testing.T, w *Watcher) {
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// a single event drains multiple queued reads
+	for i := 0; i < 3; i++ {
+		w.Read(i, local, make([]byte, 5))
+	}
+	remote.Write([]byte("aaaaabbbbbccccc"))
+
+	// queued writes complete with the peer reading
+	payload := make([]byte, 4*1024*1024)
+	w.Write("write", local, payload)
+	w.Write("write", local, payload)
+	go io.ReadFull(remote, make([]byte, 2*len(payload)))
+
+	var reads, writes int
+	for reads < 3 || writes < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			if res.Operation == OpWrite {
+				writes++
+				continue
+			}
+			if res.Context != reads || res.Size != 5 || res.Buffer[0] != "abc"[reads] {
+				t.Fatal("incorrect read", res.Context, res.Size)
+			}
+			reads++
+		}
+	}
+}
+
+func TestQueuedOperations(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	testQueuedOperations(t, w)
+}
+
+func TestLevelTriggered(t *testing.T) {
+	w, err := NewWatcherOpts(Options{LevelTriggered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	testQueuedOperations(t, w)
+}
+
+func TestManualWatcher(t *testing.T) {
+	w, err := NewWatcherManual(defaultInternalBufferSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		close(done)
+	}()
+	testBidirectionWatcher(t, w)
+
+	w.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
+
+func TestManualWatcherCloseWithoutRun(t *testing.T) {
+	w, err := NewWatcherManual(defaultInternalBufferSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Run after Close returns immediately
+	w.Run()
+}
+
 func testBidirectionWatcher(t *testing.T, w *Watcher) {
 	ln := echoServer(t, 65536)
 	defer ln.Close()
@@ -448,468 +869,5358 @@ func TestReadFull(t *testing.T) {
 	}
 }
 
-func TestSocketClose(t *testing.T) {
-	ln := echoServer(t, 1024)
-	defer ln.Close()
-	conn, err := net.Dial("tcp", ln.Addr().String())
-	if err != nil {
-		t.Fatal(err)
-	}
-
+func TestShutdown(t *testing.T) {
 	w, err := NewWatcher()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer w.Close()
-	defer time.Sleep(1 * time.Second)
 
-	tx := []byte("hello world")
-	// send
-	err = w.Write(nil, conn, tx)
-	if err != nil {
-		log.Fatal(err)
+	local1, remote1 := tcpPair(t)
+	defer remote1.Close()
+	local2, remote2 := tcpPair(t)
+	defer remote2.Close()
+
+	w.Write("written", local1, []byte("hello"))
+	w.Read("pending", local1, make([]byte, 16))
+	w.ReadTimeout("pending", local2, make([]byte, 16), time.Now().Add(time.Minute))
+	for w.Stats().Completions == 0 {
+		time.Sleep(10 * time.Millisecond)
 	}
-	for {
-		results, err := w.WaitIO()
-		if err != nil {
-			t.Log(err)
-			return
-		}
 
-		for _, res := range results {
-			switch res.Operation {
-			case OpWrite:
-				w.Free(conn)
-				w.Read(nil, conn, tx)
-			case OpRead:
-				if res.Error != nil {
-					t.Log(res.Error)
-					return
-				}
+	results, err := w.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatal("expected 3 results, got", len(results))
+	}
+	for _, res := range results {
+		switch res.Context {
+		case "written":
+			if res.Error != nil || res.Size != 5 {
+				t.Fatal("completed result is incorrect", res.Error, res.Size)
+			}
+		case "pending":
+			if res.Error != ErrWatcherClosed {
+				t.Fatal("expected ErrWatcherClosed, got", res.Error)
 			}
 		}
 	}
+
+	if err := w.Read(nil, local1, nil); err != ErrWatcherClosed {
+		t.Fatal("expected ErrWatcherClosed, got", err)
+	}
+	if _, err := w.WaitIO(); err != ErrWatcherClosed {
+		t.Fatal("expected ErrWatcherClosed, got", err)
+	}
 }
 
-func TestWriteOnClosedConn(t *testing.T) {
-	ln := echoServer(t, 1024)
-	defer ln.Close()
-	conn, err := net.Dial("tcp", ln.Addr().String())
-	if err != nil {
-		t.Fatal(err)
+func TestShutdownConsumers(t *testing.T) {
+	testShutdownConsumers(t, false)
+	testShutdownConsumers(t, true)
+}
+
+// every result is returned once, either to the consumer or by Shutdown
+func testShutdownConsumers(t *testing.T, callback bool) {
+	var mu sync.Mutex
+	seen := make(map[interface{}]int)
+	record := func(res OpResult) {
+		mu.Lock()
+		seen[res.Context]++
+		mu.Unlock()
 	}
-	conn.Close()
 
-	w, err := NewWatcher()
+	opts := Options{ResultShards: 2}
+	if callback {
+		opts.OnComplete = record
+	}
+	w, err := NewWatcherOpts(opts)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer w.Close()
 
-	tx := []byte("hello world")
-	go func() {
-		// send
-		err = w.Write(nil, conn, tx)
-		if err != nil {
-			log.Fatal(err)
+	var wg sync.WaitGroup
+	if !callback {
+		for k := 0; k < 2; k++ {
+			wg.Add(1)
+			go func(k int) {
+				defer wg.Done()
+				for {
+					results, err := w.WaitIOShard(k)
+					if err != nil {
+						return
+					}
+					for _, res := range results {
+						record(res)
+					}
+				}
+			}(k)
 		}
-	}()
+	}
 
-	for {
-		results, err := w.WaitIO()
-		if err != nil {
-			t.Log(err)
-			return
+	const numConns = 8
+	const numWrites = 256
+	for i := 0; i < numConns; i++ {
+		local, remote := tcpPair(t)
+		defer local.Close()
+		defer remote.Close()
+		go io.Copy(ioutil.Discard, remote)
+		for j := 0; j < numWrites; j++ {
+			w.Write(i*numWrites+j, local, []byte{1})
 		}
+	}
 
-		for _, res := range results {
-			switch res.Operation {
-			case OpWrite:
-				// recv
-				if res.Error != nil {
-					conn.Close()
-					return
-				}
-			}
+	results, err := w.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	for _, res := range results {
+		record(res)
+	}
+	if len(seen) != numConns*numWrites {
+		t.Fatal("results missing", len(seen))
+	}
+	for ctx, n := range seen {
+		if n != 1 {
+			t.Fatal("result returned more than once", ctx, n)
 		}
 	}
 }
 
-func Test1k(t *testing.T) {
-	testParallel(t, 1024, 1024)
-}
-func Test2k(t *testing.T) {
-	testParallel(t, 2048, 1024)
-}
-
-func Test4k(t *testing.T) {
-	testParallel(t, 4096, 1024)
-}
-
-func Test8k(t *testing.T) {
-	testParallel(t, 8192, 1024)
-}
-
-func Test10k(t *testing.T) {
-	testParallel(t, 10240, 1024)
-}
-
-func Test12k(t *testing.T) {
-	testParallel(t, 12288, 1024)
-}
+func TestShutdownReentrant(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
 
-func Test1kTiny(t *testing.T) {
-	testParallel(t, 1024, 16)
-}
+	local, remote := tcpPair(t)
+	defer remote.Close()
 
-func Test2kTiny(t *testing.T) {
-	testParallel(t, 2048, 16)
-}
+	// the write submitted from the hook is not processed yet when Shutdown runs
+	shutdown := make(chan []OpResult, 1)
+	var once sync.Once
+	w.SetBufferPool(func(size int) []byte {
+		once.Do(func() {
+			w.Write("reentrant", local, []byte{1})
+			results, err := w.Shutdown()
+			if err != nil {
+				t.Error(err)
+			}
+			shutdown <- results
+		})
+		return make([]byte, size)
+	}, func(buf []byte) {})
+	w.Read("read", local, nil)
 
-func Test4kTiny(t *testing.T) {
-	testParallel(t, 4096, 16)
+	var results []OpResult
+	select {
+	case results = <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown not called from the hook")
+	}
+	var found bool
+	for _, res := range results {
+		if res.Context == "reentrant" {
+			found = res.Error == ErrWatcherClosed
+		}
+	}
+	if !found {
+		t.Fatal("reentrant write not returned by Shutdown", results)
+	}
 }
 
-func testParallel(t *testing.T, par int, msgsize int) {
-	t.Log("testing concurrent:", par, "connections")
-	ln := echoServer(t, msgsize)
-	defer ln.Close()
-
+func TestSubmit(t *testing.T) {
 	w, err := NewWatcher()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer w.Close()
 
-	go func() {
-		for i := 0; i < par; i++ {
-			data := make([]byte, msgsize)
-			conn, err := net.Dial("tcp", ln.Addr().String())
-			if err != nil {
-				log.Fatal(err)
-			}
+	var remotes []net.Conn
+	var ops []Op
+	for i := 0; i < 8; i++ {
+		local, remote := tcpPair(t)
+		defer remote.Close()
+		remotes = append(remotes, remote)
+		ops = append(ops, Op{Operation: OpRead, Context: i, Conn: local, Buffer: make([]byte, 16)})
+	}
+	p1, _ := net.Pipe()
+	ops = append(ops,
+		Op{Operation: OpWrite, Conn: ops[0].Conn},
+		Op{Operation: opDelete, Conn: ops[0].Conn},
+		Op{Operation: OpRead, Conn: nil},
+		Op{Operation: OpWrite, Context: "pipe", Conn: p1, Buffer: []byte("x")},
+	)
 
-			// send
-			err = w.Write(nil, conn, data)
-			if err != nil {
-				log.Fatal(err)
-			}
+	if err := w.Submit(ops); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if ops[i].Err != nil {
+			t.Fatal(ops[i].Err)
 		}
-	}()
+	}
+	if ops[8].Err != ErrEmptyBuffer || ops[9].Err != ErrInvalidOp || ops[10].Err != ErrUnsupported || ops[11].Err != ErrUnsupportedConn {
+		t.Fatal("incorrect errors of ops", ops[8].Err, ops[9].Err, ops[10].Err, ops[11].Err)
+	}
 
-	nbytes := 0
-	ntotal := msgsize * par
-	for {
+	for _, remote := range remotes {
+		remote.Write([]byte("hello"))
+	}
+
+	var completed int
+	for completed < 8 {
 		results, err := w.WaitIO()
 		if err != nil {
-			t.Log(err)
-			return
+			t.Fatal(err)
 		}
 
 		for _, res := range results {
-			switch res.Operation {
-			case OpWrite:
-				// recv
-				if res.Error != nil {
-					continue
-				}
-
-				err = w.Read(nil, res.Conn, res.Buffer[:cap(res.Buffer)])
-				if err != nil {
-					t.Fatal(err)
-				}
-			case OpRead:
-				if res.Error != nil {
-					continue
-				}
-				if res.Size == 0 {
-					continue
-				}
-
-				nbytes += res.Size
-				if nbytes >= ntotal {
-					t.Log("completed:", nbytes)
-					return
-				}
+			if res.Error != nil || res.Size != 5 {
+				t.Fatal("read in batch failed", res.Error, res.Size)
 			}
+			completed++
 		}
 	}
 }
 
-func Test10kRandomSwapBuffer(t *testing.T) {
-	testParallelRandomInternal(t, 10240, 1024, false)
-}
+func TestCount(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
 
-func Test10kCompleteSwapBuffer(t *testing.T) {
-	testParallelRandomInternal(t, 10240, 1024, true)
-}
+	local1, remote1 := tcpPair(t)
+	defer remote1.Close()
+	local2, remote2 := tcpPair(t)
+	defer remote2.Close()
+	filled := fillSendBuffer(t, local2, remote2)
 
-func testParallelRandomInternal(t *testing.T, par int, msgsize int, allswap bool) {
-	t.Log("testing concurrent:", par, "connections")
-	ln := echoServer(t, msgsize)
-	defer ln.Close()
+	w.Read(nil, local1, make([]byte, 16))
+	w.Read(nil, local1, make([]byte, 16))
+	w.Read(nil, local2, make([]byte, 16))
+	w.Write(nil, local2, make([]byte, 16))
+
+	// requests are processed in order
+	for {
+		conns, reads, writes := w.Count()
+		if conns == 2 && reads == 3 && writes == 1 {
+			break
+		}
+		if conns > 2 || reads > 3 || writes > 1 {
+			t.Fatal("incorrect count", conns, reads, writes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w.Free(local1)
+	go io.ReadFull(remote2, make([]byte, filled+16))
+	for {
+		conns, reads, writes := w.Count()
+		if conns == 1 && reads == 1 && writes == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w.Close()
+	if conns, reads, writes := w.Count(); conns != 0 || reads != 0 || writes != 0 {
+		t.Fatal("closed watcher should count nothing", conns, reads, writes)
+	}
+}
 
+func TestResultFd(t *testing.T) {
 	w, err := NewWatcher()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer w.Close()
 
-	go func() {
-		for i := 0; i < par; i++ {
-			data := make([]byte, msgsize)
-			conn, err := net.Dial("tcp", ln.Addr().String())
-			if err != nil {
-				log.Fatal(err)
-			}
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	closed, closedRemote := tcpPair(t)
+	defer closedRemote.Close()
+	closed.Close()
 
-			// send
-			err = w.Write(nil, conn, data)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	}()
+	w.Write("watched", local, []byte("hello"))
+	w.Write("closed", closed, []byte("hello"))
 
-	nbytes := 0
-	ntotal := msgsize * par
-	for {
+	var completed int
+	for completed < 2 {
 		results, err := w.WaitIO()
 		if err != nil {
-			t.Log(err)
-			return
+			t.Fatal(err)
 		}
 
 		for _, res := range results {
-			switch res.Operation {
-			case OpWrite:
-				// recv
-				if res.Error != nil {
-					continue
-				}
-
-				// inject random nil buffer to test internal buffer
-				var err error
-				var rnd int32
-				binary.Read(rand.Reader, binary.LittleEndian, &rnd)
-				if allswap || rnd%13 == 0 {
-					err = w.Read(nil, res.Conn, nil)
-				} else {
-					err = w.Read(nil, res.Conn, res.Buffer[:cap(res.Buffer)])
-				}
-
-				if err != nil {
-					t.Fatal(err)
-				}
-			case OpRead:
+			switch res.Context {
+			case "watched":
 				if res.Error != nil {
-					continue
+					t.Fatal(res.Error)
 				}
-				if res.Size == 0 {
-					continue
+				sotype, err := syscall.GetsockoptInt(res.Fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+				if err != nil || sotype != syscall.SOCK_STREAM {
+					t.Fatal("Fd is not the socket operated on", res.Fd, err)
 				}
-
-				nbytes += res.Size
-				if nbytes >= ntotal {
-					t.Log("completed:", nbytes)
-					return
+			case "closed":
+				if res.Error == nil || res.Fd != -1 {
+					t.Fatal("expected error with Fd -1", res.Error, res.Fd)
 				}
 			}
+			completed++
 		}
 	}
 }
 
-func TestDeadline1k(t *testing.T) {
-	testDeadline(t, 1024)
-}
-
-func TestDeadline2k(t *testing.T) {
-	testDeadline(t, 2048)
-}
-func TestDeadline4k(t *testing.T) {
-	testDeadline(t, 4096)
-}
-
-func TestDeadline8k(t *testing.T) {
-	testDeadline(t, 8192)
-}
-
-func testDeadline(t *testing.T, par int) {
-	t.Log("testing concurrent:", par, "unresponsive connections")
-	ln := echoServer(t, 128)
-	defer ln.Close()
-
+func TestReadAtLeast(t *testing.T) {
 	w, err := NewWatcher()
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer w.Close()
 
-	die := make(chan struct{})
-	go func() {
-		for i := 0; i < par; i++ {
-			conn, err := net.Dial("tcp", ln.Addr().String())
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer conn.Close()
+	local, remote := tcpPair(t)
+	defer remote.Close()
 
-			// send nothing, but submit a read request with timeout
-			err = w.ReadTimeout(nil, conn, nil, time.Now().Add(time.Second))
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-		<-die
+	if err := w.ReadAtLeast(nil, local, nil, 1, time.Time{}); err != ErrEmptyBuffer {
+		t.Fatal("expected ErrEmptyBuffer, got", err)
+	}
+	if err := w.ReadAtLeast(nil, local, make([]byte, 8), 9, time.Time{}); err != ErrInvalidMin {
+		t.Fatal("expected ErrInvalidMin, got", err)
+	}
+	if err := w.ReadAtLeast(nil, local, make([]byte, 8), 0, time.Time{}); err != ErrInvalidMin {
+		t.Fatal("expected ErrInvalidMin, got", err)
+	}
+
+	w.ReadAtLeast(nil, local, make([]byte, 64), 4, time.Time{})
+	go func() {
+		remote.Write([]byte("he"))
+		time.Sleep(50 * time.Millisecond)
+		remote.Write([]byte("llo world"))
 	}()
 
-	nerrs := 0
 	for {
 		results, err := w.WaitIO()
 		if err != nil {
-			t.Log(err)
-			return
+			t.Fatal(err)
 		}
 
 		for _, res := range results {
-			switch res.Operation {
-			case OpRead:
-				if res.Error == ErrDeadline {
-					nerrs++
-					if nerrs == par {
-						t.Log("all deadline reached")
-						close(die)
-						return
-					}
-				}
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			if res.Size < 4 {
+				t.Fatal("completed before min bytes", res.Size)
+			}
+			if string(res.Buffer[:res.Size]) != "hello world" {
+				t.Fatal("incorrect content", string(res.Buffer[:res.Size]))
 			}
+			return
 		}
 	}
 }
 
-func BenchmarkEcho128B(b *testing.B) {
-	benchmarkEcho(b, 128, 1)
-}
-
-func BenchmarkEcho1K(b *testing.B) {
-	benchmarkEcho(b, 1024, 1)
-}
-
-func BenchmarkEcho4K(b *testing.B) {
-	benchmarkEcho(b, 4096, 1)
-}
-
-func BenchmarkEcho64K(b *testing.B) {
-	benchmarkEcho(b, 65536, 1)
-}
-
-func BenchmarkEcho128K(b *testing.B) {
-	benchmarkEcho(b, 128*1024, 1)
-}
+func TestReadFullDeadlineFunc(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
 
-func BenchmarkEcho128BParallel(b *testing.B) {
-	benchmarkEcho(b, 128, 128)
-}
+	trickle := func(conn net.Conn) {
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := conn.Write([]byte("ab")); err != nil {
+				return
+			}
+		}
+	}
 
-func BenchmarkEcho1KParallel(b *testing.B) {
-	benchmarkEcho(b, 1024, 128)
-}
+	// deadline extended on progress
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	var calls []int
+	err = w.ReadFullDeadlineFunc("extend", local, make([]byte, 10), func(soFar int) time.Time {
+		calls = append(calls, soFar)
+		return time.Now().Add(100 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go trickle(remote)
 
-func BenchmarkEcho4KParallel(b *testing.B) {
-	benchmarkEcho(b, 4096, 128)
-}
+	// fixed deadline
+	local2, remote2 := tcpPair(t)
+	defer remote2.Close()
+	deadline := time.Now().Add(100 * time.Millisecond)
+	err = w.ReadFullDeadlineFunc("fixed", local2, make([]byte, 10), func(soFar int) time.Time {
+		return deadline
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go trickle(remote2)
 
-func BenchmarkEcho64KParallel(b *testing.B) {
-	benchmarkEcho(b, 65536, 128)
-}
+	var completed int
+	for completed < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
 
-func BenchmarkEcho128KParallel(b *testing.B) {
-	benchmarkEcho(b, 128*1024, 128)
+		for _, res := range results {
+			switch res.Context {
+			case "extend":
+				if res.Error != nil || res.Size != 10 {
+					t.Fatal("read with extended deadline failed", res.Error, res.Size)
+				}
+				if len(calls) < 2 || calls[0] != 0 {
+					t.Fatal("deadline func not consulted on progress", calls)
+				}
+			case "fixed":
+				if res.Error != ErrDeadline || res.Size == 0 || res.Size == 10 {
+					t.Fatal("expected partial read with ErrDeadline", res.Error, res.Size)
+				}
+				if ne, ok := res.Error.(net.Error); !ok || !ne.Timeout() || !errors.Is(res.Error, ErrDeadline) {
+					t.Fatal("expected ErrDeadline as a timeout net.Error", res.Error)
+				}
+			}
+			completed++
+		}
+	}
 }
 
-func benchmarkEcho(b *testing.B, bufsize int, numconn int) {
-	b.Log("benchmark echo with message size:", bufsize, "with", numconn, "parallel connections, for", b.N, "times")
-	ln := echoServer(b, bufsize)
+func TestReadFullMaxSyscalls(t *testing.T) {
+	ln := echoServer(t, 65536)
 	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	w, err := NewWatcher()
 	if err != nil {
-		b.Fatal("new watcher:", err)
+		t.Fatal(err)
 	}
 	defer w.Close()
 
-	addr, _ := net.ResolveTCPAddr("tcp", ln.Addr().String())
-	for i := 0; i < numconn; i++ {
-		rx := make([]byte, bufsize)
-		tx := make([]byte, bufsize)
-		conn, err := net.DialTCP("tcp", nil, addr)
-		if err != nil {
-			b.Fatal("dial:", err)
-			return
-		}
-		w.Write(nil, conn, tx)
-		w.Read(nil, conn, rx)
-		defer conn.Close()
+	tx := make([]byte, 10*1024*1024)
+	rx := make([]byte, len(tx))
+	_, err = io.ReadFull(rand.Reader, tx)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	b.ReportAllocs()
-	b.SetBytes(int64(bufsize * numconn))
-	b.ResetTimer()
+	if err := w.Write(nil, conn, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// yield on every read syscall
+	if err := w.ReadFullMaxSyscalls(nil, conn, rx, time.Time{}, 1); err != nil {
+		t.Fatal(err)
+	}
 
-	count := 0
-	target := bufsize * b.N * numconn
 	for {
 		results, err := w.WaitIO()
 		if err != nil {
-			b.Fatal("waitio:", err)
-			return
+			t.Fatal(err)
 		}
 
 		for _, res := range results {
-			switch res.Operation {
-			case OpWrite:
+			if res.Operation == OpRead {
 				if res.Error != nil {
-					b.Fatal("read:", res.Error)
-				}
-				err := w.Write(nil, res.Conn, res.Buffer)
-				if err != nil {
-					b.Log("wirte:", err)
-				}
-			case OpRead:
-				if res.Error != nil {
-					b.Fatal("read:", res.Error)
+					t.Fatal(res.Error)
 				}
-				count += res.Size
-				if count >= target {
-					return
+				if res.Size != len(rx) {
+					t.Fatal("readfull mismatch", res.Size, len(rx))
 				}
-				//log.Println("count:", count, "target:", target)
-				err := w.Read(nil, res.Conn, res.Buffer)
-				if err != nil {
-					b.Log("read:", err)
+				if !bytes.Equal(tx, rx) {
+					t.Fatal("readfull content mismatch")
 				}
+				return
 			}
 		}
 	}
 }
 
-func BenchmarkContextSwitch(b *testing.B) {
-	die := make(chan struct{})
-	ch := make(chan struct{})
-	go func() {
+func TestReadFullYield(t *testing.T) {
+	w, err := NewWatcherManual(defaultInternalBufferSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+
+	fd, err := dupconn(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	if _, err := remote.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	pcb := &aiocb{op: OpRead, buffer: make([]byte, 4096), readFull: true, maxSyscalls: 1, idx: -1}
+	if w.tryRead(fd, pcb) {
+		t.Fatal("read full completed unexpectedly")
+	}
+	if pcb.size != 1024 {
+		t.Fatal("incorrect size", pcb.size)
+	}
+	if len(w.requeued) != 1 || w.requeued[0].ident != fd {
+		t.Fatal("operation has not been requeued")
+	}
+}
+
+func TestSetSwapBufferSize(t *testing.T) {
+	w, err := NewWatcherSize(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.SetSwapBufferSize(0); err != ErrBufferSize {
+		t.Fatal("expected ErrBufferSize, got", err)
+	}
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	read := func() OpResult {
 		for {
-			select {
-			case <-ch:
-				ch <- struct{}{}
-			case <-die:
-				return
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
 			}
 		}
-	}()
+	}
 
-	for i := 0; i < b.N; i++ {
-		ch <- struct{}{}
-		<-ch
+	// results delivered remain valid after resizing
+	w.Read(nil, local, nil)
+	remote.Write([]byte("before"))
+	before := read()
+	if err := w.SetSwapBufferSize(4096); err != nil {
+		t.Fatal(err)
+	}
+	if string(before.Buffer[:before.Size]) != "before" {
+		t.Fatal("result corrupted by resizing")
+	}
+
+	// the old buffers are in use until the result is acknowledged
+	payload := make([]byte, 3000)
+	io.ReadFull(rand.Reader, payload)
+	remote.Write(payload)
+	time.Sleep(50 * time.Millisecond)
+	w.Read(nil, local, nil)
+	time.Sleep(50 * time.Millisecond)
+	head := read()
+	if head.Error != nil || head.Size > 1024 || !bytes.Equal(head.Buffer[:head.Size], payload[:head.Size]) {
+		t.Fatal("read into old buffer failed", head.Error, head.Size)
+	}
+	if string(before.Buffer[:before.Size]) != "before" {
+		t.Fatal("result corrupted by resizing")
+	}
+
+	// the resized buffers take effect once all results are acknowledged
+	w.Recycle([]OpResult{head})
+	w.Read(nil, local, nil)
+	tail := read()
+	if tail.Error != nil || !tail.IsSwapBuffer || !bytes.Equal(tail.Buffer[:tail.Size], payload[head.Size:]) {
+		t.Fatal("read into resized buffer failed", tail.Error, tail.Size)
+	}
+}
+
+func TestSetSwapBufferSizeInFlight(t *testing.T) {
+	w, err := NewWatcherSize(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	payload := make([]byte, 3000)
+	io.ReadFull(rand.Reader, payload)
+	remote.Write(payload)
+	time.Sleep(50 * time.Millisecond)
+	w.Read(nil, local, nil)
+	var res OpResult
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			res = results[0]
+			break
+		}
+	}
+	if res.Error != nil || res.Size != len(payload) {
+		t.Fatal("incorrect read", res.Error, res.Size)
+	}
+
+	// shrinking below the result not acknowledged is rejected
+	if err := w.SetSwapBufferSize(1024); err != ErrBufferSize {
+		t.Fatal("expected ErrBufferSize, got", err)
+	}
+	if err := w.SetSwapBufferSize(len(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Buffer[:res.Size], payload) {
+		t.Fatal("result corrupted by resizing")
+	}
+
+	w.Recycle([]OpResult{res})
+	if err := w.SetSwapBufferSize(1024); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNumBuffers(t *testing.T) {
+	if _, err := NewWatcherOpts(Options{NumBuffers: 2}); err != ErrBufferSize {
+		t.Fatal("expected ErrBufferSize, got", err)
+	}
+
+	w, err := NewWatcherOpts(Options{BufferSize: 1024, NumBuffers: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// results stay intact in the ring for NumBuffers-2 more calls to WaitIO
+	var results []OpResult
+	for i := 0; i < 4; i++ {
+		w.Read(nil, local, nil)
+		remote.Write(bytes.Repeat([]byte{byte('a' + i)}, 512))
+		for {
+			r, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r) > 0 {
+				results = append(results, r[0])
+				break
+			}
+		}
+	}
+
+	for i, res := range results {
+		if !res.IsSwapBuffer || !bytes.Equal(res.Buffer[:res.Size], bytes.Repeat([]byte{byte('a' + i)}, res.Size)) {
+			t.Fatal("result overwritten", i)
+		}
+	}
+}
+
+func TestMaxEvents(t *testing.T) {
+	if _, err := NewWatcherOpts(Options{MaxEvents: minMaxEvents - 1}); err != ErrMaxEvents {
+		t.Fatal("expected ErrMaxEvents, got", err)
+	}
+
+	w, err := NewWatcherOpts(Options{MaxEvents: minMaxEvents})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// events of more conns than a poller wait returns
+	const numconn = 3 * minMaxEvents
+	var remotes []net.Conn
+	for i := 0; i < numconn; i++ {
+		local, remote := tcpPair(t)
+		defer local.Close()
+		defer remote.Close()
+		remotes = append(remotes, remote)
+		w.Read(nil, local, make([]byte, 1))
+	}
+	for _, remote := range remotes {
+		remote.Write([]byte{1})
+	}
+
+	for count := 0; count < numconn; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Error != nil || res.Size != 1 {
+				t.Fatal("incorrect result", res.Error, res.Size)
+			}
+		}
+		count += len(results)
+	}
+}
+
+func TestSwapBufferOverflow(t *testing.T) {
+	w, err := NewWatcherManual(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+
+	fd, err := dupconn(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	tx := make([]byte, 1000)
+	io.ReadFull(rand.Reader, tx)
+	if _, err := remote.Write(tx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// only 100 bytes left in the internal buffer
+	offset := w.swapSize - 100
+	w.bufferOffset = offset
+
+	pcb := &aiocb{op: OpRead, idx: -1}
+	if !w.tryRead(fd, pcb) {
+		t.Fatal("read not completed")
+	}
+	if pcb.err != nil {
+		t.Fatal(pcb.err)
+	}
+	if pcb.size != len(tx) || !bytes.Equal(pcb.buffer, tx) {
+		t.Fatal("read truncated at swap buffer boundary", pcb.size)
+	}
+	if !pcb.useSwap || w.swapIdx != 1 {
+		t.Fatal("overflowed read should spill into next swap buffer", w.swapIdx)
+	}
+	if w.bufferOffset != len(tx) {
+		t.Fatal("incorrect buffer offset", w.bufferOffset)
+	}
+
+	// the read completes in current buffer if no more data is pending
+	if _, err := remote.Write(tx[:100]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	offset = w.swapSize - 100
+	w.bufferOffset = offset
+	pcb = &aiocb{op: OpRead, idx: -1}
+	if !w.tryRead(fd, pcb) {
+		t.Fatal("read not completed")
+	}
+	if pcb.err != nil || pcb.size != 100 || !bytes.Equal(pcb.buffer, tx[:100]) {
+		t.Fatal("unexpected read", pcb.err, pcb.size)
+	}
+	if w.swapIdx != 1 || w.bufferOffset != w.swapSize {
+		t.Fatal("swap buffer should not be changed", w.swapIdx, w.bufferOffset)
+	}
+}
+
+// fillSendBuffer writes to conn until the kernel buffers between conn and peer are full
+func fillSendBuffer(t testing.TB, conn net.Conn, peer net.Conn) int {
+	// fixed size buffers to disable auto tuning
+	conn.(*net.TCPConn).SetWriteBuffer(4096)
+	peer.(*net.TCPConn).SetReadBuffer(4096)
+
+	var total int
+	for _, size := range []int{65536, 1} {
+		chunk := make([]byte, size)
+		conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+		for {
+			n, err := conn.Write(chunk)
+			total += n
+			if err != nil {
+				break
+			}
+		}
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return total
+}
+
+func TestWriteVector(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	header := []byte("header")
+	payload := make([]byte, 4*1024*1024)
+	io.ReadFull(rand.Reader, payload)
+	bufs := [][]byte{header, nil, payload, []byte("trailer")}
+	var expected []byte
+	for _, b := range bufs {
+		expected = append(expected, b...)
+	}
+
+	if err := w.WriteVector(nil, local, [][]byte{nil, {}}, time.Time{}); err != ErrEmptyBuffer {
+		t.Fatal("expected ErrEmptyBuffer, got", err)
+	}
+	if err := w.WriteVector("vector", local, bufs, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	chReceived := make(chan []byte, 1)
+	go func() {
+		rx := make([]byte, len(expected))
+		io.ReadFull(remote, rx)
+		chReceived <- rx
+	}()
+
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			if res.Context == "vector" {
+				if res.Error != nil || res.Size != len(expected) {
+					t.Fatal("vector write failed", res.Error, res.Size)
+				}
+				if !bytes.Equal(<-chReceived, expected) {
+					t.Fatal("incorrect content")
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestWriteFull(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+	local.(*net.TCPConn).SetWriteBuffer(4096)
+
+	if err := w.WriteFull(nil, local, nil, time.Time{}); err != ErrEmptyBuffer {
+		t.Fatal("expected ErrEmptyBuffer, got", err)
+	}
+
+	// the peer never reads, the write times out with partial progress on the full send buffer
+	buf := make([]byte, 4*1024*1024)
+	io.ReadFull(rand.Reader, buf)
+	if err := w.WriteFull("full", local, buf, time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	var res OpResult
+	for res.Context == nil {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			res = results[0]
+		}
+	}
+	if res.Error != ErrDeadline || res.Size == 0 || res.Size == len(buf) {
+		t.Fatal("expected partial write with ErrDeadline", res.Error, res.Size)
+	}
+
+	// Size is exactly the bytes the peer receives, the write resumes from there
+	if err := w.WriteFull("rest", local, buf[res.Size:], time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	rx := make([]byte, len(buf))
+	if _, err := io.ReadFull(remote, rx); err != nil || !bytes.Equal(rx, buf) {
+		t.Fatal("incorrect data written", err)
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	content := make([]byte, 4*1024*1024)
+	io.ReadFull(rand.Reader, content)
+	f, err := ioutil.TempFile("", "gaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.SendFile(nil, local, f, 0, 0, time.Time{}); err != ErrEmptyBuffer {
+		t.Fatal("expected ErrEmptyBuffer, got", err)
+	}
+	if err := w.SendFile(nil, local, f, -1, 10, time.Time{}); err != ErrInvalidOffset {
+		t.Fatal("expected ErrInvalidOffset, got", err)
+	}
+
+	// file region is written in order with ordinary writes
+	offset := int64(100)
+	expected := append([]byte("header"), content[offset:]...)
+	expected = append(expected, "trailer"...)
+	expected = append(expected, content[len(content)-10:]...)
+	w.Write("header", local, []byte("header"))
+	if err := w.SendFile("file", local, f, offset, int64(len(content))-offset, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	w.Write("trailer", local, []byte("trailer"))
+	if err := w.SendFile("short", local, f, int64(len(content)-10), 20, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	chReceived := make(chan []byte, 1)
+	go func() {
+		rx := make([]byte, len(expected))
+		io.ReadFull(remote, rx)
+		chReceived <- rx
+	}()
+
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			switch res.Context {
+			case "file":
+				if res.Error != nil || res.Size != len(content)-int(offset) {
+					t.Fatal("sendfile failed", res.Error, res.Size)
+				}
+			case "short":
+				if res.Error != io.ErrUnexpectedEOF || res.Size != 10 {
+					t.Fatal("expected io.ErrUnexpectedEOF", res.Error, res.Size)
+				}
+				if !bytes.Equal(<-chReceived, expected) {
+					t.Fatal("incorrect content")
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	go io.Copy(remote, remote)
+
+	// async operations on another conn share the watcher
+	other, otherRemote := tcpPair(t)
+	defer otherRemote.Close()
+	w.Write("other", other, []byte("ping"))
+	chWaitIO := make(chan OpResult, 1)
+	go func() {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				return
+			}
+			for _, res := range results {
+				chWaitIO <- res
+			}
+		}
+	}()
+
+	conn := NewConn(w, local)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello world\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello world\n" {
+		t.Fatal("incorrect echo", line, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("expected timeout error, got", err)
+	}
+	if !errors.Is(err, ErrDeadline) {
+		t.Fatal("expected ErrDeadline")
+	}
+
+	// only the async result is returned by WaitIO
+	res := <-chWaitIO
+	if res.Context != "other" || res.Error != nil {
+		t.Fatal("unexpected result", res.Context, res.Error)
+	}
+	select {
+	case res := <-chWaitIO:
+		t.Fatal("unexpected result", res.Context)
+	default:
+	}
+}
+
+func unixPair(t testing.TB) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns [2]*net.UnixConn
+	for k := range fds {
+		f := os.NewFile(uintptr(fds[k]), "unix")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[k] = conn.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestFdPassing(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := unixPair(t)
+	defer remote.Close()
+
+	r, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer wr.Close()
+
+	// send the write end of the pipe
+	if err := w.WriteWithFds("send", local, []byte("fd"), []int{int(wr.Fd())}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := remote.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatal("no control message", err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatal("no fds received", err)
+	}
+	received := os.NewFile(uintptr(fds[0]), "pipe")
+	received.Write([]byte("x"))
+	received.Close()
+	if _, err := io.ReadFull(r, buf[:1]); err != nil || buf[0] != 'x' {
+		t.Fatal("incorrect fd passed", err)
+	}
+
+	// receive the read end of the pipe back
+	if err := w.ReadWithFds("recv", local, make([]byte, 16), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := remote.WriteMsgUnix([]byte("back"), syscall.UnixRights(int(r.Fd())), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// fds can't be passed over tcp
+	tcpLocal, tcpRemote := tcpPair(t)
+	defer tcpRemote.Close()
+	w.ReadWithFds("tcp", tcpLocal, nil, time.Time{})
+
+	var completed int
+	for completed < 3 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			completed++
+			switch res.Context {
+			case "send":
+				if res.Error != nil || res.Size != 2 {
+					t.Fatal("write with fds failed", res.Error, res.Size)
+				}
+			case "recv":
+				if res.Error != nil || string(res.Buffer[:res.Size]) != "back" || len(res.Fds) != 1 {
+					t.Fatal("read with fds failed", res.Error, res.Size, res.Fds)
+				}
+				f := os.NewFile(uintptr(res.Fds[0]), "pipe")
+				wr.Write([]byte("y"))
+				if _, err := io.ReadFull(f, buf[:1]); err != nil || buf[0] != 'y' {
+					t.Fatal("incorrect fd received", err)
+				}
+				f.Close()
+			case "tcp":
+				if res.Error != ErrSocketType {
+					t.Fatal("expected ErrSocketType, got", res.Error)
+				}
+			}
+		}
+	}
+}
+
+func TestReplacePendingWrite(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Backend() == "io_uring" {
+		t.Skip("the write in flight on io_uring has started")
+	}
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	filled := fillSendBuffer(t, local, remote)
+
+	stale := []byte("stale snapshot")
+	latest := []byte("latest snapshot")
+	if err := w.Write("stale", local, stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReplacePendingWrite("latest", local, latest); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		rx := make([]byte, filled+len(latest))
+		if _, err := io.ReadFull(remote, rx); err != nil {
+			log.Println(err)
+			return
+		}
+		if !bytes.Equal(rx[filled:], latest) {
+			log.Println("incorrect content")
+			remote.Close()
+		}
+	}()
+
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			if res.Operation == OpWrite {
+				if res.Error != nil {
+					t.Fatal(res.Error)
+				}
+				if len(results) != 1 || res.Context != "latest" || res.Size != len(latest) {
+					t.Fatal("write has not been replaced", len(results), res.Context, res.Size)
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestMemLimit(t *testing.T) {
+	w, err := NewWatcherMemLimit(1024, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	filled := fillSendBuffer(t, local, remote)
+
+	if err := w.Write("first", local, make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(nil, local, make([]byte, 60)); err != ErrMemLimit {
+		t.Fatal("expected ErrMemLimit, got", err)
+	}
+	if err := w.Write(nil, local, make([]byte, 101)); err != ErrMemLimit {
+		t.Fatal("expected ErrMemLimit, got", err)
+	}
+
+	// blocks until the first write completes
+	w.SetMemLimitBlocking(true)
+	chSubmitted := make(chan error, 1)
+	go func() {
+		chSubmitted <- w.Write("second", local, make([]byte, 60))
+	}()
+
+	select {
+	case err := <-chSubmitted:
+		t.Fatal("submission over limit should block", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go io.ReadFull(remote, make([]byte, filled+120))
+
+	var completed int
+	for completed < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			if res.Context == "first" {
+				if err := <-chSubmitted; err != nil {
+					t.Fatal(err)
+				}
+			}
+			completed++
+		}
+	}
+}
+
+func testReadPersist(t *testing.T, buf []byte, freeOnEOF bool) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetFreeOnEOF(freeOnEOF)
+
+	local, remote := tcpPair(t)
+	marker, markerRemote := tcpPair(t)
+	defer markerRemote.Close()
+
+	if err := w.ReadPersist("persist", local, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := []byte("hello world, persistent read")
+	go func() {
+		for i := 0; i < len(tx); i += 7 {
+			end := i + 7
+			if end > len(tx) {
+				end = len(tx)
+			}
+			remote.Write(tx[i:end])
+			time.Sleep(20 * time.Millisecond)
+		}
+		remote.Close()
+	}()
+
+	var rx []byte
+	var eofs int
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			switch res.Context {
+			case "persist":
+				if eofs > 0 {
+					t.Fatal("persistent read delivered after EOF")
+				}
+				if res.Error == io.EOF {
+					eofs++
+					// make sure no more results delivered for persistent read
+					w.Write("marker", marker, []byte("x"))
+					continue
+				}
+				if res.Error != nil {
+					t.Fatal(res.Error)
+				}
+				rx = append(rx, res.Buffer[:res.Size]...)
+			case "marker":
+				if !bytes.Equal(tx, rx) {
+					t.Fatal("incorrect content", string(rx))
+				}
+				if freeOnEOF {
+					w.Read("freed", local, make([]byte, 1))
+					continue
+				}
+				return
+			case "freed":
+				if res.Error == nil {
+					t.Fatal("conn has not been freed on EOF")
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestReadPersist(t *testing.T) {
+	testReadPersist(t, nil, false)
+}
+
+func TestReadPersistUserBuffer(t *testing.T) {
+	testReadPersist(t, make([]byte, 4), false)
+}
+
+func TestReadPersistFreeOnEOF(t *testing.T) {
+	testReadPersist(t, make([]byte, 4), true)
+}
+
+func TestReadPersistCancel(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	marker, markerRemote := tcpPair(t)
+	defer markerRemote.Close()
+
+	w.ReadPersist("persist", local, nil)
+	remote.Write([]byte("a"))
+
+	var canceled bool
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			switch res.Context {
+			case "persist":
+				if canceled {
+					t.Fatal("persistent read delivered after cancellation")
+				}
+				if res.Error == ErrCanceled {
+					canceled = true
+					// data after cancellation is not read
+					remote.Write([]byte("b"))
+					w.Write("marker", marker, []byte("x"))
+					continue
+				}
+				if res.Error != nil || string(res.Buffer[:res.Size]) != "a" {
+					t.Fatal("incorrect persistent read", res.Error)
+				}
+				w.Cancel(local)
+			case "marker":
+				if !canceled {
+					t.Fatal("persistent read not canceled")
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	w.ReadTimeout("canceled", local, make([]byte, 16), time.Now().Add(time.Minute))
+	w.ReadFull("canceled", local, make([]byte, 16), time.Time{})
+	if err := w.Cancel(local); err != nil {
+		t.Fatal(err)
+	}
+
+	var canceled int
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			switch res.Context {
+			case "canceled":
+				if res.Error != ErrCanceled {
+					t.Fatal("expected ErrCanceled, got", res.Error)
+				}
+				canceled++
+				if canceled == 2 {
+					// the conn is still usable
+					w.Read("retry", local, make([]byte, 16))
+					remote.Write([]byte("x"))
+				}
+			case "retry":
+				if res.Error != nil || res.Size != 1 {
+					t.Fatal("read after cancel failed", res.Error, res.Size)
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestWaitIOTimeout(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	start := time.Now()
+	results, err := w.WaitIOTimeout(50 * time.Millisecond)
+	if err != ErrWaitTimeout || len(results) != 0 {
+		t.Fatal("expected ErrWaitTimeout, got", err, len(results))
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("returned before timeout")
+	}
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	w.Write(nil, local, []byte("hello"))
+	for {
+		results, err = w.WaitIOTimeout(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			break
+		}
+	}
+
+	w.Close()
+	if _, err := w.WaitIOTimeout(time.Second); err != ErrWatcherClosed {
+		t.Fatal("expected ErrWatcherClosed, got", err)
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.SetDeadline(nil, opDelete, time.Time{}); err != ErrInvalidOp {
+		t.Fatal("expected ErrInvalidOp, got", err)
+	}
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// a sliding deadline bumped explicitly keeps partial progress
+	start := time.Now()
+	w.ReadFull("slide", local, make([]byte, 4), start.Add(100*time.Millisecond))
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			remote.Write([]byte("a"))
+			w.SetDeadline(local, OpRead, time.Now().Add(100*time.Millisecond))
+		}
+	}()
+
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			if res.Context == "slide" {
+				if res.Error != ErrDeadline || res.Size != 3 {
+					t.Fatal("expected ErrDeadline with 3 bytes read", res.Error, res.Size)
+				}
+				if time.Since(start) < 200*time.Millisecond {
+					t.Fatal("deadline not extended")
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestCancelContext(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.CancelContext(nil); err != ErrIncomparable {
+		t.Fatal("nil context should be rejected", err)
+	}
+	if err := w.CancelContext([]byte("req")); err != ErrIncomparable {
+		t.Fatal("incomparable context should be rejected", err)
+	}
+
+	local1, remote1 := tcpPair(t)
+	defer remote1.Close()
+	local2, remote2 := tcpPair(t)
+	defer remote2.Close()
+
+	w.Read("req", local1, make([]byte, 16))
+	w.Read("req", local2, make([]byte, 16))
+	w.Read("other", local1, make([]byte, 16))
+	if err := w.CancelContext("req"); err != nil {
+		t.Fatal(err)
+	}
+
+	var canceled int
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			switch res.Context {
+			case "req":
+				if res.Error != ErrCanceled {
+					t.Fatal("expected ErrCanceled, got", res.Error)
+				}
+				canceled++
+				if canceled == 2 {
+					// the read behind the canceled one should proceed
+					remote1.Write([]byte("x"))
+				}
+			case "other":
+				if res.Error != nil || res.Size != 1 {
+					t.Fatal("uncanceled read failed", res.Error, res.Size)
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	goroutines := runtime.NumGoroutine()
+
+	// cancelled by context
+	goctx, cancel := context.WithCancel(context.Background())
+	if err := w.ReadContext(goctx, "cancel", local, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if res := waitResult(); res.Context != "cancel" || res.Error != context.Canceled {
+		t.Fatal("expected context.Canceled, got", res.Error)
+	}
+
+	// completed before context is done
+	goctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err := w.ReadContext(goctx, "read", local, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	remote.Write([]byte("hello"))
+	if res := waitResult(); res.Context != "read" || res.Error != nil || res.Size != 5 {
+		t.Fatal("read failed", res.Error, res.Size)
+	}
+	if err := w.WriteContext(goctx, "write", local, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if res := waitResult(); res.Context != "write" || res.Error != nil || res.Size != 5 {
+		t.Fatal("write failed", res.Error, res.Size)
+	}
+
+	// the deadline of context is on the timeout heap
+	goctx, cancelTimeout := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelTimeout()
+	if err := w.ReadContext(goctx, "timeout", local, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if res := waitResult(); res.Context != "timeout" || res.Error != context.DeadlineExceeded {
+		t.Fatal("expected context.DeadlineExceeded, got", res.Error)
+	}
+	if w.Stats().Timeouts == 0 {
+		t.Fatal("context deadline is not on the timeout heap")
+	}
+
+	// no goroutine outlives the operations
+	for i := 0; runtime.NumGoroutine() > goroutines; i++ {
+		if i == 100 {
+			t.Fatal("goroutine leaked", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReportPending(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	remote.Write([]byte("0123456789"))
+	time.Sleep(50 * time.Millisecond)
+
+	w.SetReportPending(true)
+	w.Read(nil, local, make([]byte, 4))
+	if res := waitResult(); res.Size != 4 || res.Pending != 6 {
+		t.Fatal("incorrect pending bytes", res.Size, res.Pending)
+	}
+
+	w.SetReportPending(false)
+	w.Read(nil, local, make([]byte, 4))
+	if res := waitResult(); res.Size != 4 || res.Pending != 0 {
+		t.Fatal("pending bytes should not be reported", res.Size, res.Pending)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// ECONNRESET: peer closes with linger 0
+	local, remote := tcpPair(t)
+	remote.(*net.TCPConn).SetLinger(0)
+	remote.Close()
+	w.Read(nil, local, make([]byte, 16))
+	res := waitResult()
+	if !IsConnReset(res.Error) || IsBrokenPipe(res.Error) || IsNotConnected(res.Error) {
+		t.Fatal("expected connection reset, got", res.Error)
+	}
+	if !errors.Is(res.Error, ErrConnReset) || errors.Unwrap(res.Error) != syscall.ECONNRESET {
+		t.Fatal("expected ErrConnReset wrapping the errno, got", res.Error)
+	}
+
+	// EPIPE: keep writing on a connection closed by peer
+	local, remote = tcpPair(t)
+	remote.Close()
+	for {
+		w.Write(nil, local, make([]byte, 16))
+		res = waitResult()
+		if res.Error != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !IsBrokenPipe(res.Error) && !IsConnReset(res.Error) {
+		t.Fatal("expected broken pipe, got", res.Error)
+	}
+	if !errors.Is(res.Error, ErrConnReset) {
+		t.Fatal("expected ErrConnReset, got", res.Error)
+	}
+	if IsNotConnected(res.Error) {
+		t.Fatal("unexpected classification", res.Error)
+	}
+
+	// ENOTCONN: read on a stream socket never connected
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), "unconnected")
+	unconnected, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Skip("cannot create unconnected conn:", err)
+	}
+	w.Read(nil, unconnected, make([]byte, 16))
+	res = waitResult()
+	if !IsNotConnected(res.Error) || IsConnReset(res.Error) || IsBrokenPipe(res.Error) {
+		t.Fatal("expected not connected, got", res.Error)
+	}
+}
+
+func TestSocketClose(t *testing.T) {
+	ln := echoServer(t, 1024)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	defer time.Sleep(1 * time.Second)
+
+	tx := []byte("hello world")
+	// send
+	err = w.Write(nil, conn, tx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		for _, res := range results {
+			switch res.Operation {
+			case OpWrite:
+				w.Free(conn)
+				w.Read(nil, conn, tx)
+			case OpRead:
+				if res.Error != nil {
+					t.Log(res.Error)
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestWriteOnClosedConn(t *testing.T) {
+	ln := echoServer(t, 1024)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	tx := []byte("hello world")
+	go func() {
+		// send
+		err = w.Write(nil, conn, tx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		for _, res := range results {
+			switch res.Operation {
+			case OpWrite:
+				// recv
+				if res.Error != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func Test1k(t *testing.T) {
+	testParallel(t, 1024, 1024)
+}
+func Test2k(t *testing.T) {
+	testParallel(t, 2048, 1024)
+}
+
+func Test4k(t *testing.T) {
+	testParallel(t, 4096, 1024)
+}
+
+func Test8k(t *testing.T) {
+	testParallel(t, 8192, 1024)
+}
+
+func Test10k(t *testing.T) {
+	testParallel(t, 10240, 1024)
+}
+
+func Test12k(t *testing.T) {
+	testParallel(t, 12288, 1024)
+}
+
+func Test1kTiny(t *testing.T) {
+	testParallel(t, 1024, 16)
+}
+
+func Test2kTiny(t *testing.T) {
+	testParallel(t, 2048, 16)
+}
+
+func Test4kTiny(t *testing.T) {
+	testParallel(t, 4096, 16)
+}
+
+func testParallel(t *testing.T, par int, msgsize int) {
+	t.Log("testing concurrent:", par, "connections")
+	ln := echoServer(t, msgsize)
+	defer ln.Close()
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	go func() {
+		for i := 0; i < par; i++ {
+			data := make([]byte, msgsize)
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			// send
+			err = w.Write(nil, conn, data)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}()
+
+	nbytes := 0
+	ntotal := msgsize * par
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		for _, res := range results {
+			switch res.Operation {
+			case OpWrite:
+				// recv
+				if res.Error != nil {
+					continue
+				}
+
+				err = w.Read(nil, res.Conn, res.Buffer[:cap(res.Buffer)])
+				if err != nil {
+					t.Fatal(err)
+				}
+			case OpRead:
+				if res.Error != nil {
+					continue
+				}
+				if res.Size == 0 {
+					continue
+				}
+
+				nbytes += res.Size
+				if nbytes >= ntotal {
+					t.Log("completed:", nbytes)
+					return
+				}
+			}
+		}
+	}
+}
+
+func Test10kRandomSwapBuffer(t *testing.T) {
+	testParallelRandomInternal(t, 10240, 1024, false)
+}
+
+func Test10kCompleteSwapBuffer(t *testing.T) {
+	testParallelRandomInternal(t, 10240, 1024, true)
+}
+
+func testParallelRandomInternal(t *testing.T, par int, msgsize int, allswap bool) {
+	t.Log("testing concurrent:", par, "connections")
+	ln := echoServer(t, msgsize)
+	defer ln.Close()
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	go func() {
+		for i := 0; i < par; i++ {
+			data := make([]byte, msgsize)
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			// send
+			err = w.Write(nil, conn, data)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}()
+
+	nbytes := 0
+	ntotal := msgsize * par
+	received := make(map[net.Conn]int)
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		for _, res := range results {
+			switch res.Operation {
+			case OpWrite:
+				// recv
+				if res.Error != nil {
+					continue
+				}
+
+				// inject random nil buffer to test internal buffer
+				var err error
+				var rnd int32
+				binary.Read(rand.Reader, binary.LittleEndian, &rnd)
+				if allswap || rnd%13 == 0 {
+					err = w.Read(nil, res.Conn, nil)
+				} else {
+					err = w.Read(nil, res.Conn, res.Buffer[:cap(res.Buffer)])
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			case OpRead:
+				if res.Error != nil {
+					continue
+				}
+				if res.Size == 0 {
+					continue
+				}
+
+				nbytes += res.Size
+				if nbytes >= ntotal {
+					t.Log("completed:", nbytes)
+					return
+				}
+
+				// a read into the internal buffer may be served by the
+				// one byte back buffer, keep reading the rest of the echo
+				received[res.Conn] += res.Size
+				if remain := msgsize - received[res.Conn]; remain > 0 {
+					if err := w.Read(nil, res.Conn, make([]byte, remain)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAdaptiveBatching(t *testing.T) {
+	ln := echoServer(t, 64)
+	defer ln.Close()
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if w.Stats().Batching {
+		t.Fatal("batching mode on startup")
+	}
+
+	// high completion rate
+	for i := 0; i < 64; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		w.Write(nil, conn, make([]byte, 64))
+	}
+
+	var batching bool
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && !batching {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, res := range results {
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			if res.Operation == OpWrite {
+				w.Read(nil, res.Conn, res.Buffer)
+			} else {
+				w.Write(nil, res.Conn, res.Buffer[:res.Size])
+			}
+		}
+		batching = w.Stats().Batching
+	}
+
+	if !batching {
+		t.Fatal("batching mode not engaged under high completion rate")
+	}
+
+	// low completion rate
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && batching {
+		time.Sleep(2 * adaptiveWindow)
+		w.Write("low", conn, make([]byte, 1))
+	WAIT:
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, res := range results {
+				if res.Context == "low" {
+					break WAIT
+				}
+			}
+		}
+		batching = w.Stats().Batching
+	}
+
+	if batching {
+		t.Fatal("batching mode not disengaged under low completion rate")
+	}
+
+	if w.Stats().Completions == 0 {
+		t.Fatal("completions not counted")
+	}
+}
+
+func TestStatsAndReset(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	w.Write(nil, local, []byte("hello"))
+	w.Read(nil, local, make([]byte, 16))
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(remote, buf)
+		remote.Write([]byte("world!"))
+	}()
+
+	var completed int
+	for completed < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed += len(results)
+	}
+
+	// the read and write are submitted with a single syscall on io_uring
+	minSyscalls := int64(2)
+	if w.Backend() == "io_uring" {
+		minSyscalls = 1
+	}
+	stats := w.StatsAndReset()
+	if stats.Completions != 2 || stats.BytesWritten != 5 || stats.BytesRead != 6 || stats.Syscalls < minSyscalls {
+		t.Fatalf("incorrect counters: %+v", stats)
+	}
+	if stats.Reads != 1 || stats.Writes != 1 || stats.Timeouts != 0 {
+		t.Fatalf("incorrect operation counters: %+v", stats)
+	}
+	if stats.Conns != 1 || stats.Pending != 0 {
+		t.Fatalf("incorrect gauges: %+v", stats)
+	}
+
+	w.Read(nil, local, make([]byte, 16))
+	time.Sleep(50 * time.Millisecond)
+	stats = w.StatsAndReset()
+	if stats.Completions != 0 || stats.BytesWritten != 0 || stats.BytesRead != 0 {
+		t.Fatalf("counters not reset: %+v", stats)
+	}
+	if stats.Conns != 1 || stats.Pending != 1 {
+		t.Fatalf("gauges should not be reset: %+v", stats)
+	}
+}
+
+func TestStatsTimeouts(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	w.ReadTimeout(nil, local, make([]byte, 16), time.Now().Add(50*time.Millisecond))
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			if results[0].Error != ErrDeadline {
+				t.Fatal("expected ErrDeadline", results[0].Error)
+			}
+			break
+		}
+	}
+
+	// no attempt is retried on io_uring
+	stats := w.Stats()
+	if stats.Reads != 1 || stats.Timeouts != 1 || (stats.Retries < 1 && w.Backend() != "io_uring") {
+		t.Fatalf("incorrect counters: %+v", stats)
+	}
+}
+
+func TestDeadline1k(t *testing.T) {
+	testDeadline(t, 1024)
+}
+
+func TestDeadline2k(t *testing.T) {
+	testDeadline(t, 2048)
+}
+func TestDeadline4k(t *testing.T) {
+	testDeadline(t, 4096)
+}
+
+func TestDeadline8k(t *testing.T) {
+	testDeadline(t, 8192)
+}
+
+func testDeadline(t *testing.T, par int) {
+	t.Log("testing concurrent:", par, "unresponsive connections")
+	ln := echoServer(t, 128)
+	defer ln.Close()
+
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	die := make(chan struct{})
+	go func() {
+		for i := 0; i < par; i++ {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer conn.Close()
+
+			// send nothing, but submit a read request with timeout
+			err = w.ReadTimeout(nil, conn, nil, time.Now().Add(time.Second))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		<-die
+	}()
+
+	nerrs := 0
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+
+		for _, res := range results {
+			switch res.Operation {
+			case OpRead:
+				if res.Error == ErrDeadline {
+					nerrs++
+					if nerrs == par {
+						t.Log("all deadline reached")
+						close(die)
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkEcho128B(b *testing.B) {
+	benchmarkEcho(b, 128, 1)
+}
+
+func BenchmarkEcho1K(b *testing.B) {
+	benchmarkEcho(b, 1024, 1)
+}
+
+func BenchmarkEcho4K(b *testing.B) {
+	benchmarkEcho(b, 4096, 1)
+}
+
+func BenchmarkEcho64K(b *testing.B) {
+	benchmarkEcho(b, 65536, 1)
+}
+
+func BenchmarkEcho128K(b *testing.B) {
+	benchmarkEcho(b, 128*1024, 1)
+}
+
+func BenchmarkEcho128BParallel(b *testing.B) {
+	benchmarkEcho(b, 128, 128)
+}
+
+func BenchmarkEcho1KParallel(b *testing.B) {
+	benchmarkEcho(b, 1024, 128)
+}
+
+func BenchmarkEcho4KParallel(b *testing.B) {
+	benchmarkEcho(b, 4096, 128)
+}
+
+func BenchmarkEcho64KParallel(b *testing.B) {
+	benchmarkEcho(b, 65536, 128)
+}
+
+func BenchmarkEcho128KParallel(b *testing.B) {
+	benchmarkEcho(b, 128*1024, 128)
+}
+
+func BenchmarkTimedReads100K(b *testing.B) {
+	b.Run("exact", func(b *testing.B) { benchmarkTimedReads(b, 0) })
+	b.Run("1ms", func(b *testing.B) { benchmarkTimedReads(b, time.Millisecond) })
+}
+
+// benchmarkTimedReads submits 100k reads with deadlines clustered in 5ms and out of order,
+// and waits them to time out, the timer resets per round are reported.
+func benchmarkTimedReads(b *testing.B, granularity time.Duration) {
+	const n = 100000
+	w, err := NewWatcher()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	w.SetTimerGranularity(granularity)
+
+	local, remote := tcpPair(b)
+	defer remote.Close()
+
+	w.StatsAndReset()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// submissions can block on the results not yet waited
+		go func() {
+			now := time.Now()
+			for k := 0; k < n; k++ {
+				w.ReadTimeout(nil, local, nil, now.Add(time.Duration((k*7919)%5000)*time.Microsecond))
+			}
+		}()
+		for count := 0; count < n; {
+			results, err := w.WaitIO()
+			if err != nil {
+				b.Fatal(err)
+			}
+			count += len(results)
+		}
+	}
+	b.ReportMetric(float64(w.Stats().TimerResets)/float64(b.N), "resets/op")
+}
+
+func BenchmarkMaxEvents(b *testing.B) {
+	for _, n := range []int{minMaxEvents, 512, defaultMaxEvents} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) { benchmarkMaxEvents(b, n) })
+	}
+}
+
+func benchmarkMaxEvents(b *testing.B, maxEvents int) {
+	const numconn = 1024
+	w, err := NewWatcherOpts(Options{MaxEvents: maxEvents})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	var locals, remotes []net.Conn
+	for i := 0; i < numconn; i++ {
+		local, remote := tcpPair(b)
+		defer local.Close()
+		defer remote.Close()
+		locals = append(locals, local)
+		remotes = append(remotes, remote)
+	}
+
+	// all conns become readable at once in every round
+	bufs := make([][]byte, numconn)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for k, local := range locals {
+			w.Read(nil, local, bufs[k])
+		}
+		for _, remote := range remotes {
+			remote.Write([]byte{1})
+		}
+		for count := 0; count < numconn; {
+			results, err := w.WaitIO()
+			if err != nil {
+				b.Fatal(err)
+			}
+			count += len(results)
+		}
+	}
+}
+
+func benchmarkEcho(b *testing.B, bufsize int, numconn int) {
+	b.Log("benchmark echo with message size:", bufsize, "with", numconn, "parallel connections, for", b.N, "times")
+	ln := echoServer(b, bufsize)
+	defer ln.Close()
+
+	w, err := NewWatcher()
+	if err != nil {
+		b.Fatal("new watcher:", err)
+	}
+	defer w.Close()
+
+	addr, _ := net.ResolveTCPAddr("tcp", ln.Addr().String())
+	for i := 0; i < numconn; i++ {
+		rx := make([]byte, bufsize)
+		tx := make([]byte, bufsize)
+		conn, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			b.Fatal("dial:", err)
+			return
+		}
+		w.Write(nil, conn, tx)
+		w.Read(nil, conn, rx)
+		defer conn.Close()
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(bufsize * numconn))
+	b.ResetTimer()
+
+	count := 0
+	target := bufsize * b.N * numconn
+	// completions returned per wakeup of WaitIO
+	var waits, completions int
+	defer func() { b.ReportMetric(float64(completions)/float64(waits), "results/wait") }()
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			b.Fatal("waitio:", err)
+			return
+		}
+		waits++
+		completions += len(results)
+
+		for _, res := range results {
+			switch res.Operation {
+			case OpWrite:
+				if res.Error != nil {
+					b.Fatal("read:", res.Error)
+				}
+				err := w.Write(nil, res.Conn, res.Buffer)
+				if err != nil {
+					b.Log("wirte:", err)
+				}
+			case OpRead:
+				if res.Error != nil {
+					b.Fatal("read:", res.Error)
+				}
+				count += res.Size
+				if count >= target {
+					return
+				}
+				//log.Println("count:", count, "target:", target)
+				err := w.Read(nil, res.Conn, res.Buffer)
+				if err != nil {
+					b.Log("read:", err)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkContextSwitch(b *testing.B) {
+	die := make(chan struct{})
+	ch := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				ch <- struct{}{}
+			case <-die:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		ch <- struct{}{}
+		<-ch
+	}
+	close(die)
+}
+
+func TestWatcherPool(t *testing.T) {
+	pool, err := NewWatcherPool(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	const numConns = 32
+	conns := make(map[net.Conn]bool)
+	shards := make(map[*Watcher]bool)
+	for i := 0; i < numConns; i++ {
+		local, remote := tcpPair(t)
+		defer remote.Close()
+		go io.Copy(remote, remote)
+
+		conns[local] = true
+		shards[pool.Shard(local)] = true
+		if err := pool.Write(nil, local, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(shards) < 2 {
+		t.Fatal("conns are not sharded")
+	}
+
+	var reads, canceled int
+	for reads < numConns || canceled < numConns {
+		results, err := pool.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Context == "cancel" {
+				if res.Error != ErrCanceled {
+					t.Fatal("expected ErrCanceled, got", res.Error)
+				}
+				canceled++
+				continue
+			}
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			switch res.Operation {
+			case OpWrite:
+				pool.ReadFull(nil, res.Conn, make([]byte, 5), time.Time{})
+			case OpRead:
+				if string(res.Buffer[:res.Size]) != "hello" {
+					t.Fatal("incorrect echo", string(res.Buffer[:res.Size]))
+				}
+				reads++
+				// pending read is routed to the owning shard to be cancelled
+				pool.Read("cancel", res.Conn, nil)
+				pool.Cancel(res.Conn)
+			}
+		}
+	}
+
+	for conn := range conns {
+		pool.Free(conn)
+	}
+	pool.Close()
+	if _, err := pool.WaitIO(); err != ErrWatcherClosed {
+		t.Fatal("expected ErrWatcherClosed, got", err)
+	}
+}
+
+func TestWatcherPoolShard(t *testing.T) {
+	pool, err := NewWatcherPool(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	if _, err := pool.WaitIOShard(pool.NumShards()); err != ErrInvalidShard {
+		t.Fatal("expected ErrInvalidShard, got", err)
+	}
+
+	const numConns = 16
+	shardOf := make(map[net.Conn]int)
+	for i := 0; i < numConns; i++ {
+		local, remote := tcpPair(t)
+		defer local.Close()
+		defer remote.Close()
+		for k := 0; k < pool.NumShards(); k++ {
+			if pool.Shard(local) == pool.shards[k] {
+				shardOf[local] = k
+			}
+		}
+		pool.Write(nil, local, []byte("hello"))
+	}
+
+	// a worker per shard
+	var wg sync.WaitGroup
+	var total int32
+	for k := 0; k < pool.NumShards(); k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			for atomic.LoadInt32(&total) < numConns {
+				results, err := pool.WaitIOShard(k)
+				if err != nil {
+					return
+				}
+				for _, res := range results {
+					if res.Error != nil || shardOf[res.Conn] != k {
+						t.Errorf("unexpected result on shard %v: %v", k, res.Error)
+					}
+				}
+				atomic.AddInt32(&total, int32(len(results)))
+			}
+			pool.Close()
+		}(k)
+	}
+	wg.Wait()
+	if total != numConns {
+		t.Fatal("results missing", total)
+	}
+	if _, err := pool.WaitIO(); err != ErrMixedConsumers {
+		t.Fatal("expected ErrMixedConsumers, got", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	start := time.Now()
+	if err := w.SetIdleTimeout(local, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// activity postpones the idle report
+	time.Sleep(50 * time.Millisecond)
+	active := time.Now()
+	w.Write(nil, local, []byte("ping"))
+
+	var idles int
+	for idles < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Operation != OpIdle {
+				continue
+			}
+			if res.Conn != local || res.Error != nil {
+				t.Fatal("incorrect idle result", res.Conn, res.Error)
+			}
+			if idles == 0 && time.Since(active) < 100*time.Millisecond {
+				t.Fatal("idle reported too early", time.Since(start))
+			}
+			idles++
+		}
+	}
+
+	w.SetIdleTimeout(local, 0)
+	if results, err := w.WaitIOTimeout(300 * time.Millisecond); err != ErrWaitTimeout {
+		t.Fatal("idle timeout should be removed", results, err)
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	if _, err := w.WriteQueueLen(local); err != ErrNotWatched {
+		t.Fatal("expected ErrNotWatched, got", err)
+	}
+
+	// the peer stops reading, writes pile up
+	fillSendBuffer(t, local, remote)
+	w.Write(nil, local, make([]byte, 100))
+	w.WriteVector(nil, local, [][]byte{make([]byte, 10), make([]byte, 20)}, time.Time{})
+	w.Write(nil, local, make([]byte, 1000))
+
+	n, err := w.WriteQueueLen(local)
+	if err != nil || n != 3 {
+		t.Fatal("incorrect write queue length", n, err)
+	}
+	queued, err := w.WriteQueueBytes(local)
+	if err != nil || queued != 1130 {
+		t.Fatal("incorrect write queue bytes", queued, err)
+	}
+}
+
+func TestRecycle(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// persistent read with user buffer is parked till the result is recycled
+	w.ReadPersist(nil, local, make([]byte, 16))
+	remote.Write([]byte("a"))
+	var results []OpResult
+	for len(results) == 0 {
+		if results, err = w.WaitIO(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remote.Write([]byte("b"))
+	time.Sleep(50 * time.Millisecond)
+	if stats := w.Stats(); stats.BytesRead != 1 {
+		t.Fatal("persistent read should be parked", stats.BytesRead)
+	}
+
+	// an empty slice recycles nothing
+	w.Recycle(nil)
+	time.Sleep(50 * time.Millisecond)
+	if stats := w.Stats(); stats.BytesRead != 1 {
+		t.Fatal("persistent read should stay parked", stats.BytesRead)
+	}
+
+	w.Recycle(results)
+	for i := 0; w.Stats().BytesRead != 2; i++ {
+		if i == 100 {
+			t.Fatal("persistent read should resume after Recycle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// swap buffers are detached from recycled results
+	local2, remote2 := tcpPair(t)
+	defer remote2.Close()
+	w.Read(nil, local2, nil)
+	remote2.Write([]byte("c"))
+	for {
+		if results, err = w.WaitIO(); err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.IsSwapBuffer {
+				w.Recycle(results)
+				if results[0].Buffer != nil {
+					t.Fatal("swap buffer should be detached")
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestRecycleShard(t *testing.T) {
+	const shards = 2
+	w, err := NewWatcherOpts(Options{ResultShards: shards})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the results of shard 0 are consumed apart
+	go func() {
+		for {
+			if _, err := w.WaitIOShard(0); err != nil {
+				return
+			}
+		}
+	}()
+
+	// persistent reads spread over the shards
+	const numConns = 8
+	remotes := make(map[net.Conn]net.Conn)
+	for i := 0; i < numConns; i++ {
+		local, remote := tcpPair(t)
+		defer local.Close()
+		defer remote.Close()
+		remotes[local] = remote
+		w.ReadPersist(nil, local, make([]byte, 16))
+		remote.Write([]byte("a"))
+	}
+
+	var results []OpResult
+	for len(results) == 0 {
+		if results, err = w.WaitIOShard(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; w.Stats().BytesRead != numConns; i++ {
+		if i == 100 {
+			t.Fatal("incorrect bytes read", w.Stats().BytesRead)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the read on shard 1 is parked till the result is recycled there
+	remotes[results[0].Conn].Write([]byte("b"))
+	time.Sleep(50 * time.Millisecond)
+	if stats := w.Stats(); stats.BytesRead != numConns {
+		t.Fatal("persistent read should be parked", stats.BytesRead)
+	}
+
+	w.Recycle(results)
+	for i := 0; w.Stats().BytesRead != numConns+1; i++ {
+		if i == 100 {
+			t.Fatal("persistent read should resume after Recycle on its shard")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHangup(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+
+	// persistent read is parked after delivery
+	w.ReadPersist(nil, local, make([]byte, 16))
+	remote.Write([]byte("a"))
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			break
+		}
+	}
+
+	// parked read can never complete once the connection hangs up
+	remote.(*net.TCPConn).SetLinger(0)
+	remote.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+	if res := waitResult(); !errors.Is(res.Error, ErrConnClosed) || !IsConnReset(res.Error) {
+		t.Fatal("expected ErrConnClosed wrapping ECONNRESET, got", res.Error)
+	}
+
+	// the conn is released, and later operations fail with the same error
+	if conns, _, _ := w.Count(); conns != 0 {
+		t.Fatal("conn should be released on hangup", conns)
+	}
+	w.Read(nil, local, make([]byte, 16))
+	if res := waitResult(); !errors.Is(res.Error, ErrConnClosed) || !IsConnReset(res.Error) {
+		t.Fatal("expected ErrConnClosed wrapping ECONNRESET, got", res.Error)
+	}
+}
+
+func TestHangupWriter(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIOTimeout(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// the peer half-closed still reads, the writes go on
+	local, remote := tcpPair(t)
+	remote.(*net.TCPConn).CloseWrite()
+	time.Sleep(50 * time.Millisecond)
+	w.Write(nil, local, []byte("hello"))
+	if res := waitResult(); res.Error != nil || res.Size != 5 {
+		t.Fatal("write after the half-close of peer failed", res.Error, res.Size)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("incorrect data", err)
+	}
+	remote.Close()
+	w.Free(local)
+
+	// the write blocked on a full buffer is delivered once the peer is gone,
+	// with the reset attempting it, or ErrConnClosed
+	local, remote = tcpPair(t)
+	remote.(*net.TCPConn).SetReadBuffer(4096)
+	local.(*net.TCPConn).SetWriteBuffer(4096)
+	w.Write(nil, local, make([]byte, 16*1024*1024))
+	time.Sleep(50 * time.Millisecond)
+	remote.Close()
+	if res := waitResult(); (!errors.Is(res.Error, ErrConnClosed) && !IsConnReset(res.Error)) || res.Size == 0 {
+		t.Fatal("expected the peer gone with the bytes written, got", res.Error, res.Size)
+	}
+	if conns, _, _ := w.Count(); conns != 0 {
+		t.Fatal("conn should be released on hangup", conns)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	if err := w.Register(local); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Register(local); err != nil {
+		t.Fatal("registering twice should be a no-op", err)
+	}
+	if conns, reads, writes := w.Count(); conns != 1 || reads != 0 || writes != 0 {
+		t.Fatal("incorrect count", conns, reads, writes)
+	}
+
+	// buffer is allocated when data arrives
+	remote.Write([]byte("hello"))
+	w.Read(nil, local, nil)
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			if results[0].Error != nil || string(results[0].Buffer[:results[0].Size]) != "hello" {
+				t.Fatal("read failed", results[0].Error)
+			}
+			break
+		}
+	}
+
+	w.Free(local)
+	if conns, _, _ := w.Count(); conns != 0 {
+		t.Fatal("conn should be freed", conns)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.SetMaxConns(1)
+	local1, remote1 := tcpPair(t)
+	defer remote1.Close()
+	local2, remote2 := tcpPair(t)
+	defer remote2.Close()
+
+	if err := w.Register(local1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Register(local2); err != ErrTooManyConns {
+		t.Fatal("expected ErrTooManyConns, got", err)
+	}
+
+	w.Write("rejected", local2, []byte("hello"))
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			if results[0].Error != ErrTooManyConns {
+				t.Fatal("expected ErrTooManyConns, got", results[0].Error)
+			}
+			break
+		}
+	}
+
+	// admitted after a conn is freed
+	w.Free(local1)
+	if err := w.Register(local2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResultAddr(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	laddr, raddr := local.LocalAddr().String(), local.RemoteAddr().String()
+
+	w.Write(nil, local, []byte("hello"))
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) > 0 {
+			// addresses remain valid after the conn is freed
+			w.Free(local)
+			res := results[0]
+			if res.LocalAddr == nil || res.LocalAddr.String() != laddr {
+				t.Fatal("incorrect local address", res.LocalAddr, laddr)
+			}
+			if res.RemoteAddr == nil || res.RemoteAddr.String() != raddr {
+				t.Fatal("incorrect remote address", res.RemoteAddr, raddr)
+			}
+			return
+		}
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetWriteCoalescing(true)
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	filled := fillSendBuffer(t, local, remote)
+	const numWrites = 32
+	var expected []byte
+	for i := 0; i < numWrites; i++ {
+		msg := []byte(fmt.Sprintf("message %v;", i))
+		expected = append(expected, msg...)
+		w.Write(i, local, msg)
+	}
+	// the writes are queued behind the one blocked
+	time.Sleep(50 * time.Millisecond)
+	syscalls := w.Stats().Syscalls
+
+	chReceived := make(chan []byte, 1)
+	go func() {
+		rx := make([]byte, filled+len(expected))
+		io.ReadFull(remote, rx)
+		chReceived <- rx[filled:]
+	}()
+
+	var completed int
+	for completed < numWrites {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Error != nil || res.Context != completed {
+				t.Fatal("writes delivered out of order", res.Context, res.Error)
+			}
+			completed++
+		}
+	}
+
+	if !bytes.Equal(<-chReceived, expected) {
+		t.Fatal("incorrect content")
+	}
+	if n := w.Stats().Syscalls - syscalls; n >= numWrites/2 {
+		t.Fatal("writes are not coalesced", n)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// peek and read submitted before the data arrives
+	w.Peek("peek", local, make([]byte, 4), time.Time{})
+	w.ReadFull("read", local, make([]byte, 8), time.Time{})
+	remote.Write([]byte("GET / HT"))
+
+	var completed int
+	for completed < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			completed++
+			switch res.Context {
+			case "peek":
+				if res.Error != nil || string(res.Buffer[:res.Size]) != "GET " {
+					t.Fatal("incorrect peek", res.Error, string(res.Buffer[:res.Size]))
+				}
+			case "read":
+				if res.Error != nil || string(res.Buffer[:res.Size]) != "GET / HT" {
+					t.Fatal("peeked data should be read", res.Error, string(res.Buffer[:res.Size]))
+				}
+			}
+		}
+	}
+}
+
+func TestOOB(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	if err := w.WriteOOB("woob", remote, nil, time.Time{}); err != ErrEmptyBuffer {
+		t.Fatal("empty buffer should be rejected", err)
+	}
+
+	// the urgent byte is read out-of-band, others are read inline
+	w.ReadOOB("roob", local, make([]byte, 1), time.Time{})
+	w.WriteOOB("woob", remote, []byte("ab!"), time.Time{})
+	w.ReadFull("read", local, make([]byte, 2), time.Time{})
+
+	var completed int
+	for completed < 3 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			completed++
+			if res.Error != nil {
+				t.Fatal(res.Context, res.Error)
+			}
+			switch res.Context {
+			case "roob":
+				if res.Operation != OpReadOOB || string(res.Buffer[:res.Size]) != "!" {
+					t.Fatal("incorrect urgent data", res.Operation, string(res.Buffer[:res.Size]))
+				}
+			case "woob":
+				if res.Operation != OpWriteOOB || res.Size != 3 {
+					t.Fatal("incorrect oob write", res.Operation, res.Size)
+				}
+			case "read":
+				if string(res.Buffer[:res.Size]) != "ab" {
+					t.Fatal("incorrect inline data", string(res.Buffer[:res.Size]))
+				}
+			}
+		}
+	}
+}
+
+func TestOOBShortWrite(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	remote.(*net.TCPConn).SetWriteBuffer(4096)
+
+	// the buffer is written in several chunks, only its last byte is urgent
+	tx := make([]byte, 1024*1024)
+	io.ReadFull(rand.Reader, tx)
+	w.WriteOOB("woob", remote, tx, time.Time{})
+	time.Sleep(50 * time.Millisecond)
+	if w.Stats().Retries == 0 {
+		t.Fatal("write should be short")
+	}
+	rx := make([]byte, len(tx)-1)
+	w.ReadFull("read", local, rx, time.Now().Add(5*time.Second))
+	w.ReadOOB("roob", local, make([]byte, 1), time.Now().Add(5*time.Second))
+
+	for completed := 0; completed < 3; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			completed++
+			if res.Error != nil {
+				t.Fatal(res.Context, res.Error)
+			}
+			switch res.Context {
+			case "roob":
+				if res.Size != 1 || res.Buffer[0] != tx[len(tx)-1] {
+					t.Fatal("incorrect urgent data", res.Size)
+				}
+			case "woob":
+				if res.Size != len(tx) {
+					t.Fatal("incorrect oob write", res.Size)
+				}
+			case "read":
+				if !bytes.Equal(rx, tx[:len(tx)-1]) {
+					t.Fatal("incorrect inline data")
+				}
+			}
+		}
+	}
+}
+
+func TestReadFullPartialTimeout(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// a timed out read on the internal buffer
+	w.ReadTimeout(nil, local, nil, time.Now().Add(20*time.Millisecond))
+	if res := waitResult(); res.Error != ErrDeadline || res.Size != 0 || res.IsSwapBuffer {
+		t.Fatal("incorrect internal buffer timeout", res.Error, res.Size, res.IsSwapBuffer)
+	}
+
+	buf := make([]byte, 8)
+	remote.Write([]byte("abc"))
+	w.ReadFull(nil, local, buf, time.Now().Add(100*time.Millisecond))
+	res := waitResult()
+	if res.Error != ErrDeadline || res.Size != 3 || string(res.Buffer[:res.Size]) != "abc" {
+		t.Fatal("incorrect partial read", res.Error, res.Size)
+	}
+
+	// continue on the rest of the buffer
+	remote.Write([]byte("defgh"))
+	w.ReadFull(nil, local, buf[res.Size:], time.Time{})
+	if res := waitResult(); res.Error != nil || res.Size != 5 || string(buf) != "abcdefgh" {
+		t.Fatal("incorrect continued read", res.Error, res.Size, string(buf))
+	}
+
+	// the internal buffer is intact after the timeouts
+	remote.Write([]byte("ijk"))
+	w.Read(nil, local, nil)
+	if res := waitResult(); res.Error != nil || !res.IsSwapBuffer || string(res.Buffer[:res.Size]) != "ijk" {
+		t.Fatal("incorrect internal buffer read", res.Error, string(res.Buffer[:res.Size]))
+	}
+}
+
+func TestReadBudget(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetReadBudget(4)
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// reads beyond the budget resume in later rounds
+	bufs := make([][]byte, 8)
+	for i := range bufs {
+		bufs[i] = make([]byte, 4)
+		w.ReadFull(i, local, bufs[i], time.Time{})
+	}
+	data := []byte("0000111122223333444455556666777")
+	remote.Write(append(data, '7'))
+
+	var completed int
+	for completed < len(bufs) {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			completed++
+			i := res.Context.(int)
+			if res.Error != nil || res.Size != 4 || bufs[i][0] != byte('0'+i) {
+				t.Fatal("incorrect read", i, res.Error, string(bufs[i]))
+			}
+		}
+	}
+}
+
+func TestTimerGranularity(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetTimerGranularity(50 * time.Millisecond)
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// later deadlines don't reset the timer armed for an earlier one
+	start := time.Now()
+	w.StatsAndReset()
+	for i := 0; i < 10; i++ {
+		w.ReadTimeout(nil, local, nil, start.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	for count := 0; count < 10; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			count++
+			if res.Error != ErrDeadline {
+				t.Fatal("expected ErrDeadline, got", res.Error)
+			}
+		}
+	}
+
+	stats := w.Stats()
+	if stats.Timeouts != 10 || stats.TimerResets > 2 {
+		t.Fatal("unexpected timer stats", stats.Timeouts, stats.TimerResets)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.SetBufferPool(nil, func([]byte) {}); err != ErrInvalidBufferPool {
+		t.Fatal("hooks should be set in pair", err)
+	}
+
+	// hooks run on the loop goroutine
+	var gets, puts int
+	var put []byte
+	err = w.SetBufferPool(func(size int) []byte {
+		gets++
+		return make([]byte, size)
+	}, func(buf []byte) {
+		puts++
+		put = buf
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	remote.Write([]byte("hello"))
+	w.Read(nil, local, nil)
+	res := waitResult()
+	if res.Error != nil || res.IsSwapBuffer || string(res.Buffer[:res.Size]) != "hello" {
+		t.Fatal("incorrect pooled read", res.Error, res.IsSwapBuffer)
+	}
+
+	buf := []byte("world")
+	w.Write(nil, local, buf)
+	res = waitResult()
+	if res.Error != nil || res.Size != 5 || res.Buffer != nil {
+		t.Fatal("incorrect pooled write", res.Error, res.Size)
+	}
+
+	w.runInLoop(func() {
+		if gets != 1 || puts != 1 || &put[0] != &buf[0] {
+			t.Error("unexpected pool calls", gets, puts)
+		}
+	})
+
+	// swap buffers are restored
+	w.SetBufferPool(nil, nil)
+	remote.Write([]byte("again"))
+	w.Read(nil, local, nil)
+	if res = waitResult(); res.Error != nil || !res.IsSwapBuffer {
+		t.Fatal("swap buffer not restored", res.Error)
+	}
+}
+
+func TestFreePending(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	// the send buffer is filled up to keep the write pending
+	fillSendBuffer(t, local, remote)
+
+	rbuf := make([]byte, 16)
+	w.Read("read", local, rbuf)
+	w.Write("write", local, make([]byte, 1024))
+	w.Free(local)
+
+	var completed int
+	for completed < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			completed++
+			if res.Error != ErrConnClosed {
+				t.Fatal("pending operation should be delivered with ErrConnClosed", res.Context, res.Error)
+			}
+			if res.Context == "read" && &res.Buffer[0] != &rbuf[0] {
+				t.Fatal("buffer not returned")
+			}
+		}
+	}
+}
+
+func TestDetach(t *testing.T) {
+	w1, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w1.Close()
+	w2, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	if _, err := w1.Detach(local); err != ErrNotWatched {
+		t.Fatal("detached a conn not watched", err)
+	}
+
+	waitResult := func(w *Watcher) OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// the pending read is returned for resubmission
+	w1.Read("pending", local, make([]byte, 16))
+	fd, err := w1.Detach(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := waitResult(w1); res.Context != "pending" || res.Error != ErrDetached {
+		t.Fatal("pending read should be delivered with ErrDetached", res.Error)
+	}
+
+	conn, err := w2.AttachFd(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Free(conn)
+
+	// the session is intact on the new watcher
+	remote.Write([]byte("ping"))
+	w2.Read(nil, conn, make([]byte, 16))
+	if res := waitResult(w2); res.Error != nil || string(res.Buffer[:res.Size]) != "ping" {
+		t.Fatal("incorrect read after attach", res.Error)
+	}
+	w2.Write(nil, conn, []byte("pong"))
+	if res := waitResult(w2); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "pong" {
+		t.Fatal("incorrect write after attach", err, string(buf))
+	}
+
+	if stats := w1.Stats(); stats.Conns != 0 {
+		t.Fatal("conn not removed from the old watcher", stats.Conns)
+	}
+}
+
+func TestResultCopy(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// retained copies of swap buffers are not overwritten by later reads
+	const n = 100
+	go func() {
+		for i := 0; i < n; i++ {
+			remote.Write([]byte(fmt.Sprintf("%03d", i)))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var retained [][]byte
+	var rx int
+	w.ReadPersist(nil, local, nil)
+	for rx < 3*n {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			rx += res.Size
+			retained = append(retained, res.Copy())
+		}
+	}
+
+	var all []byte
+	for _, b := range retained {
+		all = append(all, b...)
+	}
+	for i := 0; i < n; i++ {
+		if string(all[3*i:3*i+3]) != fmt.Sprintf("%03d", i) {
+			t.Fatal("retained data corrupted at", i)
+		}
+	}
+
+	// user buffers are returned as is
+	buf := []byte("abc")
+	res := OpResult{Buffer: buf, Size: 2}
+	if b := res.Copy(); &b[0] != &buf[0] || len(b) != 2 {
+		t.Fatal("user buffer should not be copied")
+	}
+}
+
+func TestWritePriority(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Backend() == "io_uring" {
+		t.Skip("the write in flight on io_uring has started")
+	}
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	filled := fillSendBuffer(t, local, remote)
+
+	// the priority write overtakes the queued ones
+	w.Write("bulk1", local, bytes.Repeat([]byte("a"), 1024))
+	w.Write("bulk2", local, bytes.Repeat([]byte("b"), 1024))
+	w.WritePriority("ctrl1", local, []byte("x"), time.Time{})
+	w.WritePriority("ctrl2", local, []byte("y"), time.Time{})
+
+	go io.Copy(ioutil.Discard, io.LimitReader(remote, int64(filled)))
+
+	var order []interface{}
+	for len(order) < 4 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			order = append(order, res.Context)
+		}
+	}
+	if fmt.Sprint(order) != "[ctrl1 ctrl2 bulk1 bulk2]" {
+		t.Fatal("incorrect completion order", order)
+	}
+}
+
+func TestBufferCheck(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetBufferCheck(true)
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	buf := make([]byte, 16)
+	if err := w.Read(nil, local, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Read(nil, local, buf[8:]); err != ErrBufferInUse {
+		t.Fatal("overlapping read should be rejected", err)
+	}
+	if err := w.Write(nil, local, buf[:4]); err != ErrBufferInUse {
+		t.Fatal("write overlapping a read should be rejected", err)
+	}
+
+	// writes can share a buffer
+	wbuf := []byte("hello")
+	if err := w.Write(nil, local, wbuf); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(nil, local, wbuf); err != nil {
+		t.Fatal(err)
+	}
+
+	remote.Write([]byte("x"))
+	for completed := 0; completed < 3; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed += len(results)
+	}
+
+	// the buffer is released on completion
+	if err := w.Read(nil, local, buf[8:]); err != nil {
+		t.Fatal("buffer not released", err)
+	}
+}
+
+func TestWaitIOInto(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.WaitIOInto(nil); err != ErrEmptyBuffer {
+		t.Fatal("empty slice should be rejected", err)
+	}
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		w.Write(i, local, []byte("x"))
+	}
+
+	// the results are copied in order, the rest are left for next call
+	dst := make([]OpResult, 2)
+	var seen []interface{}
+	for len(seen) < n {
+		count, err := w.WaitIOInto(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count < 1 || count > len(dst) {
+			t.Fatal("incorrect count", count)
+		}
+		for _, res := range dst[:count] {
+			seen = append(seen, res.Context)
+		}
+	}
+	if fmt.Sprint(seen) != "[0 1 2 3 4]" {
+		t.Fatal("incorrect results", seen)
+	}
+}
+
+func TestReadVector(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+
+	if err := w.ReadVector(nil, local, [][]byte{nil, {}}, time.Time{}); err != ErrEmptyBuffer {
+		t.Fatal("empty buffers should be rejected", err)
+	}
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// resumes from the exact offset across buffers
+	header, body := make([]byte, 4), make([]byte, 8)
+	w.ReadVector("vec", local, [][]byte{header, body}, time.Time{})
+	for _, s := range []string{"hdr", "1body", "2345"} {
+		remote.Write([]byte(s))
+		time.Sleep(20 * time.Millisecond)
+	}
+	res := waitResult()
+	if res.Error != nil || res.Size != 12 || len(res.Buffers) != 2 || res.Buffer != nil {
+		t.Fatal("incorrect vector read", res.Error, res.Size)
+	}
+	if string(header) != "hdr1" || string(body) != "body2345" {
+		t.Fatal("incorrect content", string(header), string(body))
+	}
+
+	// EOF before the buffers are filled
+	w.ReadVector("eof", local, [][]byte{header, body}, time.Time{})
+	remote.Write([]byte("ab"))
+	remote.Close()
+	if res := waitResult(); res.Error != io.EOF || res.Size != 2 {
+		t.Fatal("expected EOF with partial read", res.Error, res.Size)
+	}
+}
+
+func TestReadv(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// completes with the data available, across the buffers
+	header, body := make([]byte, 4), make([]byte, 8)
+	remote.Write([]byte("hdr1body"))
+	w.Readv(nil, local, [][]byte{header, body}, time.Time{})
+	res := waitResult()
+	if res.Error != nil || res.Size != 8 || len(res.Buffers) != 2 {
+		t.Fatal("incorrect vector read", res.Error, res.Size)
+	}
+	if string(header) != "hdr1" || string(body[:4]) != "body" {
+		t.Fatal("incorrect content", string(header), string(body))
+	}
+
+	// the gathering counterpart
+	if err := w.Writev(nil, local, [][]byte{nil, {}}, time.Time{}); err != ErrEmptyBuffer {
+		t.Fatal("expected ErrEmptyBuffer, got", err)
+	}
+	w.Writev(nil, local, [][]byte{[]byte("head"), []byte("tail")}, time.Time{})
+	if res := waitResult(); res.Error != nil || res.Size != 8 {
+		t.Fatal("incorrect vector write", res.Error, res.Size)
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "headtail" {
+		t.Fatal("incorrect content written", err, string(buf))
+	}
+}
+
+func TestAccept(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if err := w.Accept("accept", ln); err != nil {
+		t.Fatal(err)
+	}
+
+	// connections arrived together are all accepted
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	var accepted []net.Conn
+	for len(accepted) < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Operation != OpAccept || res.Context != "accept" || res.Error != nil || res.Conn == nil {
+				t.Fatal("incorrect accept result", res.Operation, res.Error)
+			}
+			accepted = append(accepted, res.Conn)
+		}
+	}
+
+	// the accepted conns work with the watcher
+	w.Write(nil, accepted[0], []byte("hello"))
+	w.Read(nil, accepted[0], make([]byte, 8))
+	for done := false; !done; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+			done = res.Operation == OpWrite && res.Size == 5
+		}
+	}
+
+	if err := w.FreeListener(ln); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// reads and writes share the budget, one second of burst,
+	// and one second to refill the rest
+	const rate, size = 200000, 200000
+	if err := w.SetRateLimit(local, rate); err != nil {
+		t.Fatal(err)
+	}
+
+	go remote.Write(make([]byte, size))
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(remote, make([]byte, size))
+		received <- err
+	}()
+
+	start := time.Now()
+	w.ReadFull("read", local, make([]byte, size), time.Time{})
+	w.Write("write", local, make([]byte, size))
+	for count := 0; count < 2; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Error != nil || res.Size != size {
+				t.Fatal("incorrect result", res.Context, res.Error, res.Size)
+			}
+			count++
+		}
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatal("rate limit not respected", elapsed)
+	}
+
+	// limit removed
+	w.SetRateLimit(local, 0)
+	go remote.Write(make([]byte, size))
+	start = time.Now()
+	w.ReadFull("read", local, make([]byte, size), time.Time{})
+	if results, err := w.WaitIO(); err != nil || results[0].Size != size {
+		t.Fatal("incorrect result", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("rate limit not removed", elapsed)
+	}
+
+	// the watcher is closed by finalizer once unreachable
+	runtime.KeepAlive(w)
+}
+
+func TestBackpressure(t *testing.T) {
+	reported := make(chan int, 1)
+	w, err := NewWatcherOpts(Options{OnBackpressure: func(waiting int) {
+		select {
+		case reported <- waiting:
+		default:
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	go io.Copy(ioutil.Discard, remote)
+
+	// keep submitting without WaitIO, until the completions waiting exceed
+	// what the results channel holds and the backpressure is reported, the
+	// writes are counted before submission as the submission blocks once the
+	// loop waits for the results to be consumed
+	var count int64
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				atomic.AddInt64(&count, 1)
+				if err := w.Write(nil, local, []byte{1}); err != nil {
+					atomic.AddInt64(&count, -1)
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	select {
+	case waiting := <-reported:
+		close(stop)
+		if waiting < defaultMaxEvents {
+			t.Fatal("incorrect number of completions waiting", waiting)
+		}
+	case <-time.After(5 * time.Second):
+		close(stop)
+		t.Fatal("backpressure not reported")
+	}
+
+	for n := int64(0); ; {
+		if n == atomic.LoadInt64(&count) {
+			// all the writes counted so far are completed, the submitter
+			// is no longer blocked and returns
+			<-done
+			if n == atomic.LoadInt64(&count) {
+				break
+			}
+		}
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += int64(len(results))
+	}
+	if w.Stats().Backpressure == 0 {
+		t.Fatal("backpressure not counted")
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// the queued writes are flushed before the write direction is shut down
+	payload := make([]byte, 4*1024*1024)
+	rand.Read(payload)
+	w.Write("data", local, payload)
+	w.CloseWrite(local)
+	w.Write("late", local, []byte("late"))
+
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(remote)
+		received <- data
+	}()
+
+	for i := 0; i < 2; i++ {
+		res := waitResult()
+		switch res.Context {
+		case "data":
+			if res.Error != nil || res.Size != len(payload) {
+				t.Fatal("incorrect write", res.Error, res.Size)
+			}
+		case "late":
+			if !IsBrokenPipe(res.Error) {
+				t.Fatal("expected broken pipe for write after CloseWrite", res.Error)
+			}
+		}
+	}
+	if data := <-received; !bytes.Equal(data, payload) {
+		t.Fatal("incorrect data before EOF", len(data))
+	}
+
+	// still readable
+	remote.Write([]byte("pong"))
+	w.Read(nil, local, make([]byte, 4))
+	if res := waitResult(); res.Error != nil || string(res.Buffer[:res.Size]) != "pong" {
+		t.Fatal("conn not readable after CloseWrite", res.Error)
+	}
+
+	// queued read completes with EOF
+	w.Read(nil, local, make([]byte, 4))
+	w.CloseRead(local)
+	if res := waitResult(); res.Error != io.EOF {
+		t.Fatal("expected EOF after CloseRead", res.Error)
+	}
+}
+
+func TestSeq(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	go io.Copy(ioutil.Discard, remote)
+
+	// internal operations are not numbered
+	w.SetIdleTimeout(local, time.Hour)
+
+	// the results are tracked in a flat array by sequence
+	const n = 8
+	var contexts [n + 1]int
+	for i := 1; i <= n/2; i++ {
+		w.Write(i, local, []byte("ping"))
+		contexts[i] = i
+	}
+	ops := make([]Op, n/2)
+	for i := range ops {
+		ops[i] = Op{Operation: OpWrite, Conn: local, Buffer: []byte("ping"), Context: n/2 + i + 1}
+	}
+	if err := w.Submit(ops); err != nil {
+		t.Fatal(err)
+	}
+	for i, op := range ops {
+		if op.Seq != uint64(n/2+i+1) {
+			t.Fatal("incorrect sequence of submitted op", op.Seq)
+		}
+		contexts[op.Seq] = op.Context.(int)
+	}
+
+	for count := 0; count < n; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Seq == 0 || res.Seq > n || contexts[res.Seq] != res.Context.(int) {
+				t.Fatal("incorrect sequence", res.Seq, res.Context)
+			}
+			contexts[res.Seq] = 0
+			count++
+		}
+	}
+}
+
+func TestReentrantSubmission(t *testing.T) {
+	w, err := NewWatcherOpts(Options{MaxEvents: minMaxEvents})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	go io.Copy(ioutil.Discard, remote)
+
+	// more submissions from the loop than the submission queue holds
+	const n = 4 * minMaxEvents
+	var once sync.Once
+	var conns int
+	w.SetBufferPool(func(size int) []byte { return make([]byte, size) }, func(buf []byte) {
+		once.Do(func() {
+			for i := 0; i < n; i++ {
+				if err := w.Write("reentrant", local, []byte{1}); err != nil {
+					t.Error(err)
+				}
+			}
+			conns, _, _ = w.Count()
+		})
+	})
+
+	w.Write("first", local, []byte{1})
+	for count := 0; count < n+1; {
+		results, err := w.WaitIOTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal("reentrant submissions not handled", err)
+		}
+		for _, res := range results {
+			if res.Error != nil {
+				t.Fatal(res.Error)
+			}
+		}
+		count += len(results)
+	}
+	if conns != 1 {
+		t.Fatal("incorrect count from the loop", conns)
+	}
+}
+
+func TestCallsDuringCallback(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	local2, remote2 := tcpPair(t)
+	defer remote2.Close()
+
+	// the callback is blocked on the loop until released
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	w.SetBufferPool(func(size int) []byte {
+		once.Do(func() {
+			close(entered)
+			<-release
+		})
+		return make([]byte, size)
+	}, func(buf []byte) {})
+	w.Read("callback", local, nil)
+	<-entered
+
+	// the calls from another goroutine wait for the loop
+	counted := make(chan int, 1)
+	submitted := make(chan error, 1)
+	go func() {
+		conns, _, _ := w.Count()
+		counted <- conns
+		submitted <- w.Read("goroutine", local2, make([]byte, 16))
+	}()
+	select {
+	case <-counted:
+		t.Fatal("Count returned while the loop is blocked in the callback")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if conns := <-counted; conns != 1 {
+		t.Fatal("incorrect count", conns)
+	}
+	if err := <-submitted; err != nil {
+		t.Fatal(err)
+	}
+	remote.Write([]byte("a"))
+	remote2.Write([]byte("b"))
+	for count := 0; count < 2; {
+		results, err := w.WaitIOTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Error != nil || res.Size != 1 {
+				t.Fatal("unexpected result", res.Context, res.Error, res.Size)
+			}
+		}
+		count += len(results)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// nothing to flush
+	w.Flush("empty", local, time.Time{})
+	if res := waitResult(); res.Operation != OpFlush || res.Error != nil || res.Size != 0 {
+		t.Fatal("incorrect flush", res.Operation, res.Error)
+	}
+
+	// the peer is not reading, the barrier times out
+	payload := make([]byte, 16*1024*1024)
+	w.Write("data", local, payload)
+	w.Flush("timeout", local, time.Now().Add(50*time.Millisecond))
+	if res := waitResult(); res.Context != "timeout" || res.Error != ErrDeadline {
+		t.Fatal("expected flush timeout", res.Context, res.Error)
+	}
+
+	// completes after the writes before
+	w.Flush("flush", local, time.Time{})
+	go io.Copy(ioutil.Discard, remote)
+	var completed []OpResult
+	for len(completed) < 2 {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed = append(completed, results...)
+	}
+	for i, ctx := range []string{"data", "flush"} {
+		if res := completed[i]; res.Context != ctx || res.Error != nil {
+			t.Fatal("incorrect completion order", res.Context, ctx, res.Error)
+		}
+	}
+}
+
+func TestConnections(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	idle, idleRemote := tcpPair(t)
+	defer idleRemote.Close()
+
+	w.Read("pending", local, make([]byte, 16))
+	w.Write("done", idle, []byte("ping"))
+	if _, err := w.WaitIO(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := w.Connections()
+	if len(infos) != 2 {
+		t.Fatal("incorrect number of connections", len(infos))
+	}
+	for _, info := range infos {
+		if info.Fd <= 0 || info.LastActive.IsZero() || info.LocalAddr == nil || info.RemoteAddr == nil {
+			t.Fatal("incomplete info", info)
+		}
+		switch info.LocalAddr.String() {
+		case local.LocalAddr().String():
+			if info.Conn != local || info.Readers != 1 || info.Writers != 0 {
+				t.Fatal("incorrect info of conn with pending read", info)
+			}
+		case idle.LocalAddr().String():
+			// not held without operations queued
+			if info.Conn != nil || info.Readers != 0 || info.Writers != 0 {
+				t.Fatal("incorrect info of idle conn", info)
+			}
+		default:
+			t.Fatal("unknown conn", info.LocalAddr)
+		}
+	}
+
+	w.Close()
+	if w.Connections() != nil {
+		t.Fatal("expected nil on closed watcher")
+	}
+}
+
+func TestEINTR(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// signals interrupt the poller and the syscalls while the read is blocked
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+
+	w.Read(nil, local, make([]byte, 4))
+	for i := 0; i < 100; i++ {
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		if i%10 == 0 {
+			// registrations and wakeups under signals
+			conn, peer := tcpPair(t)
+			w.Write(nil, conn, []byte("x"))
+			w.Free(conn)
+			peer.Close()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	remote.Write([]byte("ping"))
+
+	for {
+		results, err := w.WaitIOTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal("interrupted", err)
+		}
+		for _, res := range results {
+			if res.Operation == OpRead {
+				if res.Error != nil || string(res.Buffer[:res.Size]) != "ping" {
+					t.Fatal("incorrect read", res.Error)
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestReadMsg(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := unixPair(t)
+	defer remote.Close()
+
+	r, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer wr.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	if err := w.ReadMsg("msg", local, make([]byte, 16), oob, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := remote.WriteMsgUnix([]byte("hello"), syscall.UnixRights(int(r.Fd())), nil); err != nil {
+		t.Fatal(err)
+	}
+	res := waitResult()
+	if res.Error != nil || string(res.Buffer[:res.Size]) != "hello" {
+		t.Fatal("read msg failed", res.Error, res.Size)
+	}
+	if &res.OOB[0] != &oob[0] || res.OOBn != len(oob) || res.Flags&syscall.MSG_CTRUNC != 0 {
+		t.Fatal("unexpected control messages", res.OOBn, res.Flags)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(res.OOB[:res.OOBn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatal("no control message", err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatal("no fds received", err)
+	}
+	syscall.Close(fds[0])
+
+	// control messages are truncated if oob is too small
+	if err := w.ReadMsg("trunc", local, make([]byte, 16), nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := remote.WriteMsgUnix([]byte("world"), syscall.UnixRights(int(r.Fd())), nil); err != nil {
+		t.Fatal(err)
+	}
+	res = waitResult()
+	if res.Error != nil || string(res.Buffer[:res.Size]) != "world" || res.OOBn != 0 || res.Flags&syscall.MSG_CTRUNC == 0 {
+		t.Fatal("expected truncated control messages", res.Error, res.OOBn, res.Flags)
+	}
+}
+
+func TestSetReadBuffer(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	if err := w.SetReadBuffer(local, make([]byte, 4)); err != ErrNotWatched {
+		t.Fatal("expected ErrNotWatched, got", err)
+	}
+
+	// rotate the buffers of a persistent read
+	bufs := [][]byte{make([]byte, 4), make([]byte, 4), make([]byte, 4)}
+	if err := w.ReadPersist(nil, local, bufs[0]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(bufs); i++ {
+		if err := w.SetReadBuffer(local, bufs[i]); err != nil {
+			t.Fatal(err)
+		}
+		remote.Write([]byte("ping"))
+		res := waitResult()
+		if res.Error != nil || res.Size != 4 || &res.Buffer[0] != &bufs[i][0] {
+			t.Fatal("read into the buffer set failed", i, res.Error, res.Size)
+		}
+	}
+	w.Cancel(local)
+	if res := waitResult(); res.Error != ErrCanceled {
+		t.Fatal("expected ErrCanceled, got", res.Error)
+	}
+
+	if err := w.SetReadBuffer(local, make([]byte, 4)); err != ErrNoPendingRead {
+		t.Fatal("expected ErrNoPendingRead, got", err)
+	}
+
+	// the buffer partially filled can't be changed
+	if err := w.ReadFull(nil, local, make([]byte, 8), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	remote.Write([]byte("half"))
+	time.Sleep(50 * time.Millisecond)
+	if err := w.SetReadBuffer(local, make([]byte, 8)); err != ErrBufferInUse {
+		t.Fatal("expected ErrBufferInUse, got", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// self-signed certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gaio"},
+		DNSNames:     []string{"gaio"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	clientConfig := &tls.Config{ServerName: "gaio", RootCAs: roots}
+
+	// handshakes on both sides are driven by the same watcher
+	const N = 8
+	errs := make(chan error, 2*N)
+	for i := 0; i < N; i++ {
+		local, remote := tcpPair(t)
+		server := TLSServer(w, remote, serverConfig)
+		client := TLSClient(w, local, clientConfig)
+		go func() {
+			defer server.Close()
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(server, buf); err != nil {
+				errs <- err
+				return
+			}
+			_, err := server.Write(buf)
+			errs <- err
+		}()
+		go func() {
+			defer client.Close()
+			if _, err := client.Write([]byte("hello")); err != nil {
+				errs <- err
+				return
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(client, buf); err != nil {
+				errs <- err
+				return
+			}
+			if string(buf) != "hello" {
+				errs <- fmt.Errorf("unexpected echo %q", buf)
+				return
+			}
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < 2*N; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("tls timeout")
+		}
+	}
+}
+
+func TestReadAfterFree(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// submissions racing with Free are all delivered
+	const N = 100
+	var remotes []net.Conn
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		local, remote := tcpPair(t)
+		remotes = append(remotes, remote)
+		w.Read(nil, local, make([]byte, 1))
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			w.Free(local)
+		}()
+		go func() {
+			defer wg.Done()
+			w.Read("race", local, make([]byte, 1))
+		}()
+	}
+	wg.Wait()
+	defer func() {
+		for _, remote := range remotes {
+			remote.Close()
+		}
+	}()
+
+	var completed int
+	for completed < 2*N {
+		results, err := w.WaitIOTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal("results dropped", completed, err)
+		}
+		for _, res := range results {
+			if res.Error != ErrConnClosed {
+				t.Fatal("expected ErrConnClosed, got", res.Error)
+			}
+			completed++
+		}
+	}
+
+	// the conn freed is not watched again
+	local, remote := tcpPair(t)
+	defer remote.Close()
+	w.Read(nil, local, make([]byte, 1))
+	w.Free(local)
+	w.Write(nil, local, []byte("ping"))
+	for completed = 0; completed < 2; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Error != ErrConnClosed {
+				t.Fatal("expected ErrConnClosed, got", res.Error)
+			}
+			completed++
+		}
+	}
+	if len(w.Connections()) != 0 {
+		t.Fatal("conn freed is watched again")
+	}
+}
+
+func TestNoDup(t *testing.T) {
+	w, err := NewWatcherOpts(Options{NoDup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	var fd int
+	rc, err := local.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(s uintptr) { fd = int(s) })
+
+	w.Write(nil, local, []byte("ping"))
+	res := waitResult()
+	if res.Error != nil || res.Size != 4 || res.Fd != fd {
+		t.Fatal("write on the original fd failed", res.Error, res.Fd, fd)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("unexpected data", err)
+	}
+
+	if _, err := w.Detach(local); err != ErrNoDup {
+		t.Fatal("expected ErrNoDup, got", err)
+	}
+
+	// the conn is usable after Free, and can be watched again
+	w.Free(local)
+	for {
+		if _, err := w.WriteQueueLen(local); err == ErrNotWatched {
+			break
+		}
+	}
+	if _, err := local.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "pong" {
+		t.Fatal("unexpected data", err)
+	}
+	remote.Write([]byte("back"))
+	w.Read(nil, local, buf)
+	if res := waitResult(); res.Error != nil || string(res.Buffer[:res.Size]) != "back" {
+		t.Fatal("read on the conn watched again failed", res.Error)
+	}
+}
+
+// logWriter forwards the log output to a channel
+type logWriter chan string
+
+func (lw logWriter) Write(p []byte) (int, error) {
+	select {
+	case lw <- string(p):
+	default:
+	}
+	return len(p), nil
+}
+
+func TestLeakDiagnostics(t *testing.T) {
+	lw := make(logWriter, 1)
+	log.SetOutput(lw)
+	defer log.SetOutput(os.Stderr)
+	SetLeakDiagnostics(true)
+	defer SetLeakDiagnostics(false)
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// the closed watcher is not reported
+	func() {
+		w, err := NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}()
+
+	// a watcher leaked with a pending read
+	func() {
+		w, err := NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Read(nil, local, make([]byte, 1))
+		for w.Stats().Conns != 1 {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runtime.GC()
+		select {
+		case msg := <-lw:
+			if !strings.Contains(msg, "abandoned 1 connections, 1 pending operations") {
+				t.Fatal("unexpected report", msg)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("leaked watcher not reported")
+}
+
+func TestMaxInflightBytes(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	w.SetMaxInflightBytes(12)
+	if err := w.Read(nil, local, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Read(nil, local, make([]byte, 8)); err != ErrInflightLimit {
+		t.Fatal("expected ErrInflightLimit, got", err)
+	}
+	// nil buffer reads use the internal buffers, not counted
+	if err := w.Read(nil, local, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bytes are released on delivery
+	remote.Write([]byte("01234567abcd"))
+	for completed := 0; completed < 2; {
+		results, err := w.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed += len(results)
+	}
+	if err := w.Read(nil, local, make([]byte, 12)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bound can be removed
+	w.SetMaxInflightBytes(0)
+	if err := w.Read(nil, local, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnPollerError(t *testing.T) {
+	type pollerError struct {
+		fd  int
+		err error
+	}
+	errs := make(chan pollerError, 16)
+	w, err := NewWatcherOpts(Options{OnPollerError: func(fd int, err error) {
+		errs <- pollerError{fd, err}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Backend() == "io_uring" {
+		t.Skip("the socket error is taken by the read in flight on io_uring")
+	}
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+	waitError := func() pollerError {
+		select {
+		case e := <-errs:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("poller error not reported")
+		}
+		return pollerError{}
+	}
+
+	// reset with a read pending
+	local, remote := tcpPair(t)
+	w.Read(nil, local, make([]byte, 16))
+	time.Sleep(20 * time.Millisecond)
+	remote.(*net.TCPConn).SetLinger(0)
+	remote.Close()
+	res := waitResult()
+	if e := waitError(); e.err != syscall.ECONNRESET || e.fd != res.Fd {
+		t.Fatal("expected ECONNRESET reported on the fd, got", e.fd, e.err)
+	}
+	if !IsConnReset(res.Error) {
+		t.Fatal("expected connection reset, got", res.Error)
+	}
+
+	// reset on an idle conn, the error is kept for the next read
+	local, remote = tcpPair(t)
+	w.Write(nil, local, []byte("ping"))
+	waitResult()
+	remote.(*net.TCPConn).SetLinger(0)
+	remote.Close()
+	if e := waitError(); e.err != syscall.ECONNRESET {
+		t.Fatal("expected ECONNRESET, got", e.err)
+	}
+	w.Read(nil, local, make([]byte, 16))
+	if res := waitResult(); !IsConnReset(res.Error) {
+		t.Fatal("expected connection reset, got", res.Error)
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	pool, err := NewWatcherPool(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	// one listener per shard on the same address
+	ln, err := ListenReusePort("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln2, err := ListenReusePort("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.shards[0].Accept(0, ln); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.shards[1].Accept(1, ln2); err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 16
+	for i := 0; i < N; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	var accepted int
+	for accepted < N {
+		results, err := pool.WaitIO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Operation != OpAccept || res.Error != nil {
+				t.Fatal("incorrect accept result", res.Operation, res.Error)
+			}
+			res.Conn.Close()
+			accepted++
+		}
+	}
+
+	// the port is in use without SO_REUSEPORT
+	if ln3, err := net.Listen("tcp", addr); err == nil {
+		ln3.Close()
+		t.Fatal("address shared without SO_REUSEPORT")
+	}
+}
+
+func TestTimeoutHeapStress(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	const conns = 8
+	var locals, remotes []net.Conn
+	for i := 0; i < conns; i++ {
+		local, remote := tcpPair(t)
+		defer remote.Close()
+		locals = append(locals, local)
+		remotes = append(remotes, remote)
+	}
+
+	// mixed timed and untimed operations, with random cancels and deadline changes
+	var submitted int
+	delivered := make(map[uint64]bool)
+	collect := func() {
+		for {
+			results, err := w.WaitIOTimeout(time.Millisecond)
+			if err == ErrWaitTimeout {
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			for _, res := range results {
+				if delivered[res.Seq] {
+					t.Fatal("operation delivered twice", res.Seq)
+				}
+				delivered[res.Seq] = true
+			}
+		}
+	}
+
+	deadline := func() time.Time {
+		if mrand.Intn(2) == 0 {
+			return time.Time{}
+		}
+		return time.Now().Add(time.Duration(mrand.Intn(5000)) * time.Microsecond)
+	}
+	for i := 0; i < 5000; i++ {
+		k := mrand.Intn(conns)
+		switch mrand.Intn(6) {
+		case 0, 1:
+			if err := w.ReadTimeout(nil, locals[k], make([]byte, 1+mrand.Intn(4)), deadline()); err == nil {
+				submitted++
+			}
+		case 2:
+			if err := w.WriteTimeout(nil, locals[k], make([]byte, 1+mrand.Intn(4)), deadline()); err == nil {
+				submitted++
+			}
+		case 3:
+			w.Cancel(locals[k])
+		case 4:
+			w.SetDeadline(locals[k], OpRead, deadline())
+		case 5:
+			remotes[k].Write([]byte("x"))
+		}
+		if i%100 == 0 {
+			collect()
+		}
+	}
+
+	for _, local := range locals {
+		w.Cancel(local)
+	}
+	for start := time.Now(); len(delivered) < submitted; {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("operations lost", submitted, len(delivered))
+		}
+		collect()
+	}
+
+	var valid bool
+	var remaining int
+	w.runInLoop(func() {
+		valid = w.timeouts.valid()
+		remaining = w.timeouts.Len()
+	})
+	if !valid || remaining != 0 {
+		t.Fatal("timeout heap corrupted", valid, remaining)
+	}
+}
+
+func TestWriteSize(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	// the peer reads slowly, the write is resumed after EAGAIN many times
+	received := make(chan int, 1)
+	go func() {
+		var n int
+		buf := make([]byte, 4096)
+		for {
+			nr, err := remote.Read(buf)
+			n += nr
+			if err != nil {
+				received <- n
+				return
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	const size = 4 << 20
+	w.Write(nil, local, make([]byte, size))
+	if res := waitResult(); res.Error != nil || res.Size != size {
+		t.Fatal("incorrect size of write", res.Error, res.Size)
+	}
+
+	// the partial progress before the deadline is reported exactly
+	w.WriteTimeout(nil, local, make([]byte, 64<<20), time.Now().Add(100*time.Millisecond))
+	res := waitResult()
+	if res.Error != ErrDeadline || res.Size == 0 || res.Size == 64<<20 {
+		t.Fatal("incorrect partial write", res.Error, res.Size)
+	}
+	partial := res.Size
+
+	// nothing to write
+	w.aioCreate(nil, OpWrite, local, nil, zeroTime, false)
+	if res := waitResult(); res.Error != nil || res.Size != 0 {
+		t.Fatal("incorrect empty write", res.Error, res.Size)
+	}
+
+	// the sizes add up to the bytes received by peer
+	w.Free(local)
+	select {
+	case n := <-received:
+		if n != size+partial {
+			t.Fatal("sizes mismatch the bytes received", n, size+partial)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("peer read timeout")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	local, remote := tcpPair(t)
+	defer remote.Close()
+
+	// alive with nothing to read
+	w.Probe(local)
+	if res := waitResult(); res.Operation != OpProbe || res.Conn != local || res.Error != nil {
+		t.Fatal("incorrect probe result", res.Operation, res.Error)
+	}
+
+	// the data pending is not consumed
+	remote.Write([]byte("data"))
+	time.Sleep(20 * time.Millisecond)
+	w.Probe(local)
+	if res := waitResult(); res.Error != nil {
+		t.Fatal("alive conn probed as", res.Error)
+	}
+	w.Read(nil, local, make([]byte, 4))
+	if res := waitResult(); res.Error != nil || string(res.Buffer[:res.Size]) != "data" {
+		t.Fatal("data consumed by probe", res.Error, res.Size)
+	}
+
+	// closed by peer
+	remote.Close()
+	time.Sleep(20 * time.Millisecond)
+	w.Probe(local)
+	if res := waitResult(); res.Error != ErrConnClosed {
+		t.Fatal("expected ErrConnClosed, got", res.Error)
+	}
+
+	// reset by peer
+	local, remote = tcpPair(t)
+	remote.(*net.TCPConn).SetLinger(0)
+	remote.Close()
+	time.Sleep(20 * time.Millisecond)
+	w.Probe(local)
+	if res := waitResult(); !errors.Is(res.Error, ErrConnClosed) || !IsConnReset(res.Error) {
+		t.Fatal("expected ErrConnClosed wrapping ECONNRESET, got", res.Error)
+	}
+}
+
+func TestWaitIOShard(t *testing.T) {
+	const shards = 3
+	w, err := NewWatcherOpts(Options{ResultShards: shards})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.WaitIOShard(shards); err != ErrInvalidShard {
+		t.Fatal("expected ErrInvalidShard, got", err)
+	}
+
+	const numConns = 8
+	for i := 0; i < numConns; i++ {
+		local, remote := tcpPair(t)
+		defer local.Close()
+		defer remote.Close()
+
+		remote.Write([]byte("pong"))
+		w.Write(nil, local, []byte("ping"))
+		w.Read(nil, local, nil)
+	}
+
+	// each shard is consumed by a worker of its own
+	var wg sync.WaitGroup
+	var total int32
+	for k := 0; k < shards; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			for atomic.LoadInt32(&total) < numConns*2 {
+				results, err := w.WaitIOShard(k)
+				if err != nil {
+					return
+				}
+				for _, res := range results {
+					if res.Fd%shards != k {
+						t.Errorf("result of fd %v returned on shard %v", res.Fd, k)
+					}
+					if res.Error != nil || res.Size != 4 {
+						t.Errorf("unexpected result %v %v", res.Error, res.Size)
+					}
+				}
+				atomic.AddInt32(&total, int32(len(results)))
+			}
+			// wakes up the other workers
+			w.Close()
+		}(k)
+	}
+	wg.Wait()
+	if total != numConns*2 {
+		t.Fatal("results missing", total)
+	}
+}
+
+func TestWaitReadable(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+
+	if err := w.WaitReadable("ready", local, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WaitIOTimeout(50 * time.Millisecond); err != ErrWaitTimeout {
+		t.Fatal("readiness reported without data", err)
+	}
+
+	remote.Write([]byte("data"))
+	results, err := w.WaitIO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := results[0]; res.Context != "ready" || res.Operation != OpRead || res.Error != nil || res.Size != 0 {
+		t.Fatal("unexpected readiness result", res.Context, res.Error, res.Size)
+	}
+
+	// the data is left for the read
+	w.Read(nil, local, make([]byte, 16))
+	results, err = w.WaitIO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := results[0]; res.Error != nil || string(res.Buffer[:res.Size]) != "data" {
+		t.Fatal("data consumed by readiness", res.Error, res.Size)
+	}
+
+	remote.Close()
+	w.WaitReadable(nil, local, time.Time{})
+	results, err = w.WaitIO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := results[0]; res.Error != io.EOF || res.Size != 0 {
+		t.Fatal("expected io.EOF, got", res.Error)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	caps := w.Capabilities()
+	if runtime.GOOS == "linux" {
+		if (w.Backend() != "epoll" && w.Backend() != "io_uring") || !caps.Splice || !caps.Recvmmsg || !caps.SendFile {
+			t.Fatal("incorrect capabilities of linux", w.Backend(), caps)
+		}
+	} else if w.Backend() != "kqueue" || caps.Splice || caps.Recvmmsg {
+		t.Fatal("incorrect capabilities of kqueue", w.Backend(), caps)
+	}
+
+	// the optional operations are attempted only if supported
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+	if !caps.SendFile {
+		if err := w.SendFile(nil, local, os.Stdin, 0, 1, time.Time{}); err != ErrUnsupported {
+			t.Fatal("expected ErrUnsupported for sendfile, got", err)
+		}
+	}
+	if err := w.Splice(nil, local, remote, 1, time.Time{}); caps.Splice != (err == nil) {
+		t.Fatal("splice capability mismatch", caps.Splice, err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	ln := echoServer(t, 1024)
+	defer ln.Close()
+
+	if err := w.Connect(nil, "udp", ln.Addr().String(), time.Time{}); err == nil {
+		t.Fatal("unknown network accepted")
+	}
+
+	if err := w.Connect("dial", "tcp", ln.Addr().String(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	res := waitResult()
+	if res.Operation != OpConnect || res.Context != "dial" || res.Error != nil || res.Conn == nil {
+		t.Fatal("connect failed", res.Error)
+	}
+	if res.Conn.RemoteAddr().String() != ln.Addr().String() || res.RemoteAddr.String() != ln.Addr().String() {
+		t.Fatal("incorrect remote address", res.Conn.RemoteAddr(), res.RemoteAddr)
+	}
+
+	// the connection established is usable on the watcher
+	conn := res.Conn
+	w.Write(nil, conn, []byte("hello"))
+	w.ReadFull(nil, conn, make([]byte, 5), time.Time{})
+	for completed := 0; completed < 2; completed++ {
+		if res := waitResult(); res.Error != nil || res.Size != 5 {
+			t.Fatal("echo failed", res.Operation, res.Error)
+		}
+	}
+	w.Free(conn)
+
+	// refused
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := refused.Addr().String()
+	refused.Close()
+	w.Connect(nil, "tcp", addr, time.Time{})
+	if res := waitResult(); res.Error != syscall.ECONNREFUSED || res.Conn != nil {
+		t.Fatal("expected ECONNREFUSED, got", res.Error)
+	}
+	if n := w.Stats().Conns; n != 0 {
+		t.Fatal("connecting adapters are not released", n)
+	}
+}
+
+func TestOnComplete(t *testing.T) {
+	testOnComplete(t, nil)
+	// callbacks run asynchronously get the copies of the swap buffers
+	testOnComplete(t, func(f func()) { go f() })
+}
+
+func testOnComplete(t *testing.T, dispatcher func(f func())) {
+	const numConns = 4
+	results := make(chan OpResult, numConns*2)
+	w, err := NewWatcherOpts(Options{
+		ResultShards: 2,
+		OnComplete: func(res OpResult) {
+			if res.Operation == OpRead {
+				res.Buffer = res.Copy()
+			}
+			results <- res
+		},
+		Dispatcher: dispatcher,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.WaitIO(); err != ErrCallbackMode {
+		t.Fatal("expected ErrCallbackMode, got", err)
+	}
+	if _, err := w.WaitIOShard(1); err != ErrCallbackMode {
+		t.Fatal("expected ErrCallbackMode, got", err)
+	}
+
+	for i := 0; i < numConns; i++ {
+		local, remote := tcpPair(t)
+		defer local.Close()
+		defer remote.Close()
+
+		remote.Write([]byte("pong"))
+		w.Write(i, local, []byte("ping"))
+		w.Read(i, local, nil)
+	}
+
+	for i := 0; i < numConns*2; i++ {
+		select {
+		case res := <-results:
+			if res.Error != nil || res.Size != 4 {
+				t.Fatal("unexpected result", res.Error, res.Size)
+			}
+			if res.Operation == OpRead && string(res.Buffer) != "pong" {
+				t.Fatal("unexpected data", string(res.Buffer))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("callbacks missing")
+		}
 	}
-	close(die)
 }
@@ -0,0 +1,580 @@
+// +build linux,iouring,!mips,!mipsle,!mips64,!mips64le
+
+package gaio
+
+import (
+	"io"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// io_uring ABI, see include/uapi/linux/io_uring.h, the syscall numbers are the ones of
+// the generic syscall table, shared by the architectures other than mips.
+const (
+	sysIOURingSetup    = 425
+	sysIOURingEnter    = 426
+	sysIOURingRegister = 427
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringOpAsyncCancel = 14
+	ioringOpRead        = 22
+	ioringOpWrite       = 23
+
+	ioringEnterGetEvents  = 1 << 0
+	ioringRegisterEventfd = 4
+	ioringRegisterProbe   = 8
+	ioringFeatNoDrop      = 1 << 1
+	ioringSQCQOverflow    = 1 << 1
+	ioringOpSupported     = 1 << 0
+
+	// max submission entries of a ring, the completion queue is twice as large, and
+	// the completions beyond are kept by the kernel(IORING_FEAT_NODROP)
+	maxRingEntries = 1024
+	// max opcodes probed
+	maxRingProbeOps = 256
+)
+
+// uringParams is struct io_uring_params
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+// uringSQOffsets is struct io_sqring_offsets
+type uringSQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+// uringCQOffsets is struct io_cqring_offsets
+type uringCQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+// uringSQE is struct io_uring_sqe
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// uringCQE is struct io_uring_cqe
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ringOp is an operation in flight on the ring
+type ringOp struct {
+	pcb       *aiocb
+	fd        int
+	ev        int  // direction of the operation, EV_READ or EV_WRITE
+	canceling bool // the cancellation is submitted
+	deliver   bool // removed from its queue, delivered on completion
+	drop      bool // released with its conn, forgotten on completion
+}
+
+// ring is the io_uring of a watcher, the plain reads and writes on user buffers are submitted
+// to it at the head of their queues, instead of being attempted on readiness, and the
+// completions reaped drive the queues like the poller events. The eventfd registered to it
+// is watched by the poller, to wake up the loop on completions. It's owned by the loop.
+type ring struct {
+	fd     int
+	efd    int // eventfd signaled on completions
+	efdbuf []byte
+
+	sqRing  []byte
+	cqRing  []byte
+	sqesMem []byte
+
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqFlags *uint32
+	sqArray []uint32
+	sqes    []uringSQE
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []uringCQE
+
+	entries  uint32
+	tail     uint32 // local tail of the submission queue
+	toSubmit uint32 // entries queued since last submission
+
+	nextID   uint64
+	inflight map[uint64]*ringOp
+	busy     map[int]int // directions of the fds with an operation in flight
+
+	reaped  []uringCQE // completions taken from the queue, to be applied
+	reaping bool       // the completions are being applied
+}
+
+// openRing sets up an io_uring of 'entries' for the watcher of poller 'p', it returns nil if
+// io_uring, or its read and write operations, are not supported by the kernel, and the
+// watcher falls back to the poller alone.
+func openRing(p *poller, entries int) *ring {
+	n := uint32(1)
+	for n < uint32(entries) && n < maxRingEntries {
+		n <<= 1
+	}
+
+	var params uringParams
+	fd, _, e := syscall.Syscall(sysIOURingSetup, uintptr(n), uintptr(unsafe.Pointer(&params)), 0)
+	if e != 0 {
+		return nil
+	}
+
+	r := &ring{fd: int(fd), efd: -1}
+	if params.features&ioringFeatNoDrop == 0 || !r.probe() || r.mmap(&params) != nil || r.registerEventfd(p) != nil {
+		r.close()
+		return nil
+	}
+	r.efdbuf = make([]byte, 8)
+	r.inflight = make(map[uint64]*ringOp)
+	r.busy = make(map[int]int)
+	return r
+}
+
+// probe checks the read, write and cancel operations are supported by the kernel
+func (r *ring) probe() bool {
+	// struct io_uring_probe, followed by the array of struct io_uring_probe_op
+	buf := make([]byte, 16+8*maxRingProbeOps)
+	_, _, e := syscall.Syscall6(sysIOURingRegister, uintptr(r.fd), ioringRegisterProbe, uintptr(unsafe.Pointer(&buf[0])), maxRingProbeOps, 0, 0)
+	if e != 0 {
+		return false
+	}
+
+	for _, op := range []int{ioringOpAsyncCancel, ioringOpRead, ioringOpWrite} {
+		if op > int(buf[0]) {
+			return false
+		}
+		flags := *(*uint16)(unsafe.Pointer(&buf[16+8*op+2]))
+		if flags&ioringOpSupported == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mmap maps the submission and completion queues of the ring
+func (r *ring) mmap(params *uringParams) (err error) {
+	const prot = syscall.PROT_READ | syscall.PROT_WRITE
+	const flags = syscall.MAP_SHARED | syscall.MAP_POPULATE
+	sqSize := params.sqOff.array + params.sqEntries*4
+	cqSize := params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))
+	sqesSize := params.sqEntries * uint32(unsafe.Sizeof(uringSQE{}))
+
+	if r.sqRing, err = syscall.Mmap(r.fd, ioringOffSQRing, int(sqSize), prot, flags); err != nil {
+		return err
+	}
+	if r.cqRing, err = syscall.Mmap(r.fd, ioringOffCQRing, int(cqSize), prot, flags); err != nil {
+		return err
+	}
+	if r.sqesMem, err = syscall.Mmap(r.fd, ioringOffSQEs, int(sqesSize), prot, flags); err != nil {
+		return err
+	}
+
+	r.entries = params.sqEntries
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqFlags = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.flags]))
+	r.sqArray = (*[maxRingEntries]uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.array]))[:params.sqEntries:params.sqEntries]
+	r.sqes = (*[maxRingEntries]uringSQE)(unsafe.Pointer(&r.sqesMem[0]))[:params.sqEntries:params.sqEntries]
+	r.tail = *r.sqTail
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = (*[2 * maxRingEntries]uringCQE)(unsafe.Pointer(&r.cqRing[params.cqOff.cqes]))[:params.cqEntries:params.cqEntries]
+	return nil
+}
+
+// registerEventfd registers an eventfd to be signaled on completions, and watches it
+// with the poller 'p'
+func (r *ring) registerEventfd(p *poller) error {
+	efd, _, e := syscall.Syscall(syscall.SYS_EVENTFD2, 0, _EFD_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if e != 0 {
+		return e
+	}
+	r.efd = int(efd)
+
+	fd := int32(r.efd)
+	if _, _, e := syscall.Syscall6(sysIOURingRegister, uintptr(r.fd), ioringRegisterEventfd, uintptr(unsafe.Pointer(&fd)), 1, 0, 0); e != 0 {
+		return e
+	}
+	return syscall.EpollCtl(p.pfd, syscall.EPOLL_CTL_ADD, r.efd, &syscall.EpollEvent{Fd: fd, Events: syscall.EPOLLIN | _EPOLLET})
+}
+
+// close releases the ring, the operations must not be in flight
+func (r *ring) close() {
+	for _, mem := range [][]byte{r.sqRing, r.cqRing, r.sqesMem} {
+		if mem != nil {
+			syscall.Munmap(mem)
+		}
+	}
+	if r.efd != -1 {
+		syscall.Close(r.efd)
+	}
+	syscall.Close(r.fd)
+}
+
+// enter submits 'toSubmit' entries, and waits for 'minComplete' completions
+func (r *ring) enter(toSubmit uint32, minComplete uint32, flags uintptr) (int, error) {
+	n, _, e := syscall.Syscall6(sysIOURingEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), flags, 0, 0)
+	if e != 0 {
+		return 0, e
+	}
+	return int(n), nil
+}
+
+// ringable returns true if the read or write of 'pcb' goes through the ring, only the plain
+// ones on user buffers do, the writes are left to writev if coalesced, and the ones
+// submitted already stay till completion.
+func (w *watcher) ringable(pcb *aiocb) bool {
+	if pcb.ringID != 0 || pcb.ringDone {
+		return true
+	}
+	if pcb.op != OpRead && atomic.LoadInt32(&w.coalesce) == 1 {
+		return false
+	}
+	return len(pcb.buffer) > 0 && !pcb.pooled && !pcb.persist && pcb.maxSyscalls == 0 && !w.limited
+}
+
+// ringFull returns the bytes for the operation of 'pcb' to complete
+func ringFull(pcb *aiocb) int {
+	switch {
+	case pcb.op != OpRead:
+		return len(pcb.buffer)
+	case !pcb.readFull:
+		return 1
+	case pcb.min > 0:
+		return pcb.min
+	}
+	return len(pcb.buffer)
+}
+
+// ringRead reads into the user buffer of 'pcb' with the ring, the read submitted at the head
+// of the queue completes when its completion is applied, and a read full operation is
+// resubmitted until the buffer is filled.
+func (w *watcher) ringRead(fd int, pcb *aiocb) bool {
+	if pcb.ringID != 0 {
+		return false
+	}
+
+	if pcb.ringDone {
+		pcb.ringDone = false
+		res := pcb.ringRes
+		if res > 0 {
+			pcb.size += int(res)
+			atomic.AddInt64(&w.stats.bytesRead, int64(res))
+		} else if res == 0 {
+			pcb.err = io.EOF
+		} else if errno := syscall.Errno(-res); errno != syscall.EAGAIN && errno != syscall.EINTR {
+			pcb.err = errno
+		}
+
+		if pcb.err != nil || pcb.size >= ringFull(pcb) {
+			return true
+		}
+		if res > 0 {
+			w.progressDeadline(pcb)
+		}
+	}
+	return w.queueRing(ioringOpRead, fd, EV_READ, pcb, pcb.buffer[pcb.size:])
+}
+
+// ringWrite writes the user buffer of 'pcb' with the ring, it's resubmitted until all
+// bytes are written.
+func (w *watcher) ringWrite(fd int, pcb *aiocb) bool {
+	if pcb.ringID != 0 {
+		return false
+	}
+
+	if pcb.ringDone {
+		pcb.ringDone = false
+		res := pcb.ringRes
+		if res > 0 {
+			pcb.size += int(res)
+			atomic.AddInt64(&w.stats.bytesWritten, int64(res))
+		} else if errno := syscall.Errno(-res); res < 0 && errno != syscall.EAGAIN && errno != syscall.EINTR {
+			// the bytes written before remain in size
+			pcb.err = errno
+			return true
+		}
+
+		if pcb.size == len(pcb.buffer) {
+			return true
+		}
+	}
+	return w.queueRing(ioringOpWrite, fd, EV_WRITE, pcb, pcb.buffer[pcb.size:])
+}
+
+// queueRing queues the read or write of 'pcb' on 'b', it's retried on the completion of
+// the operation canceled in the same direction of 'fd', if any is still in flight.
+func (w *watcher) queueRing(opcode uint8, fd int, ev int, pcb *aiocb, b []byte) bool {
+	r := w.ring
+	if r.busy[fd]&ev != 0 {
+		return false
+	}
+	if len(b) > 1<<30 {
+		b = b[:1<<30]
+	}
+
+	sqe, err := w.ringSQE()
+	if err != nil {
+		pcb.err = err
+		return true
+	}
+	r.nextID++
+	sqe.opcode = opcode
+	sqe.fd = int32(fd)
+	sqe.off = ^uint64(0) // current position, sockets and pipes have none
+	sqe.addr = uint64(uintptr(unsafe.Pointer(&b[0])))
+	sqe.len = uint32(len(b))
+	sqe.userData = r.nextID
+
+	pcb.ringID = r.nextID
+	r.inflight[r.nextID] = &ringOp{pcb: pcb, fd: fd, ev: ev}
+	r.busy[fd] |= ev
+	return false
+}
+
+// ringSQE returns the next submission entry, the entries queued are submitted if the
+// submission queue is full, the error of the submission is returned if it fails.
+func (w *watcher) ringSQE() (*uringSQE, error) {
+	r := w.ring
+	for r.tail-atomic.LoadUint32(r.sqHead) >= r.entries {
+		if err := w.submitRing(); err != nil {
+			return nil, err
+		}
+	}
+
+	idx := r.tail & r.sqMask
+	sqe := &r.sqes[idx]
+	*sqe = uringSQE{}
+	r.sqArray[idx] = idx
+	r.tail++
+	atomic.StoreUint32(r.sqTail, r.tail)
+	r.toSubmit++
+	return sqe, nil
+}
+
+// submitRing submits the entries queued, the completions are reaped to make room if the
+// kernel is busy with the completion queue full, other errors are returned.
+func (w *watcher) submitRing() error {
+	r := w.ring
+	for r.toSubmit > 0 {
+		n, err := r.enter(r.toSubmit, 0, ioringEnterGetEvents)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		r.toSubmit -= uint32(n)
+		if err == syscall.EBUSY || err == syscall.EAGAIN {
+			w.reapRing()
+		} else if err != nil && err != syscall.EINTR {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelRing cancels the operation of 'pcb' in flight, it's delivered on completion with
+// the bytes transferred in the meantime, or forgotten if it's dropped with its conn.
+func (w *watcher) cancelRing(pcb *aiocb, drop bool) {
+	op := w.ring.inflight[pcb.ringID]
+	op.deliver = !drop
+	op.drop = drop
+	w.submitCancel(pcb.ringID, op)
+}
+
+// submitCancel queues the cancellation of the operation 'id', it's retried on next call if it
+// fails to be queued, the operation is delivered on its completion anyway.
+func (w *watcher) submitCancel(id uint64, op *ringOp) {
+	if op.canceling {
+		return
+	}
+	sqe, err := w.ringSQE()
+	if err != nil {
+		return
+	}
+	op.canceling = true
+	sqe.opcode = ioringOpAsyncCancel
+	sqe.fd = -1
+	sqe.addr = id
+}
+
+// ringPending settles the ring of 'pcb' being delivered, it returns true if the operation
+// is still in flight, to be delivered on completion after it's canceled.
+func (w *watcher) ringPending(pcb *aiocb) bool {
+	if pcb.ringDone {
+		pcb.ringDone = false
+		w.settleRing(pcb, pcb.ringRes)
+		return false
+	}
+	if pcb.ringID != 0 {
+		w.cancelRing(pcb, false)
+		return true
+	}
+	return false
+}
+
+// settleRing applies the completion 'res' of an operation delivered out of its queue, the
+// bytes transferred are kept, and the error of the delivery is cleared if the operation
+// has completed in the meantime.
+func (w *watcher) settleRing(pcb *aiocb, res int32) {
+	if res <= 0 {
+		return
+	}
+	pcb.size += int(res)
+	if pcb.op == OpRead {
+		atomic.AddInt64(&w.stats.bytesRead, int64(res))
+	} else {
+		atomic.AddInt64(&w.stats.bytesWritten, int64(res))
+	}
+	if pcb.size >= ringFull(pcb) {
+		pcb.err = nil
+	}
+}
+
+// reapRing takes the completions of the ring, the operations completed are applied at the
+// head of their queues by synthetic events, the canceled ones are delivered. The completions
+// are taken out of the queue before any is applied, as applying them may submit entries and
+// reap again, the completions taken by such a nested call are applied by the outer one.
+func (w *watcher) reapRing() {
+	r := w.ring
+	head := atomic.LoadUint32(r.cqHead)
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		r.reaped = append(r.reaped, r.cqes[head&r.cqMask])
+	}
+	atomic.StoreUint32(r.cqHead, head)
+
+	if r.reaping {
+		return
+	}
+	r.reaping = true
+	for i := 0; i < len(r.reaped); i++ {
+		cqe := r.reaped[i]
+		op, ok := r.inflight[cqe.userData]
+		// completion of a cancellation
+		if !ok {
+			continue
+		}
+
+		delete(r.inflight, cqe.userData)
+		if r.busy[op.fd] &^= op.ev; r.busy[op.fd] == 0 {
+			delete(r.busy, op.fd)
+		}
+
+		pcb := op.pcb
+		pcb.ringID = 0
+		switch {
+		case op.drop:
+		case op.deliver:
+			w.settleRing(pcb, cqe.res)
+			w.deliver(pcb)
+		default:
+			pcb.ringRes = cqe.res
+			pcb.ringDone = true
+		}
+		w.requeue(op.fd, op.ev)
+	}
+	r.reaped = r.reaped[:0]
+	r.reaping = false
+}
+
+// wakeRing consumes the eventfd signaled on completions, and reaps them
+func (w *watcher) wakeRing() {
+	rawRead(w.ring.efd, w.ring.efdbuf)
+	w.reapRing()
+}
+
+// flushRing submits the operations queued in this round with a single syscall, and
+// reaps the completions available, like the reads on the sockets with data ready,
+// which complete on submission.
+func (w *watcher) flushRing() {
+	r := w.ring
+	// the entries failing to be submitted stay queued, and are retried next round
+	if r.toSubmit > 0 {
+		w.submitRing()
+	}
+	w.reapRing()
+
+	// the completions kept by the kernel are moved to the completion queue as it's reaped
+	for atomic.LoadUint32(r.sqFlags)&ioringSQCQOverflow != 0 {
+		if _, err := r.enter(0, 0, ioringEnterGetEvents); err != nil && err != syscall.EINTR {
+			break
+		}
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		w.reapRing()
+	}
+}
+
+// drainRing cancels the operations in flight, and waits for their completions, so the
+// kernel is done with the user buffers. The completions of the operations queued are
+// applied by ringPending, and the canceled ones are delivered to the batch.
+func (w *watcher) drainRing() {
+	r := w.ring
+	for id, op := range r.inflight {
+		w.submitCancel(id, op)
+	}
+
+	batching := w.batching
+	w.batching = true
+	for len(r.inflight) > 0 {
+		if err := w.submitRing(); err != nil {
+			break
+		}
+		if _, err := r.enter(0, 1, ioringEnterGetEvents); err != nil && err != syscall.EINTR {
+			break
+		}
+		w.reapRing()
+	}
+	w.batching = batching
+}
+
+// closeRing drains and releases the ring, on exit of the loop
+func (w *watcher) closeRing() {
+	w.drainRing()
+	w.ring.close()
+}
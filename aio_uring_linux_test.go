@@ -0,0 +1,125 @@
+// +build linux,iouring,!mips,!mipsle,!mips64,!mips64le
+
+package gaio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Backend() != "io_uring" {
+		t.Skip("io_uring is not supported by the kernel")
+	}
+
+	waitResult := func() OpResult {
+		for {
+			results, err := w.WaitIO()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) > 0 {
+				return results[0]
+			}
+		}
+	}
+
+	local, remote := tcpPair(t)
+	defer local.Close()
+	defer remote.Close()
+
+	// a read full operation is resubmitted until the buffer is filled
+	tx := make([]byte, 4096)
+	io.ReadFull(rand.Reader, tx)
+	rx := make([]byte, len(tx))
+	w.ReadFull(nil, local, rx, time.Time{})
+	go func() {
+		for i := 0; i < len(tx); i += 1024 {
+			remote.Write(tx[i : i+1024])
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if res := waitResult(); res.Error != nil || res.Size != len(tx) || !bytes.Equal(rx, tx) {
+		t.Fatal("incorrect read full", res.Error, res.Size)
+	}
+
+	w.Write(nil, local, tx)
+	if res := waitResult(); res.Error != nil || res.Size != len(tx) {
+		t.Fatal("incorrect write", res.Error, res.Size)
+	}
+	if _, err := io.ReadFull(remote, rx); err != nil || !bytes.Equal(rx, tx) {
+		t.Fatal("incorrect data written", err)
+	}
+	if stats := w.Stats(); stats.BytesRead != int64(len(tx)) || stats.BytesWritten != int64(len(tx)) || stats.Retries != 0 {
+		t.Fatalf("incorrect counters: %+v", stats)
+	}
+
+	// the read in flight is canceled on deadline, and the next one is submitted after it
+	w.ReadTimeout("timeout", local, make([]byte, 16), time.Now().Add(50*time.Millisecond))
+	w.Read("next", local, rx)
+	if res := waitResult(); res.Context != "timeout" || res.Error != ErrDeadline {
+		t.Fatal("expected ErrDeadline, got", res.Context, res.Error)
+	}
+	remote.Write([]byte("hello"))
+	if res := waitResult(); res.Context != "next" || res.Error != nil || string(rx[:res.Size]) != "hello" {
+		t.Fatal("incorrect read after cancellation", res.Context, res.Error)
+	}
+
+	// the read in flight is returned by Shutdown
+	w.Read("shutdown", local, rx)
+	time.Sleep(20 * time.Millisecond)
+	results, err := w.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Context != "shutdown" || results[0].Error != ErrWatcherClosed {
+		t.Fatal("read in flight not returned", results)
+	}
+}
+
+func TestRingFull(t *testing.T) {
+	w, err := NewWatcherOpts(Options{MaxEvents: minMaxEvents})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Backend() != "io_uring" {
+		t.Skip("io_uring is not supported by the kernel")
+	}
+
+	// more operations than the entries of the ring, submitted and completed in bursts
+	const numConns = 8 * minMaxEvents
+	var remotes []net.Conn
+	for i := 0; i < numConns; i++ {
+		local, remote := tcpPair(t)
+		defer local.Close()
+		defer remote.Close()
+		remotes = append(remotes, remote)
+		w.Read(i, local, make([]byte, 16))
+	}
+	for i, remote := range remotes {
+		remote.Write([]byte{byte(i)})
+	}
+
+	for count := 0; count < numConns; {
+		results, err := w.WaitIOTimeout(5 * time.Second)
+		if err != nil {
+			t.Fatal("completions missing", count, err)
+		}
+		for _, res := range results {
+			if res.Error != nil || res.Size != 1 || res.Buffer[0] != byte(res.Context.(int)) {
+				t.Fatal("unexpected result", res.Context, res.Error, res.Size)
+			}
+		}
+		count += len(results)
+	}
+}
@@ -0,0 +1,23 @@
+// +build linux darwin netbsd freebsd openbsd dragonfly
+// +build !linux !iouring mips mipsle mips64 mips64le
+
+package gaio
+
+// ring is the io_uring of a watcher, available on linux with the iouring build tag,
+// the watchers rely on the poller alone without it.
+type ring struct {
+	efd int
+}
+
+// openRing returns nil, the poller alone is used
+func openRing(p *poller, entries int) *ring { return nil }
+
+func (w *watcher) ringable(pcb *aiocb) bool          { return false }
+func (w *watcher) ringRead(fd int, pcb *aiocb) bool  { return false }
+func (w *watcher) ringWrite(fd int, pcb *aiocb) bool { return false }
+func (w *watcher) cancelRing(pcb *aiocb, drop bool)  {}
+func (w *watcher) ringPending(pcb *aiocb) bool       { return false }
+func (w *watcher) wakeRing()                         {}
+func (w *watcher) flushRing()                        {}
+func (w *watcher) drainRing()                        {}
+func (w *watcher) closeRing()                        {}
@@ -0,0 +1,127 @@
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conn is a net.Conn adapter backed by a Watcher, Read and Write submit the operations
+// to the watcher and block until completion, so libraries speaking the standard interfaces
+// can run on gaio while the IO of all connections is multiplexed on one watcher.
+//
+// The results of Conn are delivered to the callers of Read and Write directly, and never
+// returned by WaitIO, the watcher can be shared with async operations on other connections.
+type Conn struct {
+	w    *Watcher
+	conn net.Conn
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// NewConn creates a net.Conn adapter of 'conn' backed by watcher 'w'
+func NewConn(w *Watcher, conn net.Conn) *Conn {
+	return &Conn{w: w, conn: conn}
+}
+
+// TLSClient returns a client side TLS connection over 'conn' with the configuration 'config',
+// the records are read and written through the Conn adapter backed by watcher 'w', so the
+// handshake, which is performed lazily on the first Read or Write, or by an explicit Handshake,
+// and all the IO afterwards are multiplexed on the watcher. Closing the returned conn frees
+// 'conn' in the watcher and closes it.
+func TLSClient(w *Watcher, conn net.Conn, config *tls.Config) *tls.Conn {
+	return tls.Client(NewConn(w, conn), config)
+}
+
+// TLSServer returns a server side TLS connection over 'conn' with the configuration 'config',
+// like TLSClient, the configuration must contain at least one certificate or else set
+// GetCertificate.
+func TLSServer(w *Watcher, conn net.Conn, config *tls.Config) *tls.Conn {
+	return tls.Server(NewConn(w, conn), config)
+}
+
+// Read reads data into 'b', it blocks until some data is read, or error.
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	return c.wait(OpRead, b, deadline)
+}
+
+// Write writes all of 'b', it blocks until completion, or error.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	return c.wait(OpWrite, b, deadline)
+}
+
+// wait submits an operation with a completion channel and waits for the result
+func (c *Conn) wait(op OpType, b []byte, deadline time.Time) (n int, err error) {
+	done := make(chan OpResult, 1)
+	err = c.w.aioCreateWith(nil, op, c.conn, b, deadline, false, func(cb *aiocb) {
+		cb.notify = done
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case res := <-done:
+		return res.Size, res.Error
+	case <-c.w.die:
+		if c.w.dieErr != nil {
+			return 0, c.w.dieErr
+		}
+		return 0, ErrWatcherClosed
+	}
+}
+
+// Close releases the resources of the connection in the watcher, and closes the connection
+func (c *Conn) Close() error {
+	c.w.Free(c.conn)
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local network address
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the remote network address
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls and any currently-blocked Read call
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.w.SetDeadline(c.conn, OpRead, t)
+}
+
+// SetWriteDeadline sets the deadline for future Write calls and any currently-blocked Write call
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.w.SetDeadline(c.conn, OpWrite, t)
+}
@@ -0,0 +1,6 @@
+// +build !gaiodebug
+
+package gaio
+
+// debugHeap enables the invariant checks of the timeout heap, built with -tags gaiodebug
+const debugHeap = false
@@ -0,0 +1,176 @@
+// Package httpserve is a minimal building block to serve HTTP/1.x on top of
+// gaio, requests are read, handled and responded all in async way.
+//
+// There is no delimited-read in gaio, bytes are accumulated per connection
+// until a complete request(headers terminated by CRLFCRLF, followed by
+// Content-Length bytes of body) is available.
+package httpserve
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/xtaci/gaio"
+)
+
+const (
+	// size of the buffer for each async read
+	readBufferSize = 4096
+	// max bytes of request headers
+	maxHeaderBytes = 1 << 20
+	// max bytes of request body
+	maxBodyBytes = 8 << 20
+)
+
+var (
+	// ErrHeaderTooLarge means the request headers exceeded maxHeaderBytes
+	ErrHeaderTooLarge = errors.New("request header too large")
+	// ErrBadContentLength means the Content-Length header is malformed, repeated,
+	// or exceeds maxBodyBytes
+	ErrBadContentLength = errors.New("bad content length")
+	// ErrTransferEncoding means the request uses a transfer encoding which is not supported
+	ErrTransferEncoding = errors.New("unsupported transfer encoding")
+)
+
+var (
+	crlf           = []byte("\r\n")
+	headerEnd      = []byte("\r\n\r\n")
+	contentLength  = []byte("content-length")
+	transferEncode = []byte("transfer-encoding")
+)
+
+// Handler processes a complete raw request, and returns a raw response to be
+// written back, returning nil closes the connection.
+type Handler func(reqBytes []byte) (respBytes []byte)
+
+// session is the per connection state, it's used as the context of
+// every async operation issued by ServeConn.
+type session struct {
+	handler Handler
+	buffer  []byte // buffer for async read
+	pending []byte // bytes received but not yet handled
+}
+
+// ServeConn starts to serve HTTP requests on conn with handler, the
+// completions must be passed to Dispatch, or use Serve to drive the watcher.
+func ServeConn(w *gaio.Watcher, conn net.Conn, handler Handler) error {
+	s := &session{handler: handler, buffer: make([]byte, readBufferSize)}
+	return w.Read(s, conn, s.buffer)
+}
+
+// Dispatch handles a completion issued by ServeConn, it returns false if
+// res does not belong to ServeConn, so it can be used along with other
+// completions on the same watcher.
+func Dispatch(w *gaio.Watcher, res gaio.OpResult) bool {
+	s, ok := res.Context.(*session)
+	if !ok {
+		return false
+	}
+
+	if res.Error != nil {
+		closeConn(w, res.Conn)
+		return true
+	}
+
+	if res.Operation == gaio.OpRead {
+		s.pending = append(s.pending, res.Buffer[:res.Size]...)
+	}
+
+	s.next(w, res.Conn)
+	return true
+}
+
+// Serve waits for completions on the watcher and dispatches them until the
+// watcher is closed, completions not issued by ServeConn are ignored.
+func Serve(w *gaio.Watcher) error {
+	for {
+		results, err := w.WaitIO()
+		if err != nil {
+			return err
+		}
+
+		for _, res := range results {
+			Dispatch(w, res)
+		}
+	}
+}
+
+// next handles a pending request if it's complete, or continues reading.
+func (s *session) next(w *gaio.Watcher, conn net.Conn) {
+	n, err := requestLength(s.pending)
+	if err != nil {
+		closeConn(w, conn)
+		return
+	}
+
+	if n == 0 {
+		if err := w.Read(s, conn, s.buffer); err != nil {
+			closeConn(w, conn)
+		}
+		return
+	}
+
+	// the handler owns the request, leftover(pipelined) bytes are moved
+	req := s.pending[:n:n]
+	s.pending = append([]byte(nil), s.pending[n:]...)
+
+	resp := s.handler(req)
+	if resp == nil {
+		closeConn(w, conn)
+		return
+	}
+
+	if err := w.Write(s, conn, resp); err != nil {
+		closeConn(w, conn)
+	}
+}
+
+// requestLength returns the length of the first complete request in buf,
+// or 0 if the request is incomplete.
+func requestLength(buf []byte) (int, error) {
+	idx := bytes.Index(buf, headerEnd)
+	if idx == -1 {
+		if len(buf) > maxHeaderBytes {
+			return 0, ErrHeaderTooLarge
+		}
+		return 0, nil
+	}
+
+	bodyLen := -1
+	lines := bytes.Split(buf[:idx], crlf)
+	for _, line := range lines[1:] { // skip request line
+		colon := bytes.IndexByte(line, ':')
+		if colon == -1 {
+			continue
+		}
+		key := bytes.TrimSpace(line[:colon])
+		value := bytes.TrimSpace(line[colon+1:])
+		if bytes.EqualFold(key, contentLength) {
+			n, err := strconv.Atoi(string(value))
+			if err != nil || n < 0 || n > maxBodyBytes || bodyLen != -1 {
+				return 0, ErrBadContentLength
+			}
+			bodyLen = n
+		} else if bytes.EqualFold(key, transferEncode) {
+			return 0, ErrTransferEncoding
+		}
+	}
+
+	if bodyLen == -1 {
+		bodyLen = 0
+	}
+
+	total := idx + len(headerEnd) + bodyLen
+	if len(buf) < total {
+		return 0, nil
+	}
+	return total, nil
+}
+
+// closeConn releases the resources of conn from both watcher and system.
+func closeConn(w *gaio.Watcher, conn net.Conn) {
+	w.Free(conn)
+	conn.Close()
+}
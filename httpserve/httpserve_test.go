@@ -0,0 +1,93 @@
+package httpserve
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/xtaci/gaio"
+)
+
+func TestServeConn(t *testing.T) {
+	w, err := gaio.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	go Serve(w)
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	handler := func(req []byte) []byte {
+		body := req[bytes.Index(req, []byte("\r\n\r\n"))+4:]
+		var resp bytes.Buffer
+		resp.WriteString("HTTP/1.1 200 OK\r\nContent-Length: ")
+		resp.WriteString(strconv.Itoa(len(body)))
+		resp.WriteString("\r\n\r\n")
+		resp.Write(body)
+		return resp.Bytes()
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if err := ServeConn(w, conn, handler); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	client := &http.Client{}
+	url := "http://" + ln.Addr().String() + "/"
+	for _, body := range []string{"", "hello", "gaio"} {
+		resp, err := client.Post(url, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatalf("expected %q, got %q", body, data)
+		}
+	}
+}
+
+func TestRequestLength(t *testing.T) {
+	cases := []struct {
+		req string
+		n   int
+		err error
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n", 0, nil},
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", 27, nil},
+		{"POST / HTTP/1.1\r\ncontent-length: 3\r\n\r\nab", 0, nil},
+		{"POST / HTTP/1.1\r\ncontent-length: 3\r\n\r\nabcGET", 41, nil},
+		{"POST / HTTP/1.1\r\nContent-Length: x\r\n\r\n", 0, ErrBadContentLength},
+		{"POST / HTTP/1.1\r\nContent-Length: 9223372036854775807\r\n\r\n", 0, ErrBadContentLength},
+		{"POST / HTTP/1.1\r\nContent-Length: 8388609\r\n\r\n", 0, ErrBadContentLength},
+		{"POST / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc", 0, ErrBadContentLength},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n", 0, ErrTransferEncoding},
+	}
+
+	for _, c := range cases {
+		n, err := requestLength([]byte(c.req))
+		if n != c.n || err != c.err {
+			t.Fatalf("%q: expected (%v, %v), got (%v, %v)", c.req, c.n, c.err, n, err)
+		}
+	}
+}
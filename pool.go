@@ -0,0 +1,267 @@
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// WatcherPool is a sharded watcher for multicore scaling, it owns N watchers
+// with their own loops, every conn is assigned to a shard on its first
+// operation, and all completions are fanned in to WaitIO, or consumed per
+// shard with WaitIOShard, so the completions are processed in parallel too.
+type WatcherPool struct {
+	*watcherPool
+	// shards are closed by their finalizers once the pool is unreachable
+	shards []*Watcher
+}
+
+// poolResults are the results of a single WaitIO on a shard
+type poolResults struct {
+	r   []OpResult
+	err error
+	ack chan struct{} // signals the shard to wait for next results
+}
+
+type watcherPool struct {
+	watchers  []*watcher
+	chResults chan poolResults
+	acks      []chan struct{} // acks of the results returned by last WaitIO
+	err       error           // error of a shard to be returned by WaitIO
+
+	// the results are consumed either fanned in by WaitIO, or per shard by WaitIOShard
+	consumer  int32 // atomic
+	fanInOnce sync.Once
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewWatcherPool creates a sharded watcher with 'n' watchers, 'n' <= 0 means
+// runtime.NumCPU(), every watcher has the default internal buffer size.
+func NewWatcherPool(n int) (*WatcherPool, error) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	pool := &WatcherPool{watcherPool: &watcherPool{
+		chResults: make(chan poolResults, n),
+		die:       make(chan struct{}),
+	}}
+	for i := 0; i < n; i++ {
+		w, err := NewWatcher()
+		if err != nil {
+			for _, shard := range pool.shards {
+				shard.Close()
+			}
+			return nil, err
+		}
+		pool.shards = append(pool.shards, w)
+		pool.watchers = append(pool.watchers, w.watcher)
+	}
+
+	return pool, nil
+}
+
+// consumers of the results of a pool
+const (
+	consumerFanIn = iota + 1
+	consumerShard
+)
+
+// consumeBy sets the consumer of the results on first call, it fails if the
+// results are consumed by the other one.
+func (p *watcherPool) consumeBy(consumer int32) bool {
+	return atomic.CompareAndSwapInt32(&p.consumer, 0, consumer) || atomic.LoadInt32(&p.consumer) == consumer
+}
+
+// ListenReusePort announces on the local network address like net.Listen, with SO_REUSEPORT set
+// on the socket before bind, so the listeners of the same address can be created one per shard,
+// each accepted by Accept on its own watcher, and the kernel balances the incoming connections
+// across them. On freebsd SO_REUSEPORT_LB is set instead, while on darwin and the other BSDs the
+// port is shared but the connections may not be balanced.
+func ListenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = retryOnEINTR(func() error {
+				return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort(), 1)
+			})
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// fanIn forwards the results of a shard, the shard waits for next results only after
+// the results forwarded have been returned and acknowledged by next call to WaitIO,
+// as they are valid till then.
+func (p *watcherPool) fanIn(w *watcher) {
+	ack := make(chan struct{}, 1)
+	for {
+		r, err := w.WaitIO()
+		select {
+		case p.chResults <- poolResults{r, err, ack}:
+		case <-p.die:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-ack:
+		case <-p.die:
+			return
+		}
+	}
+}
+
+// Shard returns the watcher which 'conn' is assigned to, all operations on
+// the conn must be submitted to it.
+func (p *WatcherPool) Shard(conn net.Conn) *Watcher {
+	return p.shards[p.index(conn)]
+}
+
+// index returns the index of shard which 'conn' is assigned to, a conn is pinned
+// to a shard by hashing its pointer, which is unique during its lifetime.
+func (p *watcherPool) index(conn net.Conn) int {
+	if conn == nil || reflect.TypeOf(conn).Kind() != reflect.Ptr {
+		// the submission fails with ErrUnsupported on any shard
+		return 0
+	}
+	// fibonacci hashing, as pointers are aligned
+	h := uint64(reflect.ValueOf(conn).Pointer()) * 0x9E3779B97F4A7C15
+	return int((h >> 32) % uint64(len(p.watchers)))
+}
+
+// shard returns the watcher which 'conn' is assigned to
+func (p *watcherPool) shard(conn net.Conn) *watcher {
+	return p.watchers[p.index(conn)]
+}
+
+// NumShards returns the number of shards of the pool
+func (p *watcherPool) NumShards() int {
+	return len(p.watchers)
+}
+
+// WaitIOShard blocks until any completion on shard 'k', which can be called by a worker
+// goroutine per shard to process the completions of the shards in parallel, the conns of
+// shard 'k' are the ones Shard returns the k-th watcher for. The results are valid until next
+// call to WaitIOShard on the same shard. ErrInvalidShard is returned if there's no shard 'k',
+// and ErrMixedConsumers if the results of the pool are consumed by WaitIO.
+func (p *watcherPool) WaitIOShard(k int) (r []OpResult, err error) {
+	if k < 0 || k >= len(p.watchers) {
+		return nil, ErrInvalidShard
+	}
+	if !p.consumeBy(consumerShard) {
+		return nil, ErrMixedConsumers
+	}
+	return p.watchers[k].WaitIO()
+}
+
+// WaitIO blocks until any read/write completion on any shard, or error.
+// An internal 'buf' returned or 'r []OpResult' are safe to use BEFORE next call to WaitIO().
+// ErrMixedConsumers is returned if the results of the pool are consumed by WaitIOShard.
+func (p *watcherPool) WaitIO() (r []OpResult, err error) {
+	if !p.consumeBy(consumerFanIn) {
+		return nil, ErrMixedConsumers
+	}
+	p.fanInOnce.Do(func() {
+		for _, w := range p.watchers {
+			go p.fanIn(w)
+		}
+	})
+
+	// results returned by last call are acknowledged
+	for _, ack := range p.acks {
+		ack <- struct{}{}
+	}
+	p.acks = p.acks[:0]
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	select {
+	case res := <-p.chResults:
+		if res.err != nil {
+			p.err = res.err
+			return nil, res.err
+		}
+		r = res.r
+		p.acks = append(p.acks, res.ack)
+	case <-p.die:
+		return nil, ErrWatcherClosed
+	}
+
+	// gather the results available on other shards
+	for len(p.chResults) > 0 {
+		res := <-p.chResults
+		if res.err != nil {
+			p.err = res.err
+			break
+		}
+		r = append(r, res.r...)
+		p.acks = append(p.acks, res.ack)
+	}
+	return r, nil
+}
+
+// Close stops all shards
+func (p *watcherPool) Close() (err error) {
+	p.dieOnce.Do(func() {
+		close(p.die)
+		for _, w := range p.watchers {
+			if werr := w.Close(); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	})
+	return err
+}
+
+// Read submits an async read request on the shard of 'conn', see Watcher.Read
+func (p *watcherPool) Read(ctx interface{}, conn net.Conn, buf []byte) error {
+	return p.shard(conn).Read(ctx, conn, buf)
+}
+
+// ReadTimeout submits an async read request on the shard of 'conn', see Watcher.ReadTimeout
+func (p *watcherPool) ReadTimeout(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return p.shard(conn).ReadTimeout(ctx, conn, buf, deadline)
+}
+
+// ReadFull submits an async read request on the shard of 'conn', see Watcher.ReadFull
+func (p *watcherPool) ReadFull(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return p.shard(conn).ReadFull(ctx, conn, buf, deadline)
+}
+
+// Write submits an async write request on the shard of 'conn', see Watcher.Write
+func (p *watcherPool) Write(ctx interface{}, conn net.Conn, buf []byte) error {
+	return p.shard(conn).Write(ctx, conn, buf)
+}
+
+// WriteTimeout submits an async write request on the shard of 'conn', see Watcher.WriteTimeout
+func (p *watcherPool) WriteTimeout(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return p.shard(conn).WriteTimeout(ctx, conn, buf, deadline)
+}
+
+// Free releases the resources of 'conn' on its shard, see Watcher.Free
+func (p *watcherPool) Free(conn net.Conn) error {
+	return p.shard(conn).Free(conn)
+}
+
+// Cancel cancels all pending operations of 'conn' on its shard, see Watcher.Cancel
+func (p *watcherPool) Cancel(conn net.Conn) error {
+	return p.shard(conn).Cancel(conn)
+}
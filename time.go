@@ -1,5 +1,7 @@
 package gaio
 
+import "container/heap"
+
 // a heap for sorted timeout
 type timedHeap []*aiocb
 
@@ -21,6 +23,48 @@ func (h *timedHeap) Pop() interface{} {
 	n := len(old)
 	x := old[n-1]
 	old[n-1] = nil // avoid memory leak
+	x.idx = -1     // for safety
 	*h = old[0 : n-1]
 	return x
 }
+
+// push adds 'pcb' to the heap, it must not be in the heap
+func (h *timedHeap) push(pcb *aiocb) {
+	if debugHeap && pcb.idx != -1 {
+		panic("gaio: operation pushed to timeout heap twice")
+	}
+	heap.Push(h, pcb)
+}
+
+// remove removes 'pcb' from the heap, it must be in the heap
+func (h *timedHeap) remove(pcb *aiocb) {
+	h.check(pcb)
+	heap.Remove(h, pcb.idx)
+}
+
+// fix re-establishes the ordering after the deadline of 'pcb' has changed
+func (h *timedHeap) fix(pcb *aiocb) {
+	h.check(pcb)
+	heap.Fix(h, pcb.idx)
+}
+
+// check panics in debug builds if the index of 'pcb' doesn't point back to it, as a
+// stale index corrupts the position of another operation on removal.
+func (h timedHeap) check(pcb *aiocb) {
+	if debugHeap && (pcb.idx < 0 || pcb.idx >= len(h) || h[pcb.idx] != pcb) {
+		panic("gaio: stale index in timeout heap")
+	}
+}
+
+// valid reports whether all the operations in the heap are at their indices, and ordered
+func (h timedHeap) valid() bool {
+	for i, pcb := range h {
+		if pcb.idx != i {
+			return false
+		}
+		if i > 0 && h.Less(i, (i-1)/2) {
+			return false
+		}
+	}
+	return true
+}
@@ -7,20 +7,29 @@
 package gaio
 
 import (
-	"container/heap"
+	"bytes"
 	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
+	"log"
 	"net"
+	"os"
 	"reflect"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 var (
 	aiocbPool sync.Pool
+
+	// atomic, log the watchers finalized by gc without Close
+	leakDiagnostics int32
 )
 
 func init() {
@@ -31,52 +40,215 @@ func init() {
 
 // fdDesc contains all data structures associated to fd
 type fdDesc struct {
-	readers list.List // all read/write requests
-	writers list.List
-	ptr     uintptr // pointer to net.Conn
+	readers    list.List // all read/write requests
+	writers    list.List
+	oobReaders list.List // out-of-band reads
+	ptr        uintptr   // pointer to net.Conn
+	datagram   bool      // datagram socket
+	unix       bool      // unix domain socket, capable of passing fds
+	interest   int       // events interested in level-triggered mode
+	detached   bool      // handed over to the user by Detach, not closed on release
+	borrowed   bool      // the original fd of the conn in NoDup mode, owned by the conn
+	closeWrite bool      // write direction to be shut down once the writes are flushed
+
+	// addresses of the conn
+	laddr net.Addr
+	raddr net.Addr
+
+	// idle timeout, the conn is held for reporting OpIdle while it's set
+	idleTimeout time.Duration
+	lastActive  time.Time // last successful completion
+	idleConn    net.Conn
+
+	// byte-rate limit, a token bucket refilled at 'rate' bytes per second
+	rate       int
+	tokens     int
+	lastRefill time.Time
+	throttled  int // events deferred till the tokens refill
+}
+
+// resultQueue is the queue of completions to a consumer of WaitIO, a batch of results chained
+// by next is sent at once, the results queued are bounded by the capacity, counted in 'queued'.
+type resultQueue struct {
+	// 64-bit atomic fields go first for alignment
+	queued       int64  // atomic, results sent not yet taken
+	lastReturned uint64 // sequence of last result returned by WaitIO
+	acked        uint64 // results before this sequence are acknowledged
+
+	chResults  chan *aiocb
+	chConsumed chan struct{} // results taken by the consumer over the bound
+	leftover   *aiocb        // results received but not yet returned by WaitIOInto
+	lastSeq    uint64        // sequence of last result delivered to the queue, owned by the loop
+
+	// batch of the shard chained in a round, owned by the loop
+	batchHead, batchTail *aiocb
+	batchLen             int
+
+	// held by the consumer converting the results, and by Shutdown draining them
+	mu sync.Mutex
+}
+
+func newResultQueue(size int) *resultQueue {
+	return &resultQueue{
+		chResults:  make(chan *aiocb, size),
+		chConsumed: make(chan struct{}, 1),
+	}
 }
 
 // watcher will monitor events and process async-io request(s),
 type watcher struct {
+	// 64-bit atomic fields go first for alignment
+	stats       counters
+	outstanding int64  // bytes of user buffers in-flight
+	submitSeq   uint64 // sequence of last operation submitted
+	memLimit    int64  // bound of bytes in-flight, 0 means unlimited
+
 	// poll fd
 	pfd *poller
 
 	// netpoll events
 	chEventNotify chan pollerEvents
 
+	// synthetic events for operations yielded before the socket was drained
+	chRequeue          chan struct{}
+	requeued           pollerEvents
+	requeuedProcessing pollerEvents
+
 	// events from user
 	chPending chan *aiocb
 
-	// IO-completion events to user
-	chResults chan *aiocb
+	// requests submitted from the callbacks running on the loop, handled
+	// before next event, as sending to chPending there could deadlock.
+	reentrant []*aiocb
+	callbacks int32  // atomic, nesting of the user callbacks running on the loop
+	loopGoid  uint64 // id of the loop goroutine, set before it runs any callback
+
+	// IO-completion events to user, one queue per result shard, the results
+	// are routed to the shard of their fd.
+	queues []*resultQueue
+
+	// persistent reads with user buffer are parked after delivery,
+	// until the result has been acknowledged by next call to WaitIO
+	deliverSeq   uint64 // sequence of last delivered result
+	parkedIdents []int  // idents with parked persistent read
+	numParked    int32  // atomic, len(parkedIdents)
+	chUnpark     chan struct{}
+	freeOnEOF    int32 // atomic, free the conn when persistent read hits EOF
+
+	// atomic, report bytes remaining in the socket after read
+	reportPending int32
+
+	// atomic, max number of connections being watched, 0 means unlimited
+	maxConns int32
+
+	// atomic, coalesce queued writes into a single writev
+	coalesce int32
+
+	// atomic, max bytes read per connection per wakeup, 0 means unlimited
+	readBudget int32
+
+	// priority operations have been submitted, the events are prioritized since
+	usePriority bool
+
+	// poller errors reported to the callback set in Options, the socket errors
+	// consumed by SO_ERROR are kept for the next read or write on the fd.
+	onPollerError func(fd int, err error)
+	sockErrs      map[int]error
+
+	// backpressure reported to the callback set in Options, best-effort
+	onBackpressure func(waiting int)
+	chBackpressure chan int
+
+	// the results are delivered to the callback set in Options instead of WaitIO
+	onComplete  func(res OpResult)
+	dispatchers sync.WaitGroup
+
+	// io_uring for the plain reads and writes, nil if unavailable
+	ring *ring
+
+	// adaptive completion notification, completions are delivered immediately
+	// for low latency, or coalesced till the end of a loop round for high
+	// throughput, according to the completion rate in recent window.
+	batching    bool
+	batched     []*aiocb
+	windowStart time.Time
+	windowCount int
+
+	// global bound of bytes pinned by in-flight user buffers
+	memBlock    int32 // atomic, block the submissions over limit instead of failing
+	memMutex    sync.Mutex
+	memReleased chan struct{} // closed to wake up blocked submissions
+
+	// buffers of in-flight operations by conn, for debugging overlapping buffers
+	checkBuffers int32 // atomic
+	bufMutex     sync.Mutex
+	bufRanges    map[uintptr][]*bufRange
+
+	// descriptors with queues changed in level-triggered mode
+	dirty []int
+
+	// iovecs for vector write
+	iovecs []syscall.Iovec
 
 	// internal buffer for reading
-	swapSize         int // swap buffer capacity, triple buffer
-	swapBufferFront  []byte
-	swapBufferMiddle []byte
-	swapBufferBack   []byte
-	bufferOffset     int   // bufferOffset for current using one
-	shouldSwap       int32 // atomic mark for swap
+	swapSize     int        // swap buffer capacity
+	swapBuffers  [][]byte   // ring of swap buffers
+	swapIdx      int        // index of the swap buffer in use
+	swapSeq      []uint64   // delivery sequence of the last result in each swap buffer
+	bufferOffset int        // bufferOffset for current using one
+	swapResized  [][]byte   // resized swap buffers, installed once the results in the old ones are acknowledged
+	swapReads    []swapRead // reads delivered in swap buffers not acknowledged, in decreasing size
+	shouldSwap   int32      // atomic mark for swap
+
+	// buffer pool hooks set by SetBufferPool
+	getBuffer func(size int) []byte
+	putBuffer func(buf []byte)
 
 	// loop cpu affinity
 	chCPUID chan int32
 
+	// functions to run on the loop goroutine
+	chCommand chan func()
+
 	// loop related data structure
 	descs      map[int]*fdDesc // all descriptors
 	connIdents map[uintptr]int // we must not hold net.Conn as key, for GC purpose
+	// conns freed and closed, the operations submitted after Free fail with ErrConnClosed
+	// instead of watching them again, till the conns are gc-ed and the pointers reusable.
+	// The error is the cause of the conns released on hangup, nil for ErrConnClosed.
+	freed map[uintptr]error
+	// operate on the original fds of the conns instead of the duplicated ones, set by Options
+	noDup bool
 	// for timeout operations which
 	// aiocb has non-zero deadline, either exists
 	// in timeouts & queue at any time
 	// or in neither of them.
 	timeouts timedHeap
 	timer    *time.Timer
+	// the time the timer is armed for, zero if it has fired
+	timerDeadline time.Time
+	// atomic, deadlines are rounded up to the granularity in nanoseconds, to
+	// coalesce the wakeups of clustered deadlines, 0 means exact deadlines.
+	timerGranularity int64
+	// descriptors with idle timeout
+	idleIdents map[int]struct{}
+	idleTimer  *time.Timer
+	// rate-limited descriptors waiting for the tokens to refill
+	throttledIdents map[int]struct{}
+	rateTimer       *time.Timer
+	// quota in bytes of the IO being tried on a rate-limited descriptor
+	limited bool
+	quota   int
 	// for garbage collector
-	gc       []net.Conn
+	gc       []uintptr // pointers to the conns
 	gcMutex  sync.Mutex
 	gcNotify chan struct{}
 
 	die     chan struct{}
+	dieErr  error // terminal error, set before die is closed
+	closing int32 // atomic, set on Shutdown to reject new requests
 	dieOnce sync.Once
+	runOnce sync.Once
 }
 
 // NewWatcher creates a management object for monitoring file descriptors
@@ -86,47 +258,322 @@ func NewWatcher() (*Watcher, error) {
 }
 
 // NewWatcherSize creates a management object for monitoring file descriptors.
-// 'bufsize' sets the internal swap buffer size for Read() with nil, 2 slices with'bufsize'
+// 'bufsize' sets the internal swap buffer size for Read() with nil, 3 slices with'bufsize'
 // will be allocated for performance.
 func NewWatcherSize(bufsize int) (*Watcher, error) {
+	w, err := NewWatcherManual(bufsize)
+	if err != nil {
+		return nil, err
+	}
+
+	go w.watcher.Run()
+	return w, nil
+}
+
+// NewWatcherOpts creates a management object for monitoring file descriptors with options.
+func NewWatcherOpts(opts Options) (*Watcher, error) {
+	bufsize := opts.BufferSize
+	if bufsize <= 0 {
+		bufsize = defaultInternalBufferSize
+	}
+
+	numBuffers := opts.NumBuffers
+	if numBuffers == 0 {
+		numBuffers = defaultNumBuffers
+	} else if numBuffers < minNumBuffers {
+		return nil, ErrBufferSize
+	}
+
+	maxEvents := opts.MaxEvents
+	if maxEvents == 0 {
+		maxEvents = defaultMaxEvents
+	} else if maxEvents < minMaxEvents {
+		return nil, ErrMaxEvents
+	}
+
+	w, err := newWatcherManual(bufsize, numBuffers, maxEvents)
+	if err != nil {
+		return nil, err
+	}
+	w.pfd.levelTriggered = opts.LevelTriggered
+	w.noDup = opts.NoDup
+	for i := 1; i < opts.ResultShards; i++ {
+		w.queues = append(w.queues, newResultQueue(maxEvents))
+	}
+	if opts.OnPollerError != nil {
+		w.onPollerError = opts.OnPollerError
+		w.sockErrs = make(map[int]error)
+	}
+	if opts.OnBackpressure != nil {
+		w.onBackpressure = opts.OnBackpressure
+		w.chBackpressure = make(chan int, 1)
+		go w.reportBackpressure()
+	}
+	if opts.OnComplete != nil {
+		w.onComplete = opts.OnComplete
+		for _, q := range w.queues {
+			w.dispatchers.Add(1)
+			go w.dispatchResults(q, opts.Dispatcher)
+		}
+	}
+
+	go w.watcher.Run()
+	return w, nil
+}
+
+// NewWatcherMemLimit creates a management object like NewWatcherSize, and the total
+// bytes of user buffers in-flight(submitted but not delivered) is bounded by
+// 'maxOutstandingBytes'. By default, submissions over limit fail with ErrMemLimit,
+// or they block until enough in-flight operations complete with SetMemLimitBlocking(true).
+func NewWatcherMemLimit(bufsize int, maxOutstandingBytes int) (*Watcher, error) {
+	w, err := NewWatcherManual(bufsize)
+	if err != nil {
+		return nil, err
+	}
+	w.memLimit = int64(maxOutstandingBytes)
+
+	go w.watcher.Run()
+	return w, nil
+}
+
+// NewWatcherManual creates a management object like NewWatcherSize, but the
+// event loop is not started, the caller must invoke Run() on a goroutine of
+// its choosing(or synchronously) to start processing requests.
+func NewWatcherManual(bufsize int) (*Watcher, error) {
+	return newWatcherManual(bufsize, defaultNumBuffers, defaultMaxEvents)
+}
+
+// newWatcherManual creates a watcher with 'numBuffers' swap buffers of 'bufsize',
+// and queues of 'maxEvents'
+func newWatcherManual(bufsize int, numBuffers int, maxEvents int) (*Watcher, error) {
 	w := new(watcher)
-	pfd, err := openPoll()
+	pfd, err := openPoll(maxEvents)
 	if err != nil {
 		return nil, err
 	}
 	w.pfd = pfd
+	w.ring = openRing(pfd, maxEvents)
 
 	// loop related chan
 	w.chCPUID = make(chan int32)
+	w.chCommand = make(chan func())
 	w.chEventNotify = make(chan pollerEvents)
+	w.chRequeue = make(chan struct{}, 1)
 	w.chPending = make(chan *aiocb, maxEvents)
-	w.chResults = make(chan *aiocb, maxEvents)
+	w.queues = []*resultQueue{newResultQueue(maxEvents)}
+	w.chUnpark = make(chan struct{}, 1)
 	w.die = make(chan struct{})
 
 	// swapBuffer for shared reading
-	w.swapSize = bufsize
-	w.swapBufferFront = make([]byte, bufsize)
-	w.swapBufferMiddle = make([]byte, bufsize)
-	w.swapBufferBack = make([]byte, bufsize)
+	w.allocSwapBuffers(bufsize, numBuffers)
 
 	// init loop related data structures
 	w.descs = make(map[int]*fdDesc)
 	w.connIdents = make(map[uintptr]int)
+	w.freed = make(map[uintptr]error)
 	w.gcNotify = make(chan struct{}, 1)
 	w.timer = time.NewTimer(0)
-
-	go w.pfd.Wait(w.chEventNotify)
-	go w.loop()
+	w.idleIdents = make(map[int]struct{})
+	w.idleTimer = time.NewTimer(0)
+	w.throttledIdents = make(map[int]struct{})
+	w.rateTimer = time.NewTimer(0)
 
 	// watcher finalizer for system resources
 	wrapper := &Watcher{watcher: w}
 	runtime.SetFinalizer(wrapper, func(wrapper *Watcher) {
+		wrapper.reportLeak()
 		wrapper.Close()
 	})
 
 	return wrapper, nil
 }
 
+// SetLeakDiagnostics sets whether to log the watchers finalized by gc without Close or
+// Shutdown, along with the connections and operations abandoned in them, for finding the
+// watchers leaked in long-running services. It's process-wide, and disabled by default.
+func SetLeakDiagnostics(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&leakDiagnostics, 1)
+	} else {
+		atomic.StoreInt32(&leakDiagnostics, 0)
+	}
+}
+
+// queuedResults returns the number of results sent but not yet taken by the consumers
+func (w *watcher) queuedResults() (n int64) {
+	for _, q := range w.queues {
+		n += atomic.LoadInt64(&q.queued)
+	}
+	return n
+}
+
+// reportLeak logs the resources abandoned in a watcher being finalized, if it's not closed
+func (w *watcher) reportLeak() {
+	if atomic.LoadInt32(&leakDiagnostics) == 0 {
+		return
+	}
+	select {
+	case <-w.die:
+		return
+	default:
+	}
+	log.Printf("gaio: watcher finalized without Close, abandoned %d connections, %d pending operations, %d results not returned",
+		atomic.LoadInt32(&w.stats.conns), atomic.LoadInt64(&w.stats.pending), w.queuedResults())
+}
+
+// Run starts the event loop of this watcher on the calling goroutine, and
+// blocks until the watcher is closed. The poller still waits for events on
+// its own goroutine. Only the first call to Run takes effect.
+func (w *watcher) Run() {
+	var first bool
+	w.runOnce.Do(func() {
+		first = true
+		go func() {
+			if err := w.pfd.Wait(w.chEventNotify); err != nil {
+				w.shutdown(&wrappedError{ErrPollerFailed, err})
+			}
+		}()
+	})
+
+	// the loop runs outside of the once, so it can be closed from a callback
+	if first {
+		w.loop()
+	}
+}
+
+// rawConn returns the syscall.RawConn of 'conn' to access the file descriptor
+func rawConn(conn net.Conn) (syscall.RawConn, error) {
+	sc, ok := conn.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		return nil, ErrNoRawConn
+	}
+	return sc.SyscallConn()
+}
+
+// errTLSConn is the cause of ErrUnsupportedConn for a *tls.Conn
+var errTLSConn = errors.New("*tls.Conn is not a socket, submit the raw conn underneath, or use TLSClient/TLSServer for TLS over the watcher")
+
+// checkConn returns ErrUnsupportedConn if 'conn' is not backed by a file descriptor, so it's
+// rejected on submission rather than failing to be duplicated on the loop.
+func checkConn(conn net.Conn) error {
+	if _, ok := conn.(syscall.Conn); ok {
+		return nil
+	}
+	if _, ok := conn.(*tls.Conn); ok {
+		return &wrappedError{ErrUnsupportedConn, errTLSConn}
+	}
+	return ErrUnsupportedConn
+}
+
+// borrowfd returns the file descriptor of 'conn' without duplicating it, it stays
+// owned by the conn, and is valid only until the conn is closed.
+func borrowfd(conn net.Conn) (fd int, err error) {
+	rc, err := rawConn(conn)
+	if err != nil {
+		return -1, ErrUnsupported
+	}
+
+	if ec := rc.Control(func(s uintptr) { fd = int(s) }); ec != nil {
+		return -1, ec
+	}
+	return fd, nil
+}
+
+// Validate checks whether 'conn' can be delegated to a watcher, without duplicating or
+// registering its file descriptor. It returns ErrNoRawConn if 'conn' is not backed by a
+// file descriptor, the error from the system if the file descriptor is closed or invalid,
+// or ErrSocketType if the type of socket is not supported.
+func Validate(conn net.Conn) error {
+	rc, err := rawConn(conn)
+	if err != nil {
+		return err
+	}
+
+	var verr error
+	cerr := rc.Control(func(fd uintptr) {
+		if _, _, e := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFD, 0); e != 0 {
+			verr = e
+			return
+		}
+
+		sotype, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if err != nil {
+			verr = err
+			return
+		}
+
+		if sotype != syscall.SOCK_STREAM && sotype != syscall.SOCK_DGRAM {
+			verr = ErrSocketType
+		}
+	})
+
+	if cerr != nil {
+		return cerr
+	}
+	return verr
+}
+
+// Backend returns the name of the poller of the watcher, "epoll" on linux and "kqueue" on
+// the BSDs and darwin, or "io_uring" if the plain reads and writes go through io_uring,
+// with the iouring build tag on linux 5.6 or later.
+func (w *watcher) Backend() string {
+	if w.ring != nil {
+		return "io_uring"
+	}
+	return backend
+}
+
+// Capabilities reports the optional operations supported by the watcher on the current
+// platform, for feature detection at runtime instead of build tags.
+func (w *watcher) Capabilities() Capabilities {
+	return capabilities()
+}
+
+// Stats returns the statistics of this watcher
+func (w *watcher) Stats() Stats {
+	return Stats{
+		Completions:  atomic.LoadInt64(&w.stats.completions),
+		BytesRead:    atomic.LoadInt64(&w.stats.bytesRead),
+		BytesWritten: atomic.LoadInt64(&w.stats.bytesWritten),
+		Syscalls:     atomic.LoadInt64(&w.stats.syscalls),
+		Reads:        atomic.LoadInt64(&w.stats.reads),
+		Writes:       atomic.LoadInt64(&w.stats.writes),
+		Timeouts:     atomic.LoadInt64(&w.stats.timeouts),
+		Retries:      atomic.LoadInt64(&w.stats.retries),
+		TimerResets:  atomic.LoadInt64(&w.stats.timerResets),
+		Backpressure: atomic.LoadInt64(&w.stats.backpressure),
+		Conns:        int(atomic.LoadInt32(&w.stats.conns)),
+		Pending:      int(atomic.LoadInt64(&w.stats.pending)),
+		Batching:     atomic.LoadInt32(&w.stats.batching) == 1,
+	}
+}
+
+// StatsAndReset returns the statistics of this watcher like Stats, and zeroes
+// the counters(Completions, BytesRead, BytesWritten, Syscalls, Reads, Writes,
+// Timeouts, Retries, TimerResets, Backpressure) at the same time,
+// for computing the rates by interval, gauges are not reset.
+// Every counter is swapped atomically, so no updates are lost between calls,
+// but the counters are not a consistent snapshot with each other.
+func (w *watcher) StatsAndReset() Stats {
+	return Stats{
+		Completions:  atomic.SwapInt64(&w.stats.completions, 0),
+		BytesRead:    atomic.SwapInt64(&w.stats.bytesRead, 0),
+		BytesWritten: atomic.SwapInt64(&w.stats.bytesWritten, 0),
+		Syscalls:     atomic.SwapInt64(&w.stats.syscalls, 0),
+		Reads:        atomic.SwapInt64(&w.stats.reads, 0),
+		Writes:       atomic.SwapInt64(&w.stats.writes, 0),
+		Timeouts:     atomic.SwapInt64(&w.stats.timeouts, 0),
+		Retries:      atomic.SwapInt64(&w.stats.retries, 0),
+		TimerResets:  atomic.SwapInt64(&w.stats.timerResets, 0),
+		Backpressure: atomic.SwapInt64(&w.stats.backpressure, 0),
+		Conns:        int(atomic.LoadInt32(&w.stats.conns)),
+		Pending:      int(atomic.LoadInt64(&w.stats.pending)),
+		Batching:     atomic.LoadInt32(&w.stats.batching) == 1,
+	}
+}
+
 // Set Poller Affinity for Epoll/Kqueue
 func (w *watcher) SetPollerAffinity(cpuid int) (err error) {
 	if cpuid >= runtime.NumCPU() {
@@ -156,240 +603,3628 @@ func (w *watcher) SetLoopAffinity(cpuid int) (err error) {
 
 // Close stops monitoring on events for all connections
 func (w *watcher) Close() (err error) {
+	return w.shutdown(nil)
+}
+
+// Shutdown stops the watcher cooperatively, new requests are rejected with ErrWatcherClosed,
+// and all the requests not completed are removed with ErrWatcherClosed, they're returned
+// along with the completed results not yet returned by WaitIO(), so the buffers can be
+// released deterministically. Close is the hard-stop variant. With Options.OnComplete, the
+// results taken by the callbacks are dispatched before Shutdown returns, so it must not be
+// called from OnComplete without a Dispatcher.
+func (w *watcher) Shutdown() (r []OpResult, err error) {
+	atomic.StoreInt32(&w.closing, 1)
+
+	var completed, removed []OpResult
+	remove := func(pcb *aiocb, ident int) {
+		if pcb.idx != -1 {
+			w.timeouts.remove(pcb)
+		}
+		if w.ring != nil {
+			w.ringPending(pcb)
+		}
+		w.releaseMem(pcb)
+		atomic.AddInt64(&w.stats.pending, -1)
+		pcb.err = ErrWatcherClosed
+		pcb.fd = ident
+		removed = append(removed, pcb.result())
+		aiocbPool.Put(pcb)
+	}
+
+	var dropPending func(pcb *aiocb)
+	dropPending = func(pcb *aiocb) {
+		switch pcb.op {
+		case OpRead, OpWrite, OpReadOOB, OpWriteOOB, OpSplice, OpAccept, OpFlush, OpProbe, OpConnect:
+			if pcb.op == OpSplice {
+				pcb.closePipe()
+			}
+			ident, ok := w.connIdents[pcb.ptr]
+			if !ok {
+				ident = -1
+			}
+			remove(pcb, ident)
+		case opBatch:
+			for _, cb := range pcb.batch {
+				dropPending(cb)
+			}
+			aiocbPool.Put(pcb)
+		case opCancelContext, opCancelOp:
+			aiocbPool.Put(pcb)
+		default:
+			atomic.AddInt64(&w.stats.pending, -1)
+			aiocbPool.Put(pcb)
+		}
+	}
+
+	err = w.runInLoop(func() {
+		// the kernel is done with the buffers of io_uring
+		if w.ring != nil {
+			w.drainRing()
+		}
+
+		// completions coalesced but not delivered
+		for i, pcb := range w.batched {
+			completed = append(completed, pcb.result())
+			aiocbPool.Put(pcb)
+			w.batched[i] = nil
+		}
+		w.batched = w.batched[:0]
+
+		// requests queued
+		for ident, desc := range w.descs {
+			for _, l := range []*list.List{&desc.readers, &desc.writers, &desc.oobReaders} {
+				for elem := l.Front(); elem != nil; elem = l.Front() {
+					l.Remove(elem)
+					remove(elem.Value.(*aiocb), ident)
+				}
+			}
+		}
+
+		// requests submitted but not processed by the loop
+		for len(w.chPending) > 0 {
+			dropPending(<-w.chPending)
+		}
+		for _, pcb := range w.takeReentrant() {
+			dropPending(pcb)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.Close()
+
+	// the callbacks of OnComplete stop taking results once the watcher is closed
+	w.dispatchers.Wait()
+
+	// completed results not yet returned by WaitIO, the consumers converting
+	// results are waited for
+	for _, q := range w.queues {
+		q.mu.Lock()
+		for pcb := q.leftover; pcb != nil || len(q.chResults) > 0; {
+			if pcb == nil {
+				pcb = <-q.chResults
+			}
+			r = append(r, pcb.result())
+			next := pcb.next
+			pcb.next = nil
+			aiocbPool.Put(pcb)
+			pcb = next
+		}
+		q.leftover = nil
+		q.mu.Unlock()
+	}
+	r = append(r, completed...)
+	return append(r, removed...), nil
+}
+
+// shutdown stops the watcher, 'cause' is the terminal error reported to WaitIO,
+// nil means closed by user.
+func (w *watcher) shutdown(cause error) (err error) {
 	w.dieOnce.Do(func() {
+		w.dieErr = cause
 		close(w.die)
 		err = w.pfd.Close()
+		// a watcher which has never been Run still has to release its poller
+		w.runOnce.Do(func() {
+			w.pfd.Wait(w.chEventNotify)
+		})
 	})
 	return err
 }
 
 // WaitIO blocks until any read/write completion, or error.
+// A fatal error of the poller shuts the watcher down, and is reported as ErrPollerFailed.
 // An internal 'buf' returned or 'r []OpResult' are safe to use BEFORE next call to WaitIO().
+// With result shards, it's the consumer of shard 0, like WaitIOShard(0).
+// ErrCallbackMode is returned if the results are delivered to Options.OnComplete.
 func (w *watcher) WaitIO() (r []OpResult, err error) {
-	for {
-		select {
-		case pcb := <-w.chResults:
-			r = append(r, OpResult{Operation: pcb.op, Conn: pcb.conn, IsSwapBuffer: pcb.useSwap, Buffer: pcb.buffer, Size: pcb.size, Error: pcb.err, Context: pcb.ctx})
-			aiocbPool.Put(pcb)
-			for len(w.chResults) > 0 {
-				pcb := <-w.chResults
-				r = append(r, OpResult{Operation: pcb.op, Conn: pcb.conn, IsSwapBuffer: pcb.useSwap, Buffer: pcb.buffer, Size: pcb.size, Error: pcb.err, Context: pcb.ctx})
-				aiocbPool.Put(pcb)
-			}
-			atomic.StoreInt32(&w.shouldSwap, 1)
-
-			return r, nil
-		case <-w.die:
-			return nil, ErrWatcherClosed
-		}
+	if w.onComplete != nil {
+		return nil, ErrCallbackMode
 	}
+	q := w.queues[0]
+	w.acknowledge(q)
+	return w.waitResults(q, nil)
 }
 
-// Read submits an async read request on 'fd' with context 'ctx', using buffer 'buf'.
-// 'buf' can be set to nil to use internal buffer.
-// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
-func (w *watcher) Read(ctx interface{}, conn net.Conn, buf []byte) error {
-	return w.aioCreate(ctx, OpRead, conn, buf, zeroTime, false)
-}
-
-// ReadTimeout submits an async read request on 'fd' with context 'ctx', using buffer 'buf', and
-// expects to read some bytes into the buffer before 'deadline'.
-// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
-func (w *watcher) ReadTimeout(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
-	return w.aioCreate(ctx, OpRead, conn, buf, deadline, false)
+// WaitIOShard is like WaitIO, but returns the completions of result shard 'k' only, with
+// Options.ResultShards set to 'n', the results are partitioned by the fd of their conns
+// modulo 'n', so every shard can be consumed by a worker goroutine of its own, the results
+// of a conn are in order on its shard. The internal swap buffers returned are safe to use
+// before next call to WaitIOShard on the same shard. ErrInvalidShard is returned if there's
+// no shard 'k'.
+func (w *watcher) WaitIOShard(k int) (r []OpResult, err error) {
+	if k < 0 || k >= len(w.queues) {
+		return nil, ErrInvalidShard
+	}
+	if w.onComplete != nil {
+		return nil, ErrCallbackMode
+	}
+	q := w.queues[k]
+	w.acknowledge(q)
+	return w.waitResults(q, nil)
 }
 
-// ReadFull submits an async read request on 'fd' with context 'ctx', using buffer 'buf', and
-// expects to fill the buffer before 'deadline'.
-// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
-// 'buf' can't be nil in ReadFull.
-func (w *watcher) ReadFull(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
-	if len(buf) == 0 {
-		return ErrEmptyBuffer
+// WaitIOTimeout is like WaitIO, but returns ErrWaitTimeout with no results if
+// no completion arrives within 'd'.
+func (w *watcher) WaitIOTimeout(d time.Duration) (r []OpResult, err error) {
+	if w.onComplete != nil {
+		return nil, ErrCallbackMode
 	}
-	return w.aioCreate(ctx, OpRead, conn, buf, deadline, true)
-}
+	q := w.queues[0]
+	w.acknowledge(q)
 
-// Write submits an async write request on 'fd' with context 'ctx', using buffer 'buf'.
-// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
-func (w *watcher) Write(ctx interface{}, conn net.Conn, buf []byte) error {
-	if len(buf) == 0 {
-		return ErrEmptyBuffer
+	// results available are returned without arming a timer
+	if q.leftover != nil {
+		return w.collectResults(q, nil), nil
+	}
+	select {
+	case pcb := <-q.chResults:
+		return w.collectResults(q, pcb), nil
+	default:
 	}
-	return w.aioCreate(ctx, OpWrite, conn, buf, zeroTime, false)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	return w.waitResults(q, timer.C)
 }
 
-// WriteTimeout submits an async write request on 'fd' with context 'ctx', using buffer 'buf', and
-// expects to complete writing the buffer before 'deadline', 'buf' can be set to nil to use internal buffer.
-// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
-func (w *watcher) WriteTimeout(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
-	if len(buf) == 0 {
-		return ErrEmptyBuffer
+// WaitIOInto is like WaitIO, but copies the results into 'dst' instead of returning an internal
+// slice, and returns the number of results copied, the results beyond the length of 'dst' are
+// left for next call. 'dst' is owned by the caller, while the buffers of the results follow the
+// rules of WaitIO, the internal swap buffers are valid before next call to WaitIO or WaitIOInto.
+func (w *watcher) WaitIOInto(dst []OpResult) (n int, err error) {
+	if len(dst) == 0 {
+		return 0, ErrEmptyBuffer
 	}
-	return w.aioCreate(ctx, OpWrite, conn, buf, deadline, false)
-}
+	if w.onComplete != nil {
+		return 0, ErrCallbackMode
+	}
+	q := w.queues[0]
+	w.acknowledge(q)
 
-// Free let the watcher to release resources related to this conn immediately,
-// like socket file descriptors.
-func (w *watcher) Free(conn net.Conn) error {
-	return w.aioCreate(nil, opDelete, conn, nil, zeroTime, false)
-}
+	q.mu.Lock()
+	if q.leftover != nil {
+		n = w.copyResults(q, nil, dst)
+		q.mu.Unlock()
+		return n, nil
+	}
+	q.mu.Unlock()
 
-// core async-io creation
-func (w *watcher) aioCreate(ctx interface{}, op OpType, conn net.Conn, buf []byte, deadline time.Time, readfull bool) error {
 	select {
+	case pcb := <-q.chResults:
+		q.mu.Lock()
+		n = w.copyResults(q, pcb, dst)
+		q.mu.Unlock()
+		return n, nil
 	case <-w.die:
-		return ErrWatcherClosed
-	default:
-		var ptr uintptr
-		if conn != nil && reflect.TypeOf(conn).Kind() == reflect.Ptr {
-			ptr = reflect.ValueOf(conn).Pointer()
-		} else {
-			return ErrUnsupported
+		if w.dieErr != nil {
+			return 0, w.dieErr
 		}
+		return 0, ErrWatcherClosed
+	}
+}
 
-		cb := aiocbPool.Get().(*aiocb)
-		*cb = aiocb{op: op, ptr: ptr, ctx: ctx, conn: conn, buffer: buf, deadline: deadline, readFull: readfull, idx: -1}
+// copyResults converts the leftover, the batch 'pcb' and the batches available into 'dst',
+// at most len(dst), the results left are kept for next call.
+func (w *watcher) copyResults(q *resultQueue, pcb *aiocb, dst []OpResult) (n int) {
+	head := q.leftover
+	if head == nil {
+		head = pcb
+	} else if pcb != nil {
+		q.leftover = nil
+		tail := head
+		for tail.next != nil {
+			tail = tail.next
+		}
+		tail.next = pcb
+	}
 
-		w.chPending <- cb
-		return nil
+	var seq uint64
+	for n < len(dst) {
+		if head == nil {
+			if len(q.chResults) == 0 {
+				break
+			}
+			head = <-q.chResults
+		}
+		dst[n] = head.result()
+		n++
+		seq = head.seq
+		next := head.next
+		head.next = nil
+		aiocbPool.Put(head)
+		head = next
 	}
+	q.leftover = head
+	w.consumed(q, n)
+	atomic.StoreUint64(&q.lastReturned, seq)
+	atomic.StoreInt32(&w.shouldSwap, 1)
+	return n
 }
 
-// tryRead will try to read data on aiocb and notify
-func (w *watcher) tryRead(fd int, pcb *aiocb) bool {
-	buf := pcb.buffer
+// consumed releases 'n' results taken by the consumer from the bound, the loop
+// blocked on the bound is notified.
+func (w *watcher) consumed(q *resultQueue, n int) {
+	if atomic.AddInt64(&q.queued, -int64(n))+int64(n) >= int64(cap(q.chResults)) {
+		select {
+		case q.chConsumed <- struct{}{}:
+		default:
+		}
+	}
+}
 
-	useSwap := false
-	backBuffer := false
+// Recycle returns the results 'r' returned by last call to WaitIO() to the watcher once they
+// have been consumed, the internal swap buffers and the user buffers of persistent reads
+// are reusable immediately, rather than on next call to WaitIO(). 'r' must not be used
+// after Recycle. It's optional, WaitIO() recycles the results of last call anyway.
+// The results returned by WaitIOShard are recycled on the shard they come from, an empty 'r'
+// names no shard, so nothing is recycled.
+func (w *watcher) Recycle(r []OpResult) {
+	if len(r) == 0 {
+		return
+	}
 
-	if buf == nil { // internal or backBuffer
-		if atomic.CompareAndSwapInt32(&w.shouldSwap, 1, 0) {
-			w.swapBufferFront, w.swapBufferMiddle, w.swapBufferBack = w.swapBufferMiddle, w.swapBufferBack, w.swapBufferFront
-			w.bufferOffset = 0
+	for k := range r {
+		if r[k].IsSwapBuffer {
+			r[k].Buffer = nil
 		}
+	}
+	w.acknowledge(w.queueOf(r[0].Fd))
+}
 
-		buf = w.swapBufferFront[w.bufferOffset:]
-		if len(buf) > 0 {
-			useSwap = true
-		} else {
-			backBuffer = true
-			buf = pcb.backBuffer[:]
+// acknowledge marks the results returned by last call to WaitIO on 'q' as acknowledged
+func (w *watcher) acknowledge(q *resultQueue) {
+	atomic.StoreUint64(&q.acked, atomic.LoadUint64(&q.lastReturned))
+	if atomic.LoadInt32(&w.numParked) > 0 {
+		select {
+		case w.chUnpark <- struct{}{}:
+		default:
 		}
 	}
+}
 
-	for {
-		nr, er := rawRead(fd, buf[pcb.size:])
-		if er == syscall.EAGAIN {
-			return false
-		}
+// waitResults blocks until any results on 'q', or error, a nil 'timeout' never expires.
+func (w *watcher) waitResults(q *resultQueue, timeout <-chan time.Time) (r []OpResult, err error) {
+	q.mu.Lock()
+	if q.leftover != nil {
+		r = w.collectResults(q, nil)
+		q.mu.Unlock()
+		return r, nil
+	}
+	q.mu.Unlock()
+
+	select {
+	case pcb := <-q.chResults:
+		q.mu.Lock()
+		r = w.collectResults(q, pcb)
+		q.mu.Unlock()
+		return r, nil
+	case <-timeout:
+		return nil, ErrWaitTimeout
+	case <-w.die:
+		if w.dieErr != nil {
+			return nil, w.dieErr
+		}
+		return nil, ErrWatcherClosed
+	}
+}
+
+// dispatchResults passes the results of 'q' to the OnComplete callback until the watcher is
+// closed, the results are acknowledged after the callbacks of the batch are dispatched, so the
+// swap buffers are copied if the callbacks are run later by 'dispatcher'.
+func (w *watcher) dispatchResults(q *resultQueue, dispatcher func(f func())) {
+	defer w.dispatchers.Done()
+	for {
+		w.acknowledge(q)
+		results, err := w.waitResults(q, nil)
+		if err != nil {
+			return
+		}
+
+		for _, res := range results {
+			if dispatcher == nil {
+				w.onComplete(res)
+				continue
+			}
+
+			if res.IsSwapBuffer {
+				res.Buffer = res.Copy()
+				res.IsSwapBuffer = false
+			}
+			res := res
+			dispatcher(func() { w.onComplete(res) })
+		}
+	}
+}
+
+// collectResults converts the leftover, the batch 'pcb' and all the batches available to OpResult(s)
+func (w *watcher) collectResults(q *resultQueue, pcb *aiocb) (r []OpResult) {
+	head := q.leftover
+	q.leftover = nil
+	if head == nil {
+		head = pcb
+		pcb = nil
+	}
+
+	var seq uint64
+	for head != nil {
+		r = append(r, head.result())
+		seq = head.seq
+		next := head.next
+		head.next = nil
+		aiocbPool.Put(head)
+		head = next
+
+		if head == nil {
+			if pcb != nil {
+				head, pcb = pcb, nil
+			} else if len(q.chResults) > 0 {
+				head = <-q.chResults
+			}
+		}
+	}
+	w.consumed(q, len(r))
+	atomic.StoreUint64(&q.lastReturned, seq)
+	atomic.StoreInt32(&w.shouldSwap, 1)
+	return r
+}
+
+// Submit submits a batch of async-io requests in one call, the requests are processed in
+// order, as if they're submitted one by one. The failure of a request doesn't abort the
+// batch, it's reported in the Err field of the corresponding Op, the error returned is
+// for the whole batch.
+func (w *watcher) Submit(ops []Op) error {
+	select {
+	case <-w.die:
+		return ErrWatcherClosed
+	default:
+	}
+
+	batch := make([]*aiocb, 0, len(ops))
+	for k := range ops {
+		op := &ops[k]
+		op.Err = nil
+		op.Seq = 0
+		switch op.Operation {
+		case OpRead:
+			if op.ReadFull && len(op.Buffer) == 0 {
+				op.Err = ErrEmptyBuffer
+				continue
+			}
+		case OpWrite:
+			if len(op.Buffer) == 0 {
+				op.Err = ErrEmptyBuffer
+				continue
+			}
+		default:
+			op.Err = ErrInvalidOp
+			continue
+		}
+
+		cb, err := w.newAiocb(op.Context, op.Operation, op.Conn, op.Buffer, op.Deadline, op.ReadFull, nil)
+		if err != nil {
+			op.Err = err
+			continue
+		}
+		op.Seq = cb.opSeq
+		batch = append(batch, cb)
+	}
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	cb := aiocbPool.Get().(*aiocb)
+	*cb = aiocb{op: opBatch, batch: batch, idx: -1}
+	w.submit(cb)
+	return nil
+}
+
+// Count returns a point-in-time snapshot of the number of connections being watched,
+// and the number of read and write operations queued on them, the results are all
+// zero if the watcher is closed.
+func (w *watcher) Count() (conns int, pendingReads int, pendingWrites int) {
+	var c, r, wr int
+	err := w.runInLoop(func() {
+		c = len(w.descs)
+		for _, desc := range w.descs {
+			r += desc.readers.Len() + desc.oobReaders.Len()
+			wr += desc.writers.Len()
+		}
+	})
+	if err != nil {
+		return 0, 0, 0
+	}
+	return c, r, wr
+}
+
+// Connections returns a point-in-time snapshot of the connections being watched,
+// it's gathered on the loop, and nil if the watcher is closed. It's O(n), and meant
+// for diagnostics like admin endpoints.
+func (w *watcher) Connections() []ConnInfo {
+	var infos []ConnInfo
+	err := w.runInLoop(func() {
+		infos = make([]ConnInfo, 0, len(w.descs))
+		for ident, desc := range w.descs {
+			info := ConnInfo{
+				Fd:         ident,
+				LocalAddr:  desc.laddr,
+				RemoteAddr: desc.raddr,
+				Readers:    desc.readers.Len() + desc.oobReaders.Len(),
+				Writers:    desc.writers.Len(),
+				LastActive: desc.lastActive,
+				Conn:       desc.idleConn,
+			}
+			// the conn held by a queued operation
+			for _, l := range []*list.List{&desc.readers, &desc.writers, &desc.oobReaders} {
+				if info.Conn == nil && l.Len() > 0 {
+					info.Conn = l.Front().Value.(*aiocb).conn
+				}
+			}
+			infos = append(infos, info)
+		}
+	})
+	if err != nil {
+		return nil
+	}
+	return infos
+}
+
+// SetSockOpt sets the socket option on the file descriptor duplicated from 'conn' which
+// is being watched, like TCP_NODELAY, SO_SNDBUF and SO_RCVBUF, as the original conn has
+// been closed once it's watched. It returns ErrNotWatched if the conn is not being watched.
+func (w *watcher) SetSockOpt(conn net.Conn, level, opt, value int) error {
+	if conn == nil || reflect.TypeOf(conn).Kind() != reflect.Ptr {
+		return ErrUnsupported
+	}
+	ptr := reflect.ValueOf(conn).Pointer()
+
+	var err error
+	if lerr := w.runInLoop(func() {
+		ident, ok := w.connIdents[ptr]
+		if !ok {
+			err = ErrNotWatched
+			return
+		}
+		err = retryOnEINTR(func() error { return syscall.SetsockoptInt(ident, level, opt, value) })
+	}); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// WriteQueueLen returns the number of write operations queued on 'conn', including the one
+// in progress, it grows when the peer stops reading, for implementing backpressure.
+// It returns ErrNotWatched if the conn is not being watched.
+func (w *watcher) WriteQueueLen(conn net.Conn) (int, error) {
+	var n int
+	err := w.inspectDesc(conn, func(desc *fdDesc) {
+		n = desc.writers.Len()
+	})
+	return n, err
+}
+
+// WriteQueueBytes returns the bytes queued on 'conn' not yet written, like WriteQueueLen,
+// connections whose send queue exceeds a threshold can be dropped to shed load.
+// It returns ErrNotWatched if the conn is not being watched.
+func (w *watcher) WriteQueueBytes(conn net.Conn) (int, error) {
+	var n int
+	err := w.inspectDesc(conn, func(desc *fdDesc) {
+		for e := desc.writers.Front(); e != nil; e = e.Next() {
+			n += e.Value.(*aiocb).unwritten()
+		}
+	})
+	return n, err
+}
+
+// SetReadBuffer replaces the buffer of the read at the head of 'conn' with 'buf' for its next
+// read cycle, without a cancel and resubmit cycle, like rotating a ring of buffers between
+// the completions of a persistent read, whose following reads keep on using 'buf'.
+// ErrBufferInUse is returned if the read has partially filled its buffer, and ErrNoPendingRead
+// if no read is queued on the conn. It returns ErrNotWatched if the conn is not being watched.
+func (w *watcher) SetReadBuffer(conn net.Conn, buf []byte) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+
+	var err error
+	if lerr := w.inspectDesc(conn, func(desc *fdDesc) {
+		if desc.readers.Len() == 0 {
+			err = ErrNoPendingRead
+			return
+		}
+		pcb := desc.readers.Front().Value.(*aiocb)
+		if pcb.op != OpRead || pcb.bufs != nil || pcb.readable {
+			err = ErrInvalidOp
+			return
+		}
+		if pcb.size > 0 || pcb.ringID != 0 || pcb.ringDone {
+			err = ErrBufferInUse
+			return
+		}
+		err = w.replaceReadBuffer(pcb, buf)
+	}); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// replaceReadBuffer sets the buffer of a read not yet started to 'buf', the bytes
+// charged and the in-flight range tracked are moved to it, the loop never blocks on
+// the memory limit, so ErrMemLimit is returned if the limit would be exceeded.
+func (w *watcher) replaceReadBuffer(pcb *aiocb, buf []byte) error {
+	old := pcb.buffer
+	if pcb.track != nil {
+		w.untrackBuffer(pcb)
+		pcb.buffer = buf
+		if err := w.trackBuffer(pcb); err != nil {
+			pcb.buffer = old
+			w.trackBuffer(pcb)
+			return err
+		}
+	}
+
+	if limit := atomic.LoadInt64(&w.memLimit); limit > 0 {
+		delta := int64(len(buf)) - pcb.charge
+		for {
+			cur := atomic.LoadInt64(&w.outstanding)
+			if delta > 0 && cur+delta > limit {
+				if pcb.track != nil {
+					w.untrackBuffer(pcb)
+					pcb.buffer = old
+					w.trackBuffer(pcb)
+				}
+				return ErrMemLimit
+			}
+			if atomic.CompareAndSwapInt64(&w.outstanding, cur, cur+delta) {
+				break
+			}
+		}
+		pcb.charge += delta
+		if delta < 0 {
+			w.notifyMemReleased()
+		}
+	}
+
+	// the buffer taken from the pool is returned
+	pcb.buffer = old
+	if pcb.pooled {
+		w.recycleBuffer(pcb)
+		pcb.pooled = false
+	}
+	pcb.buffer = buf
+	if pcb.persist {
+		pcb.persistBuf = buf
+	}
+	return nil
+}
+
+// inspectDesc runs 'f' with the descriptor of 'conn' on the loop goroutine
+func (w *watcher) inspectDesc(conn net.Conn, f func(desc *fdDesc)) error {
+	if conn == nil || reflect.TypeOf(conn).Kind() != reflect.Ptr {
+		return ErrUnsupported
+	}
+	ptr := reflect.ValueOf(conn).Pointer()
+
+	var err error
+	if lerr := w.runInLoop(func() {
+		ident, ok := w.connIdents[ptr]
+		if !ok {
+			err = ErrNotWatched
+			return
+		}
+		f(w.descs[ident])
+	}); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// SetSwapBufferSize resizes the internal swap buffers for Read() with nil to 'n' bytes,
+// without interrupting the connections being watched. New buffers are allocated, and
+// swapped in only once all the results delivered in the old buffers are acknowledged,
+// the reads until then keep using the old buffers, so the results never refer to the
+// buffers replaced. ErrBufferSize is returned if 'n' is below the size of the largest
+// result in the swap buffers not acknowledged yet, as it couldn't be read again.
+func (w *watcher) SetSwapBufferSize(n int) error {
+	if n <= 0 {
+		return ErrBufferSize
+	}
+
+	var err error
+	if lerr := w.runInLoop(func() {
+		if n < w.largestSwapRead() {
+			err = ErrBufferSize
+			return
+		}
+		w.swapResized = make([][]byte, len(w.swapBuffers))
+		for k := range w.swapResized {
+			w.swapResized[k] = make([]byte, n)
+		}
+		w.installSwapBuffers()
+	}); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// swapRead is a read delivered in the swap buffers
+type swapRead struct {
+	seq  uint64
+	size int
+}
+
+// trackSwapRead records the read delivered in the swap buffers as 'seq', the reads
+// not larger than it are dropped, as they are acknowledged before it.
+func (w *watcher) trackSwapRead(seq uint64, size int) {
+	n := len(w.swapReads)
+	for n > 0 && w.swapReads[n-1].size <= size {
+		n--
+	}
+	w.swapReads = append(w.swapReads[:n], swapRead{seq, size})
+}
+
+// pruneSwapReads drops the reads acknowledged as of 'acked'
+func (w *watcher) pruneSwapReads(acked uint64) {
+	n := 0
+	for n < len(w.swapReads) && w.swapReads[n].seq <= acked {
+		n++
+	}
+	w.swapReads = append(w.swapReads[:0], w.swapReads[n:]...)
+}
+
+// largestSwapRead returns the size of the largest read in the swap buffers not acknowledged
+func (w *watcher) largestSwapRead() int {
+	w.pruneSwapReads(w.ackedResults())
+	if len(w.swapReads) > 0 {
+		return w.swapReads[0].size
+	}
+	return 0
+}
+
+// installSwapBuffers swaps in the resized swap buffers, if all the results delivered in
+// the old ones are acknowledged.
+func (w *watcher) installSwapBuffers() {
+	acked := w.ackedResults()
+	for _, seq := range w.swapSeq {
+		if seq > acked {
+			return
+		}
+	}
+
+	w.swapSize = len(w.swapResized[0])
+	w.swapBuffers = w.swapResized
+	w.swapResized = nil
+	for k := range w.swapSeq {
+		w.swapSeq[k] = 0
+	}
+	w.swapIdx = 0
+	w.bufferOffset = 0
+}
+
+// allocSwapBuffers allocates a ring of 'num' swap buffers of 'size'
+func (w *watcher) allocSwapBuffers(size int, num int) {
+	w.swapSize = size
+	w.swapBuffers = make([][]byte, num)
+	for k := range w.swapBuffers {
+		w.swapBuffers[k] = make([]byte, size)
+	}
+	w.swapSeq = make([]uint64, num)
+	w.swapIdx = 0
+	w.bufferOffset = 0
+}
+
+// SetBufferPool sets the hooks of a buffer pool, reads submitted with a nil buffer take
+// a buffer of the swap buffer size from 'get' instead of sharing the internal swap
+// buffer, the buffer is owned by the user after the result is returned. The buffers
+// of writes are returned to 'put' on completion, the Buffer of write results is nil.
+// The buffers of operations dropped with the conn are also returned to 'put'.
+// The hooks are called on the loop goroutine, they must not block, the operations
+// submitted from them are reentrant, queued on the loop and handled before next event.
+// Writes of Conn are not affected. Setting both nil restores the swap buffers.
+func (w *watcher) SetBufferPool(get func(size int) []byte, put func(buf []byte)) error {
+	if (get == nil) != (put == nil) {
+		return ErrInvalidBufferPool
+	}
+	return w.runInLoop(func() {
+		w.getBuffer = get
+		w.putBuffer = put
+	})
+}
+
+// recycleBuffer returns the buffer of 'pcb' to the pool set by SetBufferPool
+func (w *watcher) recycleBuffer(pcb *aiocb) {
+	if w.putBuffer == nil || pcb.notify != nil || pcb.buffer == nil || pcb.bufs != nil {
+		return
+	}
+	w.enterCallback()
+	w.putBuffer(pcb.buffer)
+	w.exitCallback()
+	pcb.buffer = nil
+}
+
+// enterCallback marks a user callback starts running on the loop
+func (w *watcher) enterCallback() { atomic.AddInt32(&w.callbacks, 1) }
+
+// exitCallback marks the user callback has returned
+func (w *watcher) exitCallback() { atomic.AddInt32(&w.callbacks, -1) }
+
+// onLoop reports whether it's called by a user callback running on the loop
+// goroutine itself, the calls from other goroutines meanwhile go through the
+// channels of the loop like any other. The calling goroutine is identified
+// only while a callback runs, as it's costly.
+func (w *watcher) onLoop() bool {
+	return atomic.LoadInt32(&w.callbacks) > 0 && goid() == w.loopGoid
+}
+
+// goid returns the id of the calling goroutine, from the header of its stack
+// trace "goroutine N [running]:"
+func goid() uint64 {
+	var buf [64]byte
+	b := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	var id uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			break
+		}
+		id = id*10 + uint64(c-'0')
+	}
+	return id
+}
+
+// submit sends a request to the loop, the ones submitted from a callback on the
+// loop are queued locally and handled before next event.
+func (w *watcher) submit(cb *aiocb) {
+	if w.onLoop() {
+		w.reentrant = append(w.reentrant, cb)
+		return
+	}
+	w.chPending <- cb
+}
+
+// takeReentrant returns the requests submitted from the callbacks, called
+// on the loop only.
+func (w *watcher) takeReentrant() []*aiocb {
+	reentrant := w.reentrant
+	w.reentrant = nil
+	return reentrant
+}
+
+// runInLoop runs 'f' on the loop goroutine which owns the loop related data
+// structures, and waits for it to finish.
+func (w *watcher) runInLoop(f func()) error {
+	// called from a callback on the loop already
+	if w.onLoop() {
+		f()
+		return nil
+	}
+
+	done := make(chan struct{})
+	select {
+	case w.chCommand <- func() { f(); close(done) }:
+	case <-w.die:
+		return ErrWatcherClosed
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-w.die:
+		return ErrWatcherClosed
+	}
+}
+
+// Read submits an async read request on 'fd' with context 'ctx', using buffer 'buf'.
+// 'buf' can be set to nil to use internal buffer.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Read(ctx interface{}, conn net.Conn, buf []byte) error {
+	return w.aioCreate(ctx, OpRead, conn, buf, zeroTime, false)
+}
+
+// ReadPersist submits a persistent async read request on 'fd' with context 'ctx', using buffer 'buf',
+// the request stays armed after each completion, and keeps on delivering results until
+// an error or EOF is reported, the final result with error is delivered once and the
+// request is removed. Cancel stops it with a final result of ErrCanceled.
+// 'buf' can be set to nil to use internal buffer, for a user supplied 'buf', the next read
+// into it will not start until the next call to WaitIO(), after the result has been returned.
+func (w *watcher) ReadPersist(ctx interface{}, conn net.Conn, buf []byte) error {
+	return w.aioCreateWith(ctx, OpRead, conn, buf, zeroTime, false, func(cb *aiocb) {
+		cb.persist = true
+		cb.persistBuf = buf
+	})
+}
+
+// SetFreeOnEOF sets whether the conn will be freed automatically when a persistent read
+// on it hits EOF, the default is false, which leaves the conn for the user to Free.
+func (w *watcher) SetFreeOnEOF(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&w.freeOnEOF, 1)
+	} else {
+		atomic.StoreInt32(&w.freeOnEOF, 0)
+	}
+}
+
+// SetReportPending sets whether to report the bytes remaining buffered in the socket
+// after a read completes, in Pending of OpResult, it costs an extra ioctl(FIONREAD)
+// per read, disabled by default.
+func (w *watcher) SetReportPending(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&w.reportPending, 1)
+	} else {
+		atomic.StoreInt32(&w.reportPending, 0)
+	}
+}
+
+// SetMaxConns sets the max number of connections being watched, operations on a new
+// connection beyond the limit are delivered with ErrTooManyConns, without dup(2) the
+// conn, as an admission control point. 'n' <= 0 means unlimited, which is the default.
+func (w *watcher) SetMaxConns(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&w.maxConns, int32(n))
+}
+
+// SetWriteCoalescing sets whether to coalesce the writes queued on a connection, when the
+// connection becomes writable, all the plain writes at the head of the queue are written
+// with a single writev(2), and delivered in order as each drains fully. It cuts syscalls
+// for rapid small writes, disabled by default.
+func (w *watcher) SetWriteCoalescing(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&w.coalesce, 1)
+	} else {
+		atomic.StoreInt32(&w.coalesce, 0)
+	}
+}
+
+// SetReadBudget sets the max bytes to read on a connection per wakeup of the loop, when
+// the budget is used up, the remaining reads yield to other connections and resume in next
+// round of the loop, so a fast sender can't monopolize the loop. A single read is not split,
+// see ReadFullMaxSyscalls to limit a large ReadFull. 'n' <= 0 means unlimited, the default.
+func (w *watcher) SetReadBudget(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&w.readBudget, int32(n))
+}
+
+// SetTimerGranularity sets the granularity of deadlines, the deadlines are rounded up to
+// the next multiple of 'd', so the clustered deadlines expire in a single wakeup of the loop,
+// at the cost of firing up to 'd' late. 'd' <= 0 means exact deadlines, which is the default.
+func (w *watcher) SetTimerGranularity(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.StoreInt64(&w.timerGranularity, int64(d))
+}
+
+// SetBufferCheck sets whether to check the buffers of the operations submitted, for debugging,
+// a submission fails with ErrBufferInUse if its buffer overlaps the one of an in-flight operation
+// on the same conn, and either one is a read. It costs a lock per submission and completion,
+// disabled by default.
+func (w *watcher) SetBufferCheck(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&w.checkBuffers, 1)
+	} else {
+		atomic.StoreInt32(&w.checkBuffers, 0)
+	}
+}
+
+// SetMaxInflightBytes sets the bound of the total bytes of user buffers in-flight(submitted but
+// not delivered) to 'n', like the one of NewWatcherMemLimit, as a hard ceiling of the memory
+// pinned by the operations. The submissions over limit fail with ErrInflightLimit, or block with
+// SetMemLimitBlocking(true). 'n' <= 0 removes the bound, and the operations submitted before
+// the bound is set are not counted.
+func (w *watcher) SetMaxInflightBytes(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&w.memLimit, int64(n))
+	// the submissions blocked re-check the new bound
+	w.notifyMemReleased()
+}
+
+// SetMemLimitBlocking sets whether the submissions over the limit of NewWatcherMemLimit
+// block until enough bytes are released, instead of failing with ErrMemLimit.
+// Note the blocked submissions wait for completions to be delivered, they should
+// not be made on the goroutine calling WaitIO.
+func (w *watcher) SetMemLimitBlocking(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&w.memBlock, 1)
+	} else {
+		atomic.StoreInt32(&w.memBlock, 0)
+	}
+}
+
+// ReadTimeout submits an async read request on 'fd' with context 'ctx', using buffer 'buf', and
+// expects to read some bytes into the buffer before 'deadline'.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadTimeout(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return w.aioCreate(ctx, OpRead, conn, buf, deadline, false)
+}
+
+// Peek submits an async read request on 'fd' with context 'ctx', using buffer 'buf', like Read,
+// but the data is peeked with MSG_PEEK and left in the socket, for sniffing the protocol before
+// committing to a framing decision, the reads behind get the same data again. A peek completes
+// with the bytes available in a single attempt, it might be fewer than the bytes sniffing
+// requires, peek again for more.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Peek(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return w.aioCreateWith(ctx, OpRead, conn, buf, deadline, false, func(cb *aiocb) {
+		cb.peek = true
+	})
+}
+
+// WaitReadable submits a readiness-only request on 'conn' with context 'ctx', it completes
+// with OpRead and Size 0 once the conn is readable, no data is consumed, so the data can be
+// read by other means, like a syscall on the fd of the result. Readiness is checked by
+// peeking a byte, the result is delivered with io.EOF if the peer has closed the stream.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) WaitReadable(ctx interface{}, conn net.Conn, deadline time.Time) error {
+	return w.aioCreateWith(ctx, OpRead, conn, nil, deadline, false, func(cb *aiocb) {
+		cb.readable = true
+	})
+}
+
+// ReadOOB submits an async read request of out-of-band(urgent) data on 'fd' with context 'ctx',
+// using buffer 'buf', it completes when urgent data arrives, which is usually a single byte
+// on TCP, the result is delivered with OpReadOOB.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadOOB(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return w.aioCreate(ctx, OpReadOOB, conn, buf, deadline, false)
+}
+
+// WriteOOB submits an async write request of out-of-band(urgent) data on 'fd' with context 'ctx',
+// using buffer 'buf', the last byte of the buffer is sent as urgent data on TCP. It's ordered with
+// ordinary writes on the conn, the result is delivered with OpWriteOOB.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) WriteOOB(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	return w.aioCreate(ctx, OpWriteOOB, conn, buf, deadline, false)
+}
+
+// Splice submits an async splice request with context 'ctx', which moves 'count' bytes from
+// 'src' to 'dst' through a pipe, without copying to userspace, driven by the readiness of both.
+// It completes when 'count' bytes are written to 'dst', or with io.EOF if 'src' reaches EOF
+// before, 'count' <= 0 means until EOF, the bytes written are reported in Size.
+// Reads on 'src' and writes on 'dst' should not be submitted before completion, as they
+// may interleave with the splice. It's only supported on linux, ErrUnsupported otherwise.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Splice(ctx interface{}, src net.Conn, dst net.Conn, count int, deadline time.Time) error {
+	if dst == nil || reflect.TypeOf(dst).Kind() != reflect.Ptr {
+		return ErrUnsupported
+	}
+
+	pipe, err := newSplicePipe()
+	if err != nil {
+		return err
+	}
+
+	err = w.aioCreateWith(ctx, OpSplice, src, nil, deadline, false, func(cb *aiocb) {
+		cb.dstPtr = reflect.ValueOf(dst).Pointer()
+		cb.dstConn = dst
+		cb.pipe = pipe
+		cb.count = int64(count)
+	})
+	if err != nil {
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+	}
+	return err
+}
+
+// ReadPriority is like ReadTimeout, but the read is queued ahead of the normal reads on 'conn'
+// and behind the priority ones, and the connections with priority operations at the head of
+// their queues are processed first in each round of the loop.
+// Priority operations can starve the others if submitted continuously, the fairness between
+// connections is traded for the latency of them, use it for low volume control traffic.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadPriority(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return w.aioCreateWith(ctx, OpRead, conn, buf, deadline, false, func(cb *aiocb) {
+		cb.priority = true
+	})
+}
+
+// WritePriority is like WriteTimeout, but the write is queued ahead of the normal writes on
+// 'conn' and behind the priority ones, a write in progress is never interrupted. See
+// ReadPriority for the fairness tradeoff.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) WritePriority(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	return w.aioCreateWith(ctx, OpWrite, conn, buf, deadline, false, func(cb *aiocb) {
+		cb.priority = true
+	})
+}
+
+// ReadWithFds submits an async read request on unix domain socket 'conn' with context 'ctx',
+// using buffer 'buf', the file descriptors passed by the peer along with the data are returned
+// in Fds of the result, and owned by the caller.
+// ErrSocketType is returned in the result if 'conn' is not a unix domain socket.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadWithFds(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return w.aioCreateWith(ctx, OpRead, conn, buf, deadline, false, func(cb *aiocb) {
+		cb.withFds = true
+	})
+}
+
+// ReadMsg submits an async read request on 'conn' with context 'ctx', using buffer 'buf'
+// for the data and 'oob' for the control messages received along with it, like IP_PKTINFO
+// or SO_TIMESTAMP. OOB[:OOBn] of the result are the control messages received, and Flags
+// are the flags of the message, MSG_CTRUNC is set if 'oob' is too small.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadMsg(ctx interface{}, conn net.Conn, buf []byte, oob []byte, deadline time.Time) error {
+	return w.aioCreateWith(ctx, OpRead, conn, buf, deadline, false, func(cb *aiocb) {
+		cb.withOOB = true
+		cb.oob = oob
+	})
+}
+
+// ReadContext submits an async read request on 'fd' with context 'ctx', using buffer 'buf',
+// the request is cancelled and delivered with goctx.Err() if 'goctx' is done before
+// completion, partial results(Size) remain valid. The deadline of 'goctx', if any, is
+// the deadline of the read, expired with context.DeadlineExceeded.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadContext(goctx context.Context, ctx interface{}, conn net.Conn, buf []byte) error {
+	return w.aioCreateContext(goctx, ctx, OpRead, conn, buf)
+}
+
+// ReadFull submits an async read request on 'fd' with context 'ctx', using buffer 'buf', and
+// expects to fill the buffer before 'deadline'.
+// On ErrDeadline, Size is the number of bytes read so far and Buffer[:Size] holds them,
+// the read can be continued by submitting another ReadFull on buf[Size:].
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+// 'buf' can't be nil in ReadFull.
+func (w *watcher) ReadFull(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	return w.aioCreate(ctx, OpRead, conn, buf, deadline, true)
+}
+
+// ReadAtLeast submits an async read request on 'fd' with context 'ctx', using buffer 'buf', and
+// expects to read at least 'min' bytes into the buffer before 'deadline', the bytes available
+// beyond 'min' are read opportunistically within the buffer.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+// 'buf' can't be nil in ReadAtLeast, and 'min' must be within (0, len(buf)].
+func (w *watcher) ReadAtLeast(ctx interface{}, conn net.Conn, buf []byte, min int, deadline time.Time) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	if min <= 0 || min > len(buf) {
+		return ErrInvalidMin
+	}
+	return w.aioCreateWith(ctx, OpRead, conn, buf, deadline, true, func(cb *aiocb) {
+		cb.min = min
+	})
+}
+
+// ReadFullMaxSyscalls is like ReadFull, but limits the number of read syscalls this
+// operation can make on every readiness event to 'maxSyscalls', the operation yields
+// to other connections when the limit is reached, and resumes in next round of the loop.
+// 'maxSyscalls' <= 0 means unlimited.
+func (w *watcher) ReadFullMaxSyscalls(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time, maxSyscalls int) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	return w.aioCreateWith(ctx, OpRead, conn, buf, deadline, true, func(cb *aiocb) {
+		cb.maxSyscalls = maxSyscalls
+	})
+}
+
+// ReadFullDeadlineFunc is like ReadFull, but the deadline is computed by 'deadlineFunc'
+// with the number of bytes read so far, it's consulted on submission with 0, and after
+// each partial read to update the deadline, a zero time.Time means no deadline.
+// 'deadlineFunc' is called on the watcher's loop goroutine, it must not block, the
+// operations submitted from it are reentrant like the hooks of SetBufferPool.
+func (w *watcher) ReadFullDeadlineFunc(ctx interface{}, conn net.Conn, buf []byte, deadlineFunc func(soFar int) time.Time) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	if deadlineFunc == nil {
+		return w.aioCreate(ctx, OpRead, conn, buf, zeroTime, true)
+	}
+	return w.aioCreateWith(ctx, OpRead, conn, buf, deadlineFunc(0), true, func(cb *aiocb) {
+		cb.deadlineFunc = deadlineFunc
+	})
+}
+
+// Write submits an async write request on 'fd' with context 'ctx', using buffer 'buf'.
+// A write completes only when the whole buffer is written, or on error.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Write(ctx interface{}, conn net.Conn, buf []byte) error {
+	return w.writeFull(ctx, conn, buf, zeroTime)
+}
+
+// Probe submits a liveness check on 'conn', it's delivered with OpProbe on the loop without
+// waiting for the operations queued, with no error if the connection is alive, or ErrConnClosed
+// if the peer has closed it, or the socket has failed, wrapping the errno, checked by errors.Is.
+// It peeks at the socket, so the data pending is left for the reads, as the connections
+// idle in a pool can be validated before reuse.
+func (w *watcher) Probe(conn net.Conn) error {
+	return w.aioCreate(nil, OpProbe, conn, nil, zeroTime, false)
+}
+
+// Flush submits a write barrier on 'conn' with context 'ctx', it's delivered with OpFlush
+// once all the writes submitted before have completed, with Size 0 and no error, or
+// ErrDeadline if 'deadline' passes first. A zero 'deadline' means no deadline.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Flush(ctx interface{}, conn net.Conn, deadline time.Time) error {
+	return w.aioCreate(ctx, OpFlush, conn, nil, deadline, false)
+}
+
+// WriteTimeout submits an async write request on 'fd' with context 'ctx', using buffer 'buf', and
+// expects to complete writing the buffer before 'deadline', 'buf' can be set to nil to use internal buffer.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) WriteTimeout(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return w.writeFull(ctx, conn, buf, deadline)
+}
+
+// WriteContext submits an async write request on 'fd' with context 'ctx', using buffer 'buf',
+// the request is cancelled and delivered with goctx.Err() if 'goctx' is done before
+// completion, partial results(Size) remain valid, and it times out at the deadline of
+// 'goctx' like ReadContext.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) WriteContext(goctx context.Context, ctx interface{}, conn net.Conn, buf []byte) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	return w.aioCreateContext(goctx, ctx, OpWrite, conn, buf)
+}
+
+// WriteFull submits an async write request on 'fd' with context 'ctx', using buffer 'buf', and
+// expects to flush the entire buffer before 'deadline', it completes only when all bytes are
+// written, or on error. On ErrDeadline, Size of the result reports the bytes written before
+// timing out, so the caller knows where to resume. It's the counterpart of ReadFull, the
+// writes of Write and WriteTimeout share the same contract.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+// 'buf' can't be nil in WriteFull.
+func (w *watcher) WriteFull(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	return w.writeFull(ctx, conn, buf, deadline)
+}
+
+// writeFull submits a write which completes once the whole buffer is written, or on error
+func (w *watcher) writeFull(ctx interface{}, conn net.Conn, buf []byte, deadline time.Time) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	return w.aioCreate(ctx, OpWrite, conn, buf, deadline, false)
+}
+
+// WriteWithFds submits an async write request on unix domain socket 'conn' with context 'ctx',
+// using buffer 'buf', the file descriptors in 'fds' are passed to the peer along with the data
+// in SCM_RIGHTS ancillary data, the caller still owns 'fds' and can close them after completion.
+// ErrSocketType is returned in the result if 'conn' is not a unix domain socket.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+// 'buf' can't be nil in WriteWithFds, as ancillary data must be sent with some data.
+func (w *watcher) WriteWithFds(ctx interface{}, conn net.Conn, buf []byte, fds []int, deadline time.Time) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	return w.aioCreateWith(ctx, OpWrite, conn, buf, deadline, false, func(cb *aiocb) {
+		cb.withFds = true
+		cb.fds = fds
+	})
+}
+
+// WriteVector submits an async gathering write request on 'fd' with context 'ctx', the
+// buffers in 'bufs' are written in order as a whole, like they're concatenated, and
+// expects to complete writing before 'deadline', a zero 'deadline' means no deadline.
+// The result reports the total bytes written in Size and the buffers in Buffers, Buffer is nil.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) WriteVector(ctx interface{}, conn net.Conn, bufs [][]byte, deadline time.Time) error {
+	return w.writeVector(ctx, conn, bufs, deadline)
+}
+
+// Writev submits an async gathering write request on 'conn' with context 'ctx' with writev(2),
+// the counterpart of Readv, so the header and the payload of a message built in separate
+// buffers are sent without copying them into one. It completes once all the buffers are
+// written like WriteVector, Size of the result reports the bytes written on ErrDeadline.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Writev(ctx interface{}, conn net.Conn, bufs [][]byte, deadline time.Time) error {
+	return w.writeVector(ctx, conn, bufs, deadline)
+}
+
+// writeVector submits a gathering write, which completes once all the buffers are written
+func (w *watcher) writeVector(ctx interface{}, conn net.Conn, bufs [][]byte, deadline time.Time) error {
+	var total int
+	for _, b := range bufs {
+		total += len(b)
+	}
+	if total == 0 {
+		return ErrEmptyBuffer
+	}
+
+	return w.aioCreateWith(ctx, OpWrite, conn, nil, deadline, false, func(cb *aiocb) {
+		cb.bufs = bufs
+		cb.bufsLen = total
+	})
+}
+
+// ReadVector submits an async scattering read request on 'fd' with context 'ctx', the buffers in
+// 'bufs' are filled in order as a whole, like they're concatenated, and expects to fill all of
+// them before 'deadline', a zero 'deadline' means no deadline. The result reports the total
+// bytes read in Size and the buffers in Buffers, Buffer is nil, io.EOF is reported if the
+// connection ends before the buffers are filled.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadVector(ctx interface{}, conn net.Conn, bufs [][]byte, deadline time.Time) error {
+	return w.readVector(ctx, conn, bufs, deadline, true)
+}
+
+// Readv submits an async scattering read request on 'conn' with context 'ctx', like ReadVector,
+// but it completes with the bytes of a single readv(2) once any data is available, like Read,
+// so the header and the payload of a message can be received into separate buffers without
+// waiting for all of them to be filled. The result reports the bytes read in Size and the
+// buffers in Buffers, Buffer is nil. Writev is the gathering write with writev(2).
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Readv(ctx interface{}, conn net.Conn, bufs [][]byte, deadline time.Time) error {
+	return w.readVector(ctx, conn, bufs, deadline, false)
+}
+
+// readVector submits a scattering read, which fills all the buffers if 'full'
+func (w *watcher) readVector(ctx interface{}, conn net.Conn, bufs [][]byte, deadline time.Time, full bool) error {
+	var total int
+	for _, b := range bufs {
+		total += len(b)
+	}
+	if total == 0 {
+		return ErrEmptyBuffer
+	}
+
+	return w.aioCreateWith(ctx, OpRead, conn, nil, deadline, full, func(cb *aiocb) {
+		cb.bufs = bufs
+		cb.bufsLen = total
+	})
+}
+
+// ReadFrom submits an async read request of a datagram on the packet 'conn', like UDP or
+// unixgram, with context 'ctx', using buffer 'buf', a nil 'buf' uses the internal swap buffer
+// like Read. The source address of the datagram is reported in Addr of the result.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadFrom(ctx interface{}, conn net.PacketConn, buf []byte, deadline time.Time) error {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return ErrUnsupportedConn
+	}
+	return w.aioCreate(ctx, OpRead, c, buf, deadline, false)
+}
+
+// WriteTo submits an async write request of a datagram of 'buf' to 'addr' on the packet 'conn',
+// with context 'ctx', 'addr' is a *net.UDPAddr for UDP, or a *net.UnixAddr for unixgram, or
+// else ErrInvalidAddr is returned. The datagram is sent as a whole, Size of the result is
+// len(buf) on success.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) WriteTo(ctx interface{}, conn net.PacketConn, buf []byte, addr net.Addr, deadline time.Time) error {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return ErrUnsupportedConn
+	}
+
+	// the family of the socket follows its local address, IPv4 goes to dual-stack sockets mapped
+	var inet6 bool
+	if laddr, ok := c.LocalAddr().(*net.UDPAddr); ok && laddr.IP.To4() == nil {
+		inet6 = true
+	}
+	to, err := addrToSockaddr(addr, inet6)
+	if err != nil {
+		return err
+	}
+
+	return w.aioCreateWith(ctx, OpWrite, c, buf, deadline, false, func(cb *aiocb) {
+		cb.to = to
+	})
+}
+
+// ReadMulti submits an async batched receive request on the UDP 'conn' with context 'ctx',
+// up to len(bufs) datagrams are received into 'bufs', one datagram per buffer, with as few
+// syscalls as possible, recvmmsg(2) on linux. It completes with a single result once any
+// datagram is received, after the buffers are filled or no more datagrams are available,
+// Sizes and Addrs of the result report the size and the source of each datagram.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) ReadMulti(ctx interface{}, conn *net.UDPConn, bufs [][]byte, deadline time.Time) error {
+	var total int
+	for _, b := range bufs {
+		total += len(b)
+	}
+	if total == 0 {
+		return ErrEmptyBuffer
+	}
+	if conn == nil {
+		return ErrUnsupported
+	}
+
+	return w.aioCreateWith(ctx, OpRead, conn, nil, deadline, false, func(cb *aiocb) {
+		cb.multi = true
+		cb.bufs = bufs
+		cb.bufsLen = total
+		cb.sizes = make([]int, 0, len(bufs))
+		cb.addrs = make([]net.Addr, 0, len(bufs))
+	})
+}
+
+// SendFile submits an async write request on 'conn' with context 'ctx', transferring 'count'
+// bytes of regular file 'file' starting at 'offset' in kernel without copying through userspace,
+// the file must stay open until the result is delivered, and the file offset is not changed.
+// Writes on the same conn are performed in the order of submission, Size of the result is
+// the bytes transferred, io.ErrUnexpectedEOF is returned if the file ends before 'count' bytes.
+// It's rejected with ErrUnsupported on the platforms without sendfile(2), see Capabilities.
+func (w *watcher) SendFile(ctx interface{}, conn net.Conn, file *os.File, offset, count int64, deadline time.Time) error {
+	if file == nil || !capabilities().SendFile {
+		return ErrUnsupported
+	}
+	if count <= 0 {
+		return ErrEmptyBuffer
+	}
+	if offset < 0 {
+		return ErrInvalidOffset
+	}
+
+	return w.aioCreateWith(ctx, OpWrite, conn, nil, deadline, false, func(cb *aiocb) {
+		cb.file = file
+		cb.fileFd = int(file.Fd())
+		cb.offset = offset
+		cb.count = count
+	})
+}
+
+// ReplacePendingWrite submits an async write request on 'fd' with context 'ctx', using buffer 'buf',
+// with last-writer-wins semantics: if the oldest queued write on this conn hasn't started
+// sending, its buffer and context are replaced by 'buf' and 'ctx', and only one result
+// will be delivered; otherwise 'buf' is queued as a normal write.
+func (w *watcher) ReplacePendingWrite(ctx interface{}, conn net.Conn, buf []byte) error {
+	if len(buf) == 0 {
+		return ErrEmptyBuffer
+	}
+	return w.aioCreateWith(ctx, OpWrite, conn, buf, zeroTime, false, func(cb *aiocb) {
+		cb.replace = true
+	})
+}
+
+// Register starts watching 'conn' without submitting any operation, so the buffers can be
+// allocated when data actually arrives, it's a no-op if the conn is being watched already.
+// The original conn is closed once it's watched, like on the first operation, pair it
+// with Free to release the resources.
+func (w *watcher) Register(conn net.Conn) error {
+	if conn == nil || reflect.TypeOf(conn).Kind() != reflect.Ptr {
+		return ErrUnsupported
+	}
+	ptr := reflect.ValueOf(conn).Pointer()
+
+	var err error
+	if lerr := w.runInLoop(func() {
+		if _, ok := w.connIdents[ptr]; !ok {
+			_, _, err = w.watch(conn, ptr)
+		}
+	}); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// Detach removes 'conn' from the watcher without closing the connection, and returns the file
+// descriptor duplicated from it, which is owned by the caller, to be attached to another watcher
+// with AttachFd. The pending operations on the conn are delivered with ErrDetached in WaitIO(),
+// partial results(Size) remain valid, the rest can be resubmitted on the new conn.
+// It returns ErrNoDup in NoDup mode, as the file descriptor is owned by the conn.
+func (w *watcher) Detach(conn net.Conn) (int, error) {
+	if conn == nil || reflect.TypeOf(conn).Kind() != reflect.Ptr {
+		return -1, ErrUnsupported
+	}
+	ptr := reflect.ValueOf(conn).Pointer()
+
+	fd := -1
+	var err error
+	if lerr := w.runInLoop(func() {
+		ident, ok := w.connIdents[ptr]
+		if !ok {
+			err = ErrNotWatched
+			return
+		}
+
+		// the fd is owned by the conn in NoDup mode
+		desc := w.descs[ident]
+		if desc.borrowed {
+			err = ErrNoDup
+			return
+		}
+		if err = w.pfd.Unwatch(ident); err != nil {
+			return
+		}
+		all := func(*aiocb) bool { return true }
+		w.cancelDesc(ident, desc, all, ErrDetached)
+		desc.detached = true
+		w.releaseConn(ident)
+		fd = ident
+	}); lerr != nil {
+		return -1, lerr
+	}
+
+	if err == nil {
+		// the conn is not released by gc anymore
+		runtime.SetFinalizer(conn, nil)
+	}
+	return fd, err
+}
+
+// AttachFd wraps the socket file descriptor 'fd', usually returned by Detach, into a
+// net.Conn and starts watching it. The watcher takes ownership of 'fd', it's closed
+// on return, and the resources are released on Free of the returned conn.
+func (w *watcher) AttachFd(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "")
+	if f == nil {
+		return nil, syscall.EBADF
+	}
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.Register(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Accept starts accepting connections on listener 'ln' with context 'ctx', every connection
+// accepted is delivered with OpAccept in WaitIO(), as the Conn of the result, it stays armed
+// until an error is delivered, or it's cancelled by CancelContext. Like conns, the listener is
+// closed once it's watched, the watcher accepts on the file descriptor duplicated from it,
+// which is released by FreeListener, or when 'ln' is garbage collected.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Accept(ctx interface{}, ln net.Listener) error {
+	if ln == nil || reflect.TypeOf(ln).Kind() != reflect.Ptr {
+		return ErrUnsupported
+	}
+	ptr := reflect.ValueOf(ln).Pointer()
+	return w.aioCreateWith(ctx, OpAccept, &listenerConn{ln}, nil, zeroTime, false, func(cb *aiocb) {
+		cb.ptr = ptr
+	})
+}
+
+// Connect starts a non-blocking connect to 'addr' on 'network'("tcp", "tcp4", "tcp6" or "unix")
+// with context 'ctx', the connection established is delivered with OpConnect in WaitIO(), as
+// the Conn of the result, or the error of the connect, like ECONNREFUSED, or ErrDeadline if
+// it's not established before 'deadline'. The host name in 'addr' is resolved on the calling
+// goroutine, an IP address avoids the lookup. Connections established are not watched until
+// operations are submitted on them, like accepted ones.
+// 'ctx' is the user-defined value passed through the gaio watcher unchanged.
+func (w *watcher) Connect(ctx interface{}, network, addr string, deadline time.Time) error {
+	var raddr net.Addr
+	var family int
+	var err error
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		var tcpAddr *net.TCPAddr
+		if tcpAddr, err = net.ResolveTCPAddr(network, addr); err != nil {
+			return err
+		}
+		family = syscall.AF_INET6
+		if tcpAddr.IP.To4() != nil && network != "tcp6" {
+			family = syscall.AF_INET
+		}
+		raddr = tcpAddr
+	case "unix":
+		if raddr, err = net.ResolveUnixAddr(network, addr); err != nil {
+			return err
+		}
+		family = syscall.AF_UNIX
+	default:
+		return net.UnknownNetworkError(network)
+	}
+
+	sa, err := addrToSockaddr(raddr, family == syscall.AF_INET6)
+	if err != nil {
+		return err
+	}
+	fd, err := connectSocket(family, sa)
+	if err != nil {
+		return err
+	}
+
+	c := &connectConn{fd: fd, raddr: raddr}
+	if err := w.aioCreate(ctx, OpConnect, c, nil, deadline, false); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// connectSocket opens a non-blocking stream socket of 'family' and starts connecting it to 'sa'
+func connectSocket(family int, sa syscall.Sockaddr) (fd int, err error) {
+	syscall.ForkLock.RLock()
+	fd, err = syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return -1, err
+	}
+
+	if err = syscall.SetNonblock(fd, true); err == nil {
+		// an interrupted connect goes on asynchronously
+		err = syscall.Connect(fd, sa)
+		if err == syscall.EINPROGRESS || err == syscall.EINTR {
+			err = nil
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// tryConnect completes a connect once the socket is connected, or has failed, the
+// connection is delivered as a new net.Conn on the file descriptor duplicated, as
+// the one watched belongs to the connecting adapter and is released on completion.
+func (w *watcher) tryConnect(fd int, pcb *aiocb) bool {
+	// SO_ERROR has been taken on the poller error
+	if len(w.sockErrs) > 0 && w.takeSockErr(fd, pcb) {
+		pcb.conn = nil
+		return true
+	}
+
+	errno, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	atomic.AddInt64(&w.stats.syscalls, 1)
+	if err == nil && errno != 0 {
+		err = syscall.Errno(errno)
+	}
+	if err != nil {
+		pcb.conn, pcb.err = nil, err
+		return true
+	}
+
+	// still in progress
+	if _, err := syscall.Getpeername(fd); err == syscall.ENOTCONN {
+		atomic.AddInt64(&w.stats.retries, 1)
+		return false
+	}
+
+	var nfd int
+	if pcb.err = retryOnEINTR(func() (err error) {
+		nfd, err = syscall.Dup(fd)
+		return err
+	}); pcb.err != nil {
+		pcb.conn = nil
+		return true
+	}
+	syscall.CloseOnExec(nfd)
+	if pcb.conn, pcb.err = acceptedConn(nfd); pcb.err == nil {
+		pcb.laddr = pcb.conn.LocalAddr()
+		pcb.raddr = pcb.conn.RemoteAddr()
+	}
+	return true
+}
+
+// releaseConnect releases the connecting adapter watched on 'ident' after the connect has
+// completed, it's removed from the poller first, as closing it doesn't while the connection
+// delivered refers to the same socket, and the fd of the connection might be watched later.
+func (w *watcher) releaseConnect(ident int) {
+	w.pfd.Unwatch(ident)
+	w.releaseConn(ident)
+}
+
+// connectConn adapts a connecting socket to net.Conn to be watched for Connect
+type connectConn struct {
+	fd        int
+	raddr     net.Addr
+	closeOnce sync.Once
+}
+
+func (c *connectConn) Read(b []byte) (int, error)  { return 0, ErrInvalidOp }
+func (c *connectConn) Write(b []byte) (int, error) { return 0, ErrInvalidOp }
+func (c *connectConn) Close() error {
+	c.closeOnce.Do(func() { syscall.Close(c.fd) })
+	return nil
+}
+func (c *connectConn) LocalAddr() net.Addr                { return nil }
+func (c *connectConn) RemoteAddr() net.Addr               { return c.raddr }
+func (c *connectConn) SetDeadline(t time.Time) error      { return nil }
+func (c *connectConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *connectConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// SyscallConn returns the raw connection of the connecting socket
+func (c *connectConn) SyscallConn() (syscall.RawConn, error) { return connectRawConn{c.fd}, nil }
+
+// connectRawConn is the syscall.RawConn of a connecting socket
+type connectRawConn struct {
+	fd int
+}
+
+func (rc connectRawConn) Control(f func(fd uintptr)) error           { f(uintptr(rc.fd)); return nil }
+func (rc connectRawConn) Read(f func(fd uintptr) (done bool)) error  { return ErrInvalidOp }
+func (rc connectRawConn) Write(f func(fd uintptr) (done bool)) error { return ErrInvalidOp }
+
+// FreeListener releases the resources related to listener 'ln' immediately, like Free,
+// the pending Accept is delivered with ErrConnClosed.
+func (w *watcher) FreeListener(ln net.Listener) error {
+	if ln == nil || reflect.TypeOf(ln).Kind() != reflect.Ptr {
+		return ErrUnsupported
+	}
+	ptr := reflect.ValueOf(ln).Pointer()
+	return w.aioCreateWith(nil, opDelete, &listenerConn{ln}, nil, zeroTime, false, func(cb *aiocb) {
+		cb.ptr = ptr
+	})
+}
+
+// CloseWrite shuts down the write direction of 'conn'(SHUT_WR) once the writes queued
+// before are completed, the peer reads EOF after all the data. The conn stays watched
+// and readable, writes submitted after CloseWrite fail.
+func (w *watcher) CloseWrite(conn net.Conn) error {
+	return w.aioCreate(syscall.SHUT_WR, opShutdown, conn, nil, zeroTime, false)
+}
+
+// CloseRead shuts down the read direction of 'conn'(SHUT_RD) immediately, the reads
+// queued complete with the data received already, or io.EOF. The conn stays writable.
+func (w *watcher) CloseRead(conn net.Conn) error {
+	return w.aioCreate(syscall.SHUT_RD, opShutdown, conn, nil, zeroTime, false)
+}
+
+// Free let the watcher to release resources related to this conn immediately,
+// like socket file descriptors. The pending operations on the conn are delivered
+// with ErrConnClosed in WaitIO(), partial results(Size) remain valid.
+func (w *watcher) Free(conn net.Conn) error {
+	return w.aioCreate(nil, opDelete, conn, nil, zeroTime, false)
+}
+
+// Cancel cancels all pending operations on 'conn', the cancelled operations are delivered
+// with ErrCanceled in WaitIO(), partial results(Size) remain valid. Unlike Free, the conn
+// is still being watched, new operations can be submitted on it.
+func (w *watcher) Cancel(conn net.Conn) error {
+	return w.aioCreate(nil, opCancel, conn, nil, zeroTime, false)
+}
+
+// SetDeadline modifies the deadline of the oldest pending operation of type 'op'(OpRead
+// or OpWrite) on 'conn', which is the one in progress, the partial progress of it is
+// kept. A zero 'deadline' removes the deadline, and nothing happens if there's no
+// pending operation of type 'op'.
+func (w *watcher) SetDeadline(conn net.Conn, op OpType, deadline time.Time) error {
+	if op != OpRead && op != OpWrite {
+		return ErrInvalidOp
+	}
+	return w.aioCreate(op, opSetDeadline, conn, nil, deadline, false)
+}
+
+// SetIdleTimeout sets the idle timeout of 'conn', a result of OpIdle is delivered in WaitIO()
+// once the conn has had no completed IO for 'd', and once every 'd' while it stays idle.
+// It tracks the connection rather than a single request, to reap idle connections in pools.
+// The conn is held by the watcher while the idle timeout is set, a zero 'd' removes it.
+func (w *watcher) SetIdleTimeout(conn net.Conn, d time.Duration) error {
+	return w.aioCreate(d, opSetIdle, conn, nil, zeroTime, false)
+}
+
+// SetRateLimit caps the bytes read and written on 'conn' to 'bytesPerSec' in total,
+// with a burst of one second, 'bytesPerSec' <= 0 removes the limit. Once the budget is spent,
+// the operations on the conn stay queued until the tokens refill, the data left is not
+// drained from the socket, a read may complete with the bytes allowed only.
+//
+// Plain reads and writes are capped to the tokens left, other operations like vector
+// IO are charged after completion, the overdraft is repaid before the conn is served again.
+func (w *watcher) SetRateLimit(conn net.Conn, bytesPerSec int) error {
+	return w.aioCreate(bytesPerSec, opSetRate, conn, nil, zeroTime, false)
+}
+
+// CancelContext cancels all pending operations whose context equals to ctx,
+// the cancelled operations are delivered with ErrCanceled in WaitIO(), partial
+// results(Size) remain valid.
+//
+// Cancelling requires a scan of all pending operations in the watcher, it's O(n)
+// and should be used occasionally, like aborting a logical request.
+// ctx must be non-nil and comparable.
+func (w *watcher) CancelContext(ctx interface{}) error {
+	if ctx == nil || !reflect.TypeOf(ctx).Comparable() {
+		return ErrIncomparable
+	}
+
+	select {
+	case <-w.die:
+		return ErrWatcherClosed
+	default:
+		cb := aiocbPool.Get().(*aiocb)
+		*cb = aiocb{op: opCancelContext, ctx: ctx, idx: -1}
+		w.submit(cb)
+		return nil
+	}
+}
+
+// core async-io creation
+func (w *watcher) aioCreate(ctx interface{}, op OpType, conn net.Conn, buf []byte, deadline time.Time, readfull bool) error {
+	return w.aioCreateWith(ctx, op, conn, buf, deadline, readfull, nil)
+}
+
+// aioCreateContext creates an async-io request cancelled by 'goctx', a goroutine waits
+// for either 'goctx' is done or the request is settled, so it never outlives the request.
+// The deadline of 'goctx' is the deadline of the request on the timeout heap, expired with
+// context.DeadlineExceeded like the cancellation on it.
+func (w *watcher) aioCreateContext(goctx context.Context, ctx interface{}, op OpType, conn net.Conn, buf []byte) error {
+	done := make(chan struct{})
+	var ptr uintptr
+	deadline, hasDeadline := goctx.Deadline()
+	err := w.aioCreateWith(ctx, op, conn, buf, deadline, false, func(cb *aiocb) {
+		cb.done = done
+		cb.ctxDeadline = hasDeadline
+		ptr = cb.ptr
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-goctx.Done():
+			// the deadline expires on the timeout heap
+			if hasDeadline && goctx.Err() == context.DeadlineExceeded {
+				select {
+				case <-done:
+				case <-w.die:
+				}
+				return
+			}
+			cb := aiocbPool.Get().(*aiocb)
+			*cb = aiocb{op: opCancelOp, ptr: ptr, ctx: done, err: goctx.Err(), idx: -1}
+			select {
+			case w.chPending <- cb:
+			case <-w.die:
+			}
+		case <-done:
+		case <-w.die:
+		}
+	}()
+	return nil
+}
+
+// aioCreateWith creates an async-io request, 'setup' can be used to set
+// extra fields on the aiocb before it's submitted to the loop.
+func (w *watcher) aioCreateWith(ctx interface{}, op OpType, conn net.Conn, buf []byte, deadline time.Time, readfull bool, setup func(*aiocb)) error {
+	select {
+	case <-w.die:
+		return ErrWatcherClosed
+	default:
+		cb, err := w.newAiocb(ctx, op, conn, buf, deadline, readfull, setup)
+		if err != nil {
+			return err
+		}
+
+		w.submit(cb)
+		return nil
+	}
+}
+
+// newAiocb creates an aiocb for the request to be submitted
+func (w *watcher) newAiocb(ctx interface{}, op OpType, conn net.Conn, buf []byte, deadline time.Time, readfull bool, setup func(*aiocb)) (*aiocb, error) {
+	if atomic.LoadInt32(&w.closing) == 1 {
+		return nil, ErrWatcherClosed
+	}
+
+	var ptr uintptr
+	if conn != nil && reflect.TypeOf(conn).Kind() == reflect.Ptr {
+		ptr = reflect.ValueOf(conn).Pointer()
+	} else {
+		return nil, ErrUnsupported
+	}
+	if err := checkConn(conn); err != nil {
+		return nil, err
+	}
+
+	cb := aiocbPool.Get().(*aiocb)
+	*cb = aiocb{op: op, ptr: ptr, ctx: ctx, conn: conn, buffer: buf, deadline: deadline, readFull: readfull, idx: -1}
+	if op == OpRead || op == OpWrite || op == OpReadOOB || op == OpWriteOOB {
+		// addresses are cached by conn
+		cb.laddr = conn.LocalAddr()
+		cb.raddr = conn.RemoteAddr()
+	}
+	if setup != nil {
+		setup(cb)
+	}
+
+	if charge := int64(len(cb.buffer) + cb.bufsLen); atomic.LoadInt64(&w.memLimit) > 0 && charge > 0 {
+		if err := w.acquireMem(charge); err != nil {
+			aiocbPool.Put(cb)
+			return nil, err
+		}
+		cb.charge = charge
+	}
+	if atomic.LoadInt32(&w.checkBuffers) == 1 && len(cb.buffer) > 0 && (op == OpRead || op == OpWrite || op == OpReadOOB || op == OpWriteOOB) {
+		if err := w.trackBuffer(cb); err != nil {
+			w.releaseMem(cb)
+			aiocbPool.Put(cb)
+			return nil, err
+		}
+	}
+	// user operations are numbered, internal ones are not
+	if op < opDelete {
+		cb.opSeq = atomic.AddUint64(&w.submitSeq, 1)
+	}
+	atomic.AddInt64(&w.stats.pending, 1)
+	return cb, nil
+}
+
+// bufRange is the memory range of the buffer of an in-flight operation
+type bufRange struct {
+	start uintptr
+	end   uintptr
+	read  bool
+}
+
+// trackBuffer records the buffer of 'pcb' as in-flight on its conn, ErrBufferInUse is
+// returned if it overlaps the buffer of an in-flight operation, and either one is a read.
+func (w *watcher) trackBuffer(pcb *aiocb) error {
+	r := &bufRange{start: uintptr(unsafe.Pointer(&pcb.buffer[0])), read: pcb.op == OpRead || pcb.op == OpReadOOB}
+	r.end = r.start + uintptr(len(pcb.buffer))
+
+	w.bufMutex.Lock()
+	defer w.bufMutex.Unlock()
+	for _, q := range w.bufRanges[pcb.ptr] {
+		if (r.read || q.read) && r.start < q.end && q.start < r.end {
+			return ErrBufferInUse
+		}
+	}
+
+	if w.bufRanges == nil {
+		w.bufRanges = make(map[uintptr][]*bufRange)
+	}
+	w.bufRanges[pcb.ptr] = append(w.bufRanges[pcb.ptr], r)
+	pcb.track = r
+	return nil
+}
+
+// untrackBuffer removes the buffer of 'pcb' from the in-flight buffers
+func (w *watcher) untrackBuffer(pcb *aiocb) {
+	w.bufMutex.Lock()
+	ranges := w.bufRanges[pcb.ptr]
+	for k := range ranges {
+		if ranges[k] == pcb.track {
+			ranges[k] = ranges[len(ranges)-1]
+			ranges[len(ranges)-1] = nil
+			ranges = ranges[:len(ranges)-1]
+			break
+		}
+	}
+	if len(ranges) == 0 {
+		delete(w.bufRanges, pcb.ptr)
+	} else {
+		w.bufRanges[pcb.ptr] = ranges
+	}
+	w.bufMutex.Unlock()
+	pcb.track = nil
+}
+
+// acquireMem charges 'n' bytes to the outstanding bytes within the limit
+func (w *watcher) acquireMem(n int64) error {
+	for {
+		// the limit can be changed by SetMaxInflightBytes while waiting
+		limit := atomic.LoadInt64(&w.memLimit)
+		if limit <= 0 {
+			return nil
+		}
+		if n > limit {
+			return ErrMemLimit
+		}
+
+		cur := atomic.LoadInt64(&w.outstanding)
+		if cur+n <= limit {
+			if atomic.CompareAndSwapInt64(&w.outstanding, cur, cur+n) {
+				return nil
+			}
+			continue
+		}
+
+		// the loop releasing the bytes never blocks
+		if atomic.LoadInt32(&w.memBlock) == 0 || w.onLoop() {
+			return ErrMemLimit
+		}
+
+		w.memMutex.Lock()
+		if w.memReleased == nil {
+			w.memReleased = make(chan struct{})
+		}
+		released := w.memReleased
+		w.memMutex.Unlock()
+
+		// re-check in case of bytes released before waiting
+		if limit := atomic.LoadInt64(&w.memLimit); limit <= 0 || atomic.LoadInt64(&w.outstanding)+n <= limit {
+			continue
+		}
+
+		select {
+		case <-released:
+		case <-w.die:
+			return ErrWatcherClosed
+		}
+	}
+}
+
+// releaseMem returns the bytes charged by the aiocb
+func (w *watcher) releaseMem(pcb *aiocb) {
+	if pcb.track != nil {
+		w.untrackBuffer(pcb)
+	}
+	if pcb.charge == 0 {
+		return
+	}
+
+	atomic.AddInt64(&w.outstanding, -pcb.charge)
+	pcb.charge = 0
+	w.notifyMemReleased()
+}
+
+// notifyMemReleased wakes up the submitters waiting for the outstanding bytes
+func (w *watcher) notifyMemReleased() {
+	w.memMutex.Lock()
+	if w.memReleased != nil {
+		close(w.memReleased)
+		w.memReleased = nil
+	}
+	w.memMutex.Unlock()
+}
+
+// reportPollerError calls the OnPollerError callback with the error of event 'e'
+func (w *watcher) reportPollerError(e event) {
+	err := e.err
+	if err == nil && e.ev&EV_ERR != 0 {
+		// epoll doesn't carry the errno
+		if errno, gerr := syscall.GetsockoptInt(e.ident, syscall.SOL_SOCKET, syscall.SO_ERROR); gerr == nil && errno != 0 {
+			err = syscall.Errno(errno)
+			w.sockErrs[e.ident] = err
+		}
+	}
+	if err == nil {
+		err = io.EOF
+	}
+
+	w.enterCallback()
+	w.onPollerError(e.ident, err)
+	w.exitCallback()
+}
+
+// hangupError returns the error of the operations on the conn hung up with event 'e',
+// ErrConnClosed wrapping the socket error if any.
+func (w *watcher) hangupError(e event) error {
+	err := e.err
+	if sockErr, ok := w.sockErrs[e.ident]; ok {
+		err = sockErr
+	} else if err == nil && e.ev&EV_ERR != 0 {
+		if errno, gerr := syscall.GetsockoptInt(e.ident, syscall.SOL_SOCKET, syscall.SO_ERROR); gerr == nil && errno != 0 {
+			err = syscall.Errno(errno)
+		}
+	}
+	if err == nil {
+		return ErrConnClosed
+	}
+	return &wrappedError{ErrConnClosed, connError(err)}
+}
+
+// takeSockErr completes 'pcb' with the socket error of 'fd' consumed by reportPollerError
+func (w *watcher) takeSockErr(fd int, pcb *aiocb) bool {
+	err, ok := w.sockErrs[fd]
+	if !ok {
+		return false
+	}
+	delete(w.sockErrs, fd)
+	pcb.err = err
+	return true
+}
+
+// probe checks the liveness of 'ident' by peeking a byte, the data pending is not consumed,
+// neither the socket error kept for the next read or write.
+func (w *watcher) probe(ident int, desc *fdDesc, pcb *aiocb) {
+	if err, ok := w.sockErrs[ident]; ok {
+		pcb.err = &wrappedError{ErrConnClosed, err}
+		return
+	}
+
+	var b [1]byte
+	for {
+		n, _, er := syscall.Recvfrom(ident, b[:], syscall.MSG_PEEK)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EINTR {
+			continue
+		}
+
+		// EAGAIN means alive with nothing to read, a zero-length datagram is not EOF
+		if er != nil && er != syscall.EAGAIN {
+			pcb.err = &wrappedError{ErrConnClosed, er}
+		} else if er == nil && n == 0 && !desc.datagram {
+			pcb.err = ErrConnClosed
+		}
+		return
+	}
+}
+
+// tryRead will try to read data on aiocb and notify
+func (w *watcher) tryRead(fd int, pcb *aiocb) bool {
+	if len(w.sockErrs) > 0 && w.takeSockErr(fd, pcb) {
+		return true
+	}
+	if pcb.op == OpSplice {
+		return w.trySplice(pcb)
+	}
+	if pcb.op == OpAccept {
+		return w.tryAccept(fd, pcb)
+	}
+	if pcb.multi {
+		return w.tryReadMulti(fd, pcb)
+	}
+	if pcb.bufs != nil {
+		return w.tryReadv(fd, pcb)
+	}
+	if pcb.peek {
+		return w.tryPeek(fd, pcb)
+	}
+	if pcb.readable {
+		return w.tryReadable(fd, pcb)
+	}
+	if pcb.withFds {
+		return w.tryRecvmsg(fd, pcb)
+	}
+	if pcb.withOOB {
+		return w.tryReadMsg(fd, pcb)
+	}
+	if pcb.datagram {
+		return w.tryRecvfrom(fd, pcb)
+	}
+	if w.ring != nil && w.ringable(pcb) {
+		return w.ringRead(fd, pcb)
+	}
+
+	buf, useSwap, backBuffer := w.readBuffer(pcb)
+
+	// read full operation completes when the buffer is filled,
+	// or at least 'min' bytes are read for ReadAtLeast.
+	fullSize := len(pcb.buffer)
+	if pcb.min > 0 {
+		fullSize = pcb.min
+	}
+
+	var syscalls int
+	soFar := pcb.size
+	for {
+		b := buf[pcb.size:]
+		if w.limited && len(b) > w.quota-(pcb.size-soFar) {
+			b = b[:w.quota-(pcb.size-soFar)]
+		}
+
+		nr, er := rawRead(fd, b)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			if pcb.size > soFar {
+				w.progressDeadline(pcb)
+			}
+			return false
+		}
+
+		// On MacOS we can see EINTR here if the user
+		// pressed ^Z.
+		if er == syscall.EINTR {
+			continue
+		}
+
+		// if er is nil, accumulate bytes read
+		if er == nil {
+			pcb.size += nr
+			atomic.AddInt64(&w.stats.bytesRead, int64(nr))
+		}
+
+		pcb.err = er
+		// proper setting of EOF
+		if nr == 0 && er == nil {
+			pcb.err = io.EOF
+		}
+
+		// read full operation keeps on reading until the buffer is filled,
+		// or the socket is drained, within the syscall budget.
+		if pcb.readFull && pcb.err == nil && pcb.size < fullSize {
+			// rate limit reached, resumes when the tokens refill
+			if w.limited && pcb.size-soFar >= w.quota {
+				w.progressDeadline(pcb)
+				return false
+			}
+
+			syscalls++
+			if pcb.maxSyscalls > 0 && syscalls >= pcb.maxSyscalls {
+				w.progressDeadline(pcb)
+				w.requeue(fd, EV_READ)
+				return false
+			}
+			continue
+		}
+
+		break
+	}
+
+	if pcb.readFull { // read full operation
+		if pcb.err != nil {
+			return true
+		}
+		if pcb.size >= fullSize {
+			return true
+		}
+		return false
+	}
+
+	if useSwap && pcb.err == nil && pcb.size == len(buf) && len(buf) < w.swapSize && !w.limited {
+		w.spillRead(fd, pcb, buf)
+		return true
+	}
+
+	if useSwap { // IO completed with internal buffer
+		pcb.useSwap = true
+		pcb.buffer = buf[:pcb.size] // set len to pcb.size
+		w.bufferOffset += pcb.size
+	} else if backBuffer { // internal buffer exhausted
+		pcb.buffer = buf[:pcb.size]
+	}
+	return true
+}
+
+// spillRead continues a read which has filled up the remaining region 'buf' of the internal
+// buffer into the next swap buffer, so the read is not truncated at the boundary. The bytes
+// read are moved to the head of the next buffer only if more data is read into it, otherwise
+// the read completes in the current buffer, and the next buffer is left untouched if it's in
+// use by the results not acknowledged.
+func (w *watcher) spillRead(fd int, pcb *aiocb, buf []byte) {
+	next := (w.swapIdx + 1) % len(w.swapBuffers)
+	if w.swapSeq[next] <= w.ackedResults() {
+		for {
+			nr, er := rawRead(fd, w.swapBuffers[next][pcb.size:])
+			atomic.AddInt64(&w.stats.syscalls, 1)
+			if er == syscall.EINTR {
+				continue
+			}
+
+			if er == nil && nr > 0 {
+				copy(w.swapBuffers[next], buf[:pcb.size])
+				pcb.size += nr
+				atomic.AddInt64(&w.stats.bytesRead, int64(nr))
+				w.swapIdx = next
+				w.swapSeq[next] = 0
+				w.bufferOffset = 0
+				buf = w.swapBuffers[next]
+			} else if er != nil && er != syscall.EAGAIN {
+				// the socket error is consumed by this read, reported along with the data
+				pcb.err = er
+			}
+			// EOF is reported by next read
+			break
+		}
+	}
+
+	pcb.useSwap = true
+	pcb.buffer = buf[:pcb.size]
+	w.bufferOffset += pcb.size
+}
+
+// readBuffer returns the buffer to read into for aiocb, which is the user supplied one,
+// or the internal swap buffer, or the one byte back buffer if the internal buffer is exhausted.
+func (w *watcher) readBuffer(pcb *aiocb) (buf []byte, useSwap bool, backBuffer bool) {
+	buf = pcb.buffer
+	if buf == nil { // internal or backBuffer
+		if w.swapResized != nil {
+			w.installSwapBuffers()
+		}
+		if atomic.CompareAndSwapInt32(&w.shouldSwap, 1, 0) {
+			w.swapIdx = (w.swapIdx + 1) % len(w.swapBuffers)
+			w.bufferOffset = 0
+			acked := w.ackedResults()
+			w.pruneSwapReads(acked)
+			// results in the buffer not acknowledged are still in use, replace it
+			if w.swapSeq[w.swapIdx] > acked {
+				w.swapBuffers[w.swapIdx] = make([]byte, w.swapSize)
+			}
+			w.swapSeq[w.swapIdx] = 0
+		}
+
+		buf = w.swapBuffers[w.swapIdx][w.bufferOffset:]
+		if len(buf) > 0 {
+			useSwap = true
+		} else {
+			backBuffer = true
+			buf = pcb.backBuffer[:]
+		}
+	}
+	return
+}
+
+// ackedResults returns the sequence before which the results on all shards are acknowledged,
+// as the results of a shard are returned in order, it's the least acknowledged of the shards
+// with results outstanding, or the latest acknowledged if all results are acknowledged, so an
+// idle shard never holds the swap buffers.
+func (w *watcher) ackedResults() (acked uint64) {
+	lagging := false
+	for _, q := range w.queues {
+		a := atomic.LoadUint64(&q.acked)
+		if a < q.lastSeq {
+			if !lagging || a < acked {
+				acked = a
+			}
+			lagging = true
+		} else if !lagging && a > acked {
+			acked = a
+		}
+	}
+	return acked
+}
+
+// tryRecvfrom will try to receive a single datagram on aiocb and notify, a zero-length
+// datagram is legitimate and completes the read, datagram larger than the buffer is truncated.
+func (w *watcher) tryRecvfrom(fd int, pcb *aiocb) bool {
+	buf, useSwap, backBuffer := w.readBuffer(pcb)
+	for {
+		nr, from, er := syscall.Recvfrom(fd, buf, 0)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if er == syscall.EINTR {
+			continue
+		}
+
+		pcb.err = er
+		if er == nil {
+			pcb.size = nr
+			pcb.addr = sockaddrToAddr(from)
+			atomic.AddInt64(&w.stats.bytesRead, int64(nr))
+		}
+		break
+	}
+
+	if useSwap {
+		pcb.useSwap = true
+		pcb.buffer = buf[:pcb.size]
+		w.bufferOffset += pcb.size
+	} else if backBuffer {
+		pcb.buffer = buf[:pcb.size]
+	}
+	return true
+}
+
+// tryReadMulti will try to receive datagrams into the buffers of a ReadMulti, one datagram
+// per buffer, as many as available per syscall with recvmmsg, it keeps receiving until the
+// buffers are filled or EAGAIN, and completes if any datagram is received.
+func (w *watcher) tryReadMulti(fd int, pcb *aiocb) bool {
+	for len(pcb.sizes) < len(pcb.bufs) {
+		k := len(pcb.sizes)
+		n, er := rawRecvmmsg(fd, pcb.bufs[k:], pcb.sizes[k:len(pcb.bufs)], pcb.addrs[k:len(pcb.bufs)])
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			if k == 0 {
+				return false
+			}
+			break
+		}
+
+		if er == syscall.EINTR {
+			continue
+		}
+
+		if er != nil {
+			pcb.err = er
+			break
+		}
+
+		pcb.sizes = pcb.sizes[:k+n]
+		pcb.addrs = pcb.addrs[:k+n]
+		for _, size := range pcb.sizes[k:] {
+			pcb.size += size
+		}
+	}
+	atomic.AddInt64(&w.stats.bytesRead, int64(pcb.size))
+	return true
+}
+
+// tryPeek will try to peek data on aiocb with MSG_PEEK and notify, the data is left in the
+// socket for the reads behind, every attempt starts over from the head of the socket buffer.
+func (w *watcher) tryPeek(fd int, pcb *aiocb) bool {
+	buf, useSwap, backBuffer := w.readBuffer(pcb)
+	for {
+		nr, from, er := syscall.Recvfrom(fd, buf, syscall.MSG_PEEK)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if er == syscall.EINTR {
+			continue
+		}
+
+		pcb.err = er
+		if er == nil {
+			pcb.size = nr
+			if pcb.datagram {
+				pcb.addr = sockaddrToAddr(from)
+			} else if nr == 0 {
+				pcb.err = io.EOF
+			}
+		}
+		break
+	}
+
+	if useSwap {
+		pcb.useSwap = true
+		pcb.buffer = buf[:pcb.size]
+		w.bufferOffset += pcb.size
+	} else if backBuffer {
+		pcb.buffer = buf[:pcb.size]
+	}
+	return true
+}
+
+// tryReadable completes a readiness-only request once 'fd' is readable, a byte is peeked
+// to tell the readiness, as the event might be stale, and nothing is consumed.
+func (w *watcher) tryReadable(fd int, pcb *aiocb) bool {
+	var b [1]byte
+	for {
+		n, _, er := syscall.Recvfrom(fd, b[:], syscall.MSG_PEEK)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if er == syscall.EINTR {
+			continue
+		}
+
+		// a zero-length datagram is readable, not EOF
+		pcb.err = er
+		if er == nil && n == 0 && !pcb.datagram {
+			pcb.err = io.EOF
+		}
+		return true
+	}
+}
+
+// tryRecvmsg will try to read data along with the file descriptors passed
+// in SCM_RIGHTS ancillary data on a unix domain socket.
+func (w *watcher) tryRecvmsg(fd int, pcb *aiocb) bool {
+	buf, useSwap, backBuffer := w.readBuffer(pcb)
+	oob := make([]byte, syscall.CmsgSpace(maxRecvFds*4))
+	for {
+		nr, oobn, _, _, er := syscall.Recvmsg(fd, buf, oob, 0)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if er == syscall.EINTR {
+			continue
+		}
+
+		pcb.err = er
+		if er == nil {
+			pcb.size = nr
+			atomic.AddInt64(&w.stats.bytesRead, int64(nr))
+			if msgs, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil {
+				for k := range msgs {
+					if fds, err := syscall.ParseUnixRights(&msgs[k]); err == nil {
+						pcb.fds = append(pcb.fds, fds...)
+					}
+				}
+			}
+
+			// proper setting of EOF
+			if nr == 0 && !pcb.datagram {
+				pcb.err = io.EOF
+			}
+		}
+		break
+	}
+
+	if useSwap {
+		pcb.useSwap = true
+		pcb.buffer = buf[:pcb.size]
+		w.bufferOffset += pcb.size
+	} else if backBuffer {
+		pcb.buffer = buf[:pcb.size]
+	}
+	return true
+}
+
+// tryReadMsg will try to read data along with the control messages into the
+// out-of-band buffer of aiocb, and notify.
+func (w *watcher) tryReadMsg(fd int, pcb *aiocb) bool {
+	buf, useSwap, backBuffer := w.readBuffer(pcb)
+	for {
+		nr, oobn, flags, from, er := syscall.Recvmsg(fd, buf, pcb.oob, 0)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if er == syscall.EINTR {
+			continue
+		}
+
+		pcb.err = er
+		if er == nil {
+			pcb.size = nr
+			pcb.oobn = oobn
+			pcb.flags = flags
+			atomic.AddInt64(&w.stats.bytesRead, int64(nr))
+			if pcb.datagram {
+				pcb.addr = sockaddrToAddr(from)
+			} else if nr == 0 && oobn == 0 {
+				// proper setting of EOF
+				pcb.err = io.EOF
+			}
+		}
+		break
+	}
+
+	if useSwap {
+		pcb.useSwap = true
+		pcb.buffer = buf[:pcb.size]
+		w.bufferOffset += pcb.size
+	} else if backBuffer {
+		pcb.buffer = buf[:pcb.size]
+	}
+	return true
+}
+
+func (w *watcher) tryWrite(fd int, pcb *aiocb) bool {
+	if pcb.op == OpConnect {
+		return w.tryConnect(fd, pcb)
+	}
+	if len(w.sockErrs) > 0 && w.takeSockErr(fd, pcb) {
+		return true
+	}
+	if pcb.op == OpSplice {
+		return w.trySplice(pcb)
+	}
+	// write barrier, the writes before have completed
+	if pcb.op == OpFlush {
+		return true
+	}
+	if pcb.bufs != nil {
+		return w.tryWritev(fd, pcb)
+	}
+	if pcb.file != nil {
+		return w.trySendfile(fd, pcb)
+	}
+	if pcb.withFds {
+		return w.trySendmsg(fd, pcb)
+	}
+	if pcb.op == OpWriteOOB {
+		return w.trySendOOB(fd, pcb)
+	}
+	if pcb.to != nil {
+		return w.trySendto(fd, pcb)
+	}
+
+	// nothing to write, completes with Size 0 and no error
+	if len(pcb.buffer) == 0 {
+		pcb.err = nil
+		return true
+	}
+	if w.ring != nil && w.ringable(pcb) {
+		return w.ringWrite(fd, pcb)
+	}
+
+	b := pcb.buffer[pcb.size:]
+	if w.limited && len(b) > w.quota {
+		b = b[:w.quota]
+	}
+
+	for {
+		nw, ew := rawWrite(fd, b)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		pcb.err = ew
+		if ew == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if ew == syscall.EINTR {
+			continue
+		}
+
+		// has error, the bytes written before remain in size
+		if ew != nil {
+			return true
+		}
+
+		// accumulate bytes written across the attempts
+		pcb.size += nw
+		atomic.AddInt64(&w.stats.bytesWritten, int64(nw))
+		break
+	}
+
+	// all bytes written
+	return pcb.size == len(pcb.buffer)
+}
+
+// trySendto sends the datagram of WriteTo to its destination, a datagram is sent as a whole
+func (w *watcher) trySendto(fd int, pcb *aiocb) bool {
+	for {
+		ew := syscall.Sendto(fd, pcb.buffer, 0, pcb.to)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		pcb.err = ew
+		if ew == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if ew == syscall.EINTR {
+			continue
+		}
+
+		if ew == nil {
+			pcb.size = len(pcb.buffer)
+			atomic.AddInt64(&w.stats.bytesWritten, int64(pcb.size))
+		}
+		return true
+	}
+}
+
+// tryWritev writes the buffers of a vector write from the offset of bytes written
+func (w *watcher) tryWritev(fd int, pcb *aiocb) bool {
+	for pcb.size < pcb.bufsLen {
+		// locate the buffers unwritten
+		iovecs := w.iovecs[:0]
+		offset := pcb.size
+		for _, b := range pcb.bufs {
+			if offset >= len(b) {
+				offset -= len(b)
+				continue
+			}
+			iov := syscall.Iovec{Base: &b[offset]}
+			iov.SetLen(len(b) - offset)
+			iovecs = append(iovecs, iov)
+			offset = 0
+			if len(iovecs) == maxIovecs {
+				break
+			}
+		}
+
+		nw, ew := rawWritev(fd, iovecs)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		// user buffers should not be held
+		for k := range iovecs {
+			iovecs[k].Base = nil
+		}
+		w.iovecs = iovecs
+
+		pcb.err = ew
+		if ew == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if ew == syscall.EINTR {
+			continue
+		}
+
+		if ew != nil {
+			return true
+		}
+
+		pcb.size += nw
+		atomic.AddInt64(&w.stats.bytesWritten, int64(nw))
+	}
+	return true
+}
+
+// tryAccept accepts the connections on the listener until drained, each one is delivered
+// with OpAccept, it returns true only on error, as the operation stays armed.
+func (w *watcher) tryAccept(fd int, pcb *aiocb) bool {
+	for {
+		nfd, err := rawAccept(fd)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if err == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		// the connection aborted before accepted is skipped
+		if err == syscall.EINTR || err == syscall.ECONNABORTED {
+			continue
+		}
+
+		if err != nil {
+			pcb.err = err
+			return true
+		}
+
+		res := aiocbPool.Get().(*aiocb)
+		*res = aiocb{op: OpAccept, ptr: pcb.ptr, ctx: pcb.ctx, opSeq: pcb.opSeq, idx: -1}
+		res.conn, res.err = acceptedConn(nfd)
+		atomic.AddInt64(&w.stats.pending, 1)
+		w.deliver(res)
+	}
+}
+
+// acceptedConn wraps the accepted file descriptor into a net.Conn, the descriptor is closed
+func acceptedConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// listenerConn adapts a listener to net.Conn to be watched for Accept
+type listenerConn struct {
+	ln net.Listener
+}
+
+func (c *listenerConn) Read(b []byte) (int, error)         { return 0, ErrInvalidOp }
+func (c *listenerConn) Write(b []byte) (int, error)        { return 0, ErrInvalidOp }
+func (c *listenerConn) Close() error                       { return c.ln.Close() }
+func (c *listenerConn) LocalAddr() net.Addr                { return c.ln.Addr() }
+func (c *listenerConn) RemoteAddr() net.Addr               { return nil }
+func (c *listenerConn) SetDeadline(t time.Time) error      { return nil }
+func (c *listenerConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *listenerConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// SyscallConn returns the raw connection of the listener
+func (c *listenerConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.ln.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		return nil, ErrNoRawConn
+	}
+	return sc.SyscallConn()
+}
+
+// tryReadv reads into the buffers of a vector read from the offset of bytes read,
+// until all the buffers are filled
+func (w *watcher) tryReadv(fd int, pcb *aiocb) bool {
+	for pcb.size < pcb.bufsLen {
+		// locate the buffers unfilled
+		iovecs := w.iovecs[:0]
+		offset := pcb.size
+		for _, b := range pcb.bufs {
+			if offset >= len(b) {
+				offset -= len(b)
+				continue
+			}
+			iov := syscall.Iovec{Base: &b[offset]}
+			iov.SetLen(len(b) - offset)
+			iovecs = append(iovecs, iov)
+			offset = 0
+			if len(iovecs) == maxIovecs {
+				break
+			}
+		}
+
+		nr, er := rawReadv(fd, iovecs)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		// user buffers should not be held
+		for k := range iovecs {
+			iovecs[k].Base = nil
+		}
+		w.iovecs = iovecs
+
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if er == syscall.EINTR {
+			continue
+		}
+
+		pcb.err = er
+		if er != nil {
+			return true
+		}
+
+		// proper setting of EOF
+		if nr == 0 {
+			pcb.err = io.EOF
+			return true
+		}
+
+		pcb.size += nr
+		atomic.AddInt64(&w.stats.bytesRead, int64(nr))
+		if !pcb.readFull {
+			break
+		}
+	}
+	return true
+}
+
+// writeCoalesced writes the plain writes at the head of the queue with a single writev,
+// the bytes written are distributed to the writes in order, and the writes drained fully
+// are delivered. It returns false if the socket is not writable anymore, otherwise the
+// writes left are for the ordinary path.
+func (w *watcher) writeCoalesced(ident int, desc *fdDesc) bool {
+	for {
+		iovecs := w.iovecs[:0]
+		for elem := desc.writers.Front(); elem != nil && len(iovecs) < maxIovecs; elem = elem.Next() {
+			pcb := elem.Value.(*aiocb)
+			if pcb.bufs != nil || pcb.file != nil || pcb.withFds || pcb.to != nil || pcb.op != OpWrite || pcb.ringID != 0 || pcb.ringDone {
+				break
+			}
+			iov := syscall.Iovec{Base: &pcb.buffer[pcb.size]}
+			iov.SetLen(len(pcb.buffer) - pcb.size)
+			iovecs = append(iovecs, iov)
+		}
+
+		// nothing to coalesce
+		if len(iovecs) < 2 {
+			w.iovecs = iovecs[:0]
+			return true
+		}
+
+		nw, ew := rawWritev(ident, iovecs)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		// user buffers should not be held
+		for k := range iovecs {
+			iovecs[k].Base = nil
+		}
+		w.iovecs = iovecs
+
+		if ew == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if ew == syscall.EINTR {
+			continue
+		}
+
+		// the error is reported on the head, and the
+		// others on their attempts in the ordinary path
+		if ew != nil {
+			elem := desc.writers.Front()
+			pcb := elem.Value.(*aiocb)
+			pcb.err = ew
+			w.deliver(pcb)
+			desc.writers.Remove(elem)
+			return true
+		}
+
+		atomic.AddInt64(&w.stats.bytesWritten, int64(nw))
+		for nw > 0 {
+			elem := desc.writers.Front()
+			pcb := elem.Value.(*aiocb)
+			left := len(pcb.buffer) - pcb.size
+			if nw < left {
+				pcb.size += nw
+				break
+			}
+			pcb.size += left
+			nw -= left
+			pcb.err = nil
+			w.deliver(pcb)
+			desc.writers.Remove(elem)
+		}
+	}
+}
+
+// tryReadOOB will try to read out-of-band data on aiocb and notify, EINVAL means
+// no urgent data is pending, it's waited like EAGAIN.
+func (w *watcher) tryReadOOB(fd int, pcb *aiocb) bool {
+	buf, useSwap, backBuffer := w.readBuffer(pcb)
+	for {
+		nr, _, er := syscall.Recvfrom(fd, buf, syscall.MSG_OOB)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN || er == syscall.EINVAL {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if er == syscall.EINTR {
+			continue
+		}
+
+		pcb.err = er
+		if er == nil {
+			pcb.size = nr
+			atomic.AddInt64(&w.stats.bytesRead, int64(nr))
+		}
+		break
+	}
+
+	if useSwap {
+		pcb.useSwap = true
+		pcb.buffer = buf[:pcb.size]
+		w.bufferOffset += pcb.size
+	} else if backBuffer {
+		pcb.buffer = buf[:pcb.size]
+	}
+	return true
+}
+
+// trySendOOB writes the buffer as out-of-band data, the bytes before the last one are
+// sent as ordinary data, and only the last byte with MSG_OOB, so a short write never
+// marks the last byte of a partial chunk as urgent.
+func (w *watcher) trySendOOB(fd int, pcb *aiocb) bool {
+	last := len(pcb.buffer) - 1
+	for pcb.size < len(pcb.buffer) {
+		buf, flags := pcb.buffer[pcb.size:last], 0
+		if pcb.size == last {
+			buf, flags = pcb.buffer[last:], syscall.MSG_OOB
+		}
+		nw, ew := syscall.SendmsgN(fd, buf, nil, nil, flags)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		pcb.err = ew
+		if ew == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if ew == syscall.EINTR {
+			continue
+		}
+
+		if ew != nil {
+			return true
+		}
+
+		pcb.size += nw
+		atomic.AddInt64(&w.stats.bytesWritten, int64(nw))
+	}
+	return true
+}
+
+// trySplice moves data from the source to the destination through the pipe of the
+// operation, the pipe is drained to the destination before splicing more from the
+// source. It returns false if either end is not ready, and the operation is queued on
+// the readers of the source or the writers of the destination, waiting for readiness.
+func (w *watcher) trySplice(pcb *aiocb) bool {
+	src, ok := w.connIdents[pcb.ptr]
+	if !ok {
+		pcb.err = ErrConnClosed
+		return true
+	}
+	dst, ok := w.connIdents[pcb.dstPtr]
+	if !ok {
+		pcb.err = ErrConnClosed
+		return true
+	}
+
+	for {
+		for pcb.inPipe > 0 {
+			nw, ew := rawSplice(pcb.pipe[0], dst, pcb.inPipe)
+			atomic.AddInt64(&w.stats.syscalls, 1)
+			if ew == syscall.EAGAIN {
+				atomic.AddInt64(&w.stats.retries, 1)
+				w.waitSplice(pcb, dst, &w.descs[dst].writers, false, src, EV_READ)
+				return false
+			}
+
+			if ew == syscall.EINTR {
+				continue
+			}
+
+			if ew != nil {
+				pcb.err = ew
+				return true
+			}
+
+			pcb.inPipe -= nw
+			pcb.size += nw
+			atomic.AddInt64(&w.stats.bytesWritten, int64(nw))
+		}
+
+		n := maxSpliceSize
+		if pcb.count > 0 {
+			if remain := pcb.count - int64(pcb.size); remain == 0 {
+				return true
+			} else if remain < int64(n) {
+				n = int(remain)
+			}
+		}
+
+		nr, er := rawSplice(src, pcb.pipe[1], n)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		if er == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			w.waitSplice(pcb, src, &w.descs[src].readers, true, dst, EV_WRITE)
+			return false
+		}
 
-		// On MacOS we can see EINTR here if the user
-		// pressed ^Z.
 		if er == syscall.EINTR {
 			continue
 		}
 
-		// if er is nil, accumulate bytes read
-		if er == nil {
-			pcb.size += nr
+		if er != nil {
+			pcb.err = er
+			return true
 		}
 
-		pcb.err = er
-		// proper setting of EOF
-		if nr == 0 && er == nil {
+		// the pipe is empty here
+		if nr == 0 {
 			pcb.err = io.EOF
+			return true
 		}
 
-		break
+		pcb.inPipe += nr
+		atomic.AddInt64(&w.stats.bytesRead, int64(nr))
 	}
+}
 
-	if pcb.readFull { // read full operation
-		if pcb.err != nil {
+// waitSplice queues the splice operation on the list 'l' of 'ident' to wait for readiness, it's
+// moved from the list of the other end 'prev' if it was there, and returns to the front of the
+// source readers, as it was the oldest read there.
+func (w *watcher) waitSplice(pcb *aiocb, ident int, l *list.List, front bool, prev int, prevEv int) {
+	if pcb.l == l {
+		return
+	}
+
+	if pcb.l != nil {
+		pcb.l.Remove(pcb.elem)
+		// the operations behind will not get the edge again
+		if pcb.l.Len() > 0 {
+			w.requeue(prev, prevEv)
+		}
+	}
+
+	pcb.l = l
+	if front {
+		pcb.elem = l.PushFront(pcb)
+	} else {
+		pcb.elem = l.PushBack(pcb)
+	}
+	w.markDirty(ident)
+}
+
+// closePipe closes the pipe of a splice operation
+func (pcb *aiocb) closePipe() {
+	syscall.Close(pcb.pipe[0])
+	syscall.Close(pcb.pipe[1])
+}
+
+// trySendmsg writes the buffer along with the file descriptors in SCM_RIGHTS
+// ancillary data, the descriptors are sent with the first chunk written.
+func (w *watcher) trySendmsg(fd int, pcb *aiocb) bool {
+	for pcb.size < len(pcb.buffer) {
+		var oob []byte
+		if pcb.size == 0 {
+			oob = syscall.UnixRights(pcb.fds...)
+		}
+
+		nw, ew := syscall.SendmsgN(fd, pcb.buffer[pcb.size:], oob, nil, 0)
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		pcb.err = ew
+		if ew == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if ew == syscall.EINTR {
+			continue
+		}
+
+		if ew != nil {
 			return true
 		}
-		if pcb.size == len(pcb.buffer) {
+
+		pcb.size += nw
+		atomic.AddInt64(&w.stats.bytesWritten, int64(nw))
+	}
+	return true
+}
+
+// trySendfile transfers the file region of a sendfile request from the offset of bytes written
+func (w *watcher) trySendfile(fd int, pcb *aiocb) bool {
+	for int64(pcb.size) < pcb.count {
+		n := pcb.count - int64(pcb.size)
+		if n > maxSendfileSize {
+			n = maxSendfileSize
+		}
+
+		nw, ew := rawSendfile(fd, pcb.fileFd, pcb.offset+int64(pcb.size), int(n))
+		atomic.AddInt64(&w.stats.syscalls, 1)
+		// some platforms report bytes written along with EAGAIN
+		if nw > 0 {
+			pcb.size += nw
+			atomic.AddInt64(&w.stats.bytesWritten, int64(nw))
+		}
+
+		pcb.err = ew
+		if ew == syscall.EAGAIN {
+			atomic.AddInt64(&w.stats.retries, 1)
+			return false
+		}
+
+		if ew == syscall.EINTR {
+			continue
+		}
+
+		if ew != nil {
 			return true
 		}
-		return false
+
+		// file ends before count
+		if nw == 0 {
+			pcb.err = io.ErrUnexpectedEOF
+			return true
+		}
+	}
+	return true
+}
+
+// progressDeadline recomputes the deadline of a partially completed operation
+func (w *watcher) progressDeadline(pcb *aiocb) {
+	if pcb.deadlineFunc != nil {
+		w.enterCallback()
+		deadline := pcb.deadlineFunc(pcb.size)
+		w.exitCallback()
+		w.setDeadline(pcb, deadline)
+	}
+}
+
+// setDeadline updates the deadline of an operation, and keeps the timeout heap
+// consistent if the operation has been queued.
+func (w *watcher) setDeadline(pcb *aiocb, deadline time.Time) {
+	pcb.deadline = deadline
+	if pcb.l == nil { // not queued yet, heap will be updated on queueing
+		return
+	}
+
+	if pcb.idx == -1 {
+		if deadline.IsZero() {
+			return
+		}
+		w.timeouts.push(pcb)
+	} else if deadline.IsZero() {
+		w.timeouts.remove(pcb)
+		return
+	} else {
+		w.timeouts.fix(pcb)
+	}
+
+	w.armTimer()
+}
+
+// armTimer arms the timer for the earliest deadline in the heap, the timer is only
+// reset when the deadline is strictly earlier than the one it's armed for, a timer
+// armed too early wakes up the loop to re-arm it, which is cheaper than resetting
+// it on every push.
+func (w *watcher) armTimer() {
+	if w.timeouts.Len() == 0 {
+		return
+	}
+
+	deadline := w.timeouts[0].deadline
+	if g := atomic.LoadInt64(&w.timerGranularity); g > 0 {
+		// round up to the next tick
+		if rem := deadline.UnixNano() % g; rem != 0 {
+			deadline = deadline.Add(time.Duration(g - rem))
+		}
+	}
+
+	if w.timerDeadline.IsZero() || deadline.Before(w.timerDeadline) {
+		w.timer.Reset(time.Until(deadline))
+		w.timerDeadline = deadline
+		atomic.AddInt64(&w.stats.timerResets, 1)
+	}
+}
+
+// requeue schedules a synthetic event for 'ident' in next round of the loop,
+// for operations yielded before the socket was drained, as edge-triggered
+// poller will not report the remaining data again.
+func (w *watcher) requeue(ident int, ev int) {
+	w.requeued = append(w.requeued, event{ident: ident, ev: ev})
+	select {
+	case w.chRequeue <- struct{}{}:
+	default:
+	}
+}
+
+// flushCloseWrite shuts down the write direction of 'ident' if requested by
+// CloseWrite, and no writes are queued.
+func (w *watcher) flushCloseWrite(ident int, desc *fdDesc) {
+	if desc.closeWrite && desc.writers.Len() == 0 {
+		desc.closeWrite = false
+		retryOnEINTR(func() error { return syscall.Shutdown(ident, syscall.SHUT_WR) })
+	}
+}
+
+// release connection related resources
+func (w *watcher) releaseConn(ident int) {
+	if desc, ok := w.descs[ident]; ok {
+		// delete from heap
+		for _, l := range []*list.List{&desc.readers, &desc.writers, &desc.oobReaders} {
+			for e := l.Front(); e != nil; e = e.Next() {
+				tcb := e.Value.(*aiocb)
+				if tcb.idx != -1 {
+					w.timeouts.remove(tcb)
+				}
+				if tcb.done != nil {
+					close(tcb.done)
+				}
+				// the buffer in flight on io_uring is left to gc after its completion
+				if tcb.ringID != 0 {
+					w.cancelRing(tcb, true)
+				} else if tcb.pooled || tcb.op == OpWrite || tcb.op == OpWriteOOB {
+					w.recycleBuffer(tcb)
+				}
+				if tcb.op == OpSplice {
+					tcb.closePipe()
+				}
+				w.releaseMem(tcb)
+				atomic.AddInt64(&w.stats.pending, -1)
+			}
+		}
+
+		delete(w.descs, ident)
+		delete(w.connIdents, desc.ptr)
+		delete(w.idleIdents, ident)
+		delete(w.throttledIdents, ident)
+		delete(w.sockErrs, ident)
+		atomic.AddInt32(&w.stats.conns, -1)
+		// close socket file descriptor duplicated from net.Conn, the
+		// borrowed one is left to the conn, and removed from the poller.
+		if desc.borrowed {
+			w.pfd.Unwatch(ident)
+		} else if !desc.detached {
+			syscall.Close(ident)
+		}
+	}
+}
+
+// deliver function will try best to aggregate results for batch delivery
+func (w *watcher) deliver(pcb *aiocb) {
+	if pcb.idx != -1 {
+		w.timeouts.remove(pcb)
+	}
+	// in flight on io_uring, delivered on completion once canceled
+	if w.ring != nil && w.ringPending(pcb) {
+		return
+	}
+	if pcb.done != nil {
+		close(pcb.done)
+	}
+	w.releaseMem(pcb)
+	atomic.AddInt64(&w.stats.pending, -1)
+	if pcb.op == OpSplice {
+		pcb.closePipe()
+	}
+	if pcb.err != nil {
+		pcb.err = connError(pcb.err)
+	}
+
+	if ident, ok := w.connIdents[pcb.ptr]; ok {
+		pcb.fd = ident
+		if pcb.op == OpRead && pcb.err == nil && atomic.LoadInt32(&w.reportPending) == 1 {
+			pcb.pending, _ = rawFionread(ident)
+		}
+		if pcb.err == nil && pcb.op != OpIdle {
+			w.descs[ident].lastActive = time.Now()
+		}
+	} else {
+		pcb.fd = -1
+	}
+
+	atomic.AddInt64(&w.stats.completions, 1)
+	switch pcb.op {
+	case OpRead, OpReadOOB:
+		atomic.AddInt64(&w.stats.reads, 1)
+	case OpWrite, OpWriteOOB:
+		atomic.AddInt64(&w.stats.writes, 1)
+		w.recycleBuffer(pcb)
+	}
+
+	// blocking operation of Conn
+	if pcb.notify != nil {
+		pcb.notify <- pcb.result()
+		aiocbPool.Put(pcb)
+		return
+	}
+
+	w.deliverSeq++
+	pcb.seq = w.deliverSeq
+	w.queueOf(pcb.fd).lastSeq = pcb.seq
+	w.windowCount++
+	if pcb.useSwap {
+		w.swapSeq[w.swapIdx] = pcb.seq
+		w.trackSwapRead(pcb.seq, pcb.size)
+	}
+
+	if w.batching {
+		w.batched = append(w.batched, pcb)
+		return
+	}
+
+	w.sendResults(w.queueOf(pcb.fd), pcb, 1)
+}
+
+// queueOf returns the result queue of the shard of 'fd', the results without a
+// watched fd go to shard 0.
+func (w *watcher) queueOf(fd int) *resultQueue {
+	if fd <= 0 || len(w.queues) == 1 {
+		return w.queues[0]
+	}
+	return w.queues[fd%len(w.queues)]
+}
+
+// sendResults sends a batch of 'n' completions chained from 'head' to WaitIO with a
+// single wakeup, the loop blocks if the results are not consumed in time, which is
+// counted and reported as backpressure.
+func (w *watcher) sendResults(q *resultQueue, head *aiocb, n int) {
+	if atomic.LoadInt64(&q.queued) >= int64(cap(q.chResults)) {
+		atomic.AddInt64(&w.stats.backpressure, 1)
+		if w.onBackpressure != nil {
+			// the callback runs on its own goroutine, dropped if it's busy
+			select {
+			case w.chBackpressure <- int(atomic.LoadInt64(&q.queued)):
+			default:
+			}
+		}
+
+		for atomic.LoadInt64(&q.queued) >= int64(cap(q.chResults)) {
+			select {
+			case <-q.chConsumed:
+			case <-w.die:
+				return
+			}
+		}
+	}
+
+	// every batch has at least one result, the channel never blocks under the bound
+	atomic.AddInt64(&q.queued, int64(n))
+	select {
+	case q.chResults <- head:
+	case <-w.die:
+	}
+}
+
+// reportBackpressure calls the backpressure callback, apart from the loop
+func (w *watcher) reportBackpressure() {
+	for {
+		select {
+		case waiting := <-w.chBackpressure:
+			w.onBackpressure(waiting)
+		case <-w.die:
+			return
+		}
+	}
+}
+
+// checkIdle delivers OpIdle for the descriptors idle beyond their idle timeout
+func (w *watcher) checkIdle() {
+	now := time.Now()
+	for ident := range w.idleIdents {
+		desc := w.descs[ident]
+		if now.Sub(desc.lastActive) >= desc.idleTimeout {
+			desc.lastActive = now
+			pcb := aiocbPool.Get().(*aiocb)
+			*pcb = aiocb{op: OpIdle, ptr: desc.ptr, conn: desc.idleConn, idx: -1}
+			pcb.laddr = desc.idleConn.LocalAddr()
+			pcb.raddr = desc.idleConn.RemoteAddr()
+			// accounted as submitted to be balanced on delivery
+			atomic.AddInt64(&w.stats.pending, 1)
+			w.deliver(pcb)
+		}
 	}
+	w.resetIdleTimer()
+}
+
+// resetIdleTimer arms the idle timer to the earliest idle expiry
+func (w *watcher) resetIdleTimer() {
+	if !w.idleTimer.Stop() {
+		select {
+		case <-w.idleTimer.C:
+		default:
+		}
+	}
+
+	var earliest time.Time
+	for ident := range w.idleIdents {
+		desc := w.descs[ident]
+		if expire := desc.lastActive.Add(desc.idleTimeout); earliest.IsZero() || expire.Before(earliest) {
+			earliest = expire
+		}
+	}
+	if !earliest.IsZero() {
+		w.idleTimer.Reset(time.Until(earliest))
+	}
+}
+
+// refill adds the tokens accumulated since last refill to the bucket of 'desc',
+// bounded to the burst of one second.
+func (desc *fdDesc) refill(now time.Time) {
+	n := int64(now.Sub(desc.lastRefill)) * int64(desc.rate) / int64(time.Second)
+	if desc.tokens+int(n) >= desc.rate {
+		desc.tokens = desc.rate
+		desc.lastRefill = now
+		return
+	}
+	// the time of fractional tokens is carried over
+	desc.tokens += int(n)
+	desc.lastRefill = desc.lastRefill.Add(time.Duration(n * int64(time.Second) / int64(desc.rate)))
+}
+
+// limit sets the quota of the IO about to be tried on 'desc'
+func (w *watcher) limit(desc *fdDesc) {
+	w.limited = desc.rate > 0
+	w.quota = desc.tokens
+}
+
+// spend charges 'n' bytes transferred to the bucket of 'desc'
+func (w *watcher) spend(desc *fdDesc, n int) {
+	if desc.rate > 0 {
+		desc.tokens -= n
+	}
+}
+
+// throttle defers the events 'ev' on 'ident' till its tokens refill, the socket
+// is not drained, the events are requeued when the rate timer fires.
+func (w *watcher) throttle(ident int, desc *fdDesc, ev int) {
+	if desc.throttled&ev == ev {
+		return
+	}
+	desc.throttled |= ev
+	w.throttledIdents[ident] = struct{}{}
+	w.markDirty(ident)
+	w.resetRateTimer()
+}
+
+// unthrottle resumes the throttled descriptors whose tokens have refilled
+func (w *watcher) unthrottle() {
+	now := time.Now()
+	for ident := range w.throttledIdents {
+		desc := w.descs[ident]
+		desc.refill(now)
+		if desc.tokens > 0 {
+			w.requeue(ident, desc.throttled)
+			desc.throttled = 0
+			delete(w.throttledIdents, ident)
+			w.markDirty(ident)
+		}
+	}
+	w.resetRateTimer()
+}
+
+// resetRateTimer arms the rate timer to the earliest refill of the throttled
+// descriptors, they are resumed with tokens of at least 10ms to avoid tiny IOs.
+func (w *watcher) resetRateTimer() {
+	if !w.rateTimer.Stop() {
+		select {
+		case <-w.rateTimer.C:
+		default:
+		}
+	}
+
+	var earliest time.Time
+	for ident := range w.throttledIdents {
+		desc := w.descs[ident]
+		need := int64(desc.rate/100 + 1 - desc.tokens)
+		refill := desc.lastRefill.Add(time.Duration(need * int64(time.Second) / int64(desc.rate)))
+		if earliest.IsZero() || refill.Before(earliest) {
+			earliest = refill
+		}
+	}
+	if !earliest.IsZero() {
+		w.rateTimer.Reset(time.Until(earliest))
+	}
+}
+
+// markDirty marks the queues of 'ident' have changed, the interest of events
+// on it will be updated at the end of a loop round in level-triggered mode.
+func (w *watcher) markDirty(ident int) {
+	if w.pfd.levelTriggered {
+		w.dirty = append(w.dirty, ident)
+	}
+}
+
+// updateInterests updates the interest of events on the descriptors changed in
+// level-triggered mode, a descriptor is interested in reading or writing only
+// if there are operations queued, to avoid the events being reported repeatedly.
+func (w *watcher) updateInterests() {
+	for _, ident := range w.dirty {
+		desc, ok := w.descs[ident]
+		if !ok {
+			continue
+		}
+
+		var interest int
+		if desc.readers.Len() > 0 && !desc.readers.Front().Value.(*aiocb).parked && desc.throttled&EV_READ == 0 {
+			interest |= EV_READ
+		}
+		if desc.writers.Len() > 0 && desc.throttled&EV_WRITE == 0 {
+			interest |= EV_WRITE
+		}
+		if desc.oobReaders.Len() > 0 {
+			interest |= EV_OOB
+		}
+
+		if interest != desc.interest {
+			if err := w.pfd.Interest(ident, desc.interest, interest); err == nil {
+				desc.interest = interest
+			}
+		}
+	}
+	w.dirty = w.dirty[:0]
+}
+
+// flushBatched delivers the coalesced completions at the end of a loop round,
+// and adjusts the notification mode by completion rate.
+func (w *watcher) flushBatched() {
+	// the completions of this round are delivered in one batch
+	if n := len(w.batched); n > 0 && len(w.queues) == 1 {
+		for i := 0; i < n-1; i++ {
+			w.batched[i].next = w.batched[i+1]
+		}
+		w.sendResults(w.queues[0], w.batched[0], n)
+	} else if n > 0 {
+		// one batch per shard, all chained before any is sent, as the results
+		// sent belong to the consumer of the shard
+		for _, pcb := range w.batched {
+			q := w.queueOf(pcb.fd)
+			if q.batchHead == nil {
+				q.batchHead = pcb
+			} else {
+				q.batchTail.next = pcb
+			}
+			q.batchTail = pcb
+			q.batchLen++
+		}
+		for _, q := range w.queues {
+			if q.batchHead != nil {
+				head, count := q.batchHead, q.batchLen
+				q.batchHead, q.batchTail, q.batchLen = nil, nil, 0
+				w.sendResults(q, head, count)
+			}
+		}
+	}
+	for i := range w.batched {
+		w.batched[i] = nil
+	}
+	w.batched = w.batched[:0]
+
+	now := time.Now()
+	if elapsed := now.Sub(w.windowStart); elapsed >= adaptiveWindow {
+		if w.batching {
+			w.batching = w.windowCount >= adaptiveThreshold/2
+		} else {
+			w.batching = w.windowCount >= adaptiveThreshold
+		}
+
+		if w.batching {
+			atomic.StoreInt32(&w.stats.batching, 1)
+		} else {
+			atomic.StoreInt32(&w.stats.batching, 0)
+		}
 
-	if useSwap { // IO completed with internal buffer
-		pcb.useSwap = true
-		pcb.buffer = buf[:pcb.size] // set len to pcb.size
-		w.bufferOffset += pcb.size
-	} else if backBuffer { // internal buffer exhausted
-		pcb.buffer = buf
+		w.windowStart = now
+		w.windowCount = 0
 	}
-	return true
 }
 
-func (w *watcher) tryWrite(fd int, pcb *aiocb) bool {
-	var nw int
-	var ew error
-
-	if pcb.buffer != nil {
-		for {
-			nw, ew = rawWrite(fd, pcb.buffer[pcb.size:])
-			pcb.err = ew
-			if ew == syscall.EAGAIN {
-				return false
-			}
+// rearmPersist delivers a copy of the result of a completed persistent read,
+// and resets it for next read, returns false if the read has completed with
+// error and should be delivered and removed as usual.
+func (w *watcher) rearmPersist(ident int, pcb *aiocb) bool {
+	if !pcb.persist || pcb.err != nil {
+		return false
+	}
 
-			if ew == syscall.EINTR {
-				continue
-			}
+	res := aiocbPool.Get().(*aiocb)
+	*res = *pcb
+	res.l = nil
+	res.elem = nil
+	res.idx = -1
+	res.charge = 0 // persistent buffer is charged until the read is removed
+	res.track = nil
+	atomic.AddInt64(&w.stats.pending, 1)
+	w.deliver(res)
 
-			// if ew is nil, accumulate bytes written
-			if ew == nil {
-				pcb.size += nw
-			}
-			break
+	pcb.size = 0
+	pcb.useSwap = false
+	pcb.buffer = pcb.persistBuf
+	if pcb.pooled {
+		if w.getBuffer != nil {
+			w.enterCallback()
+			pcb.buffer = w.getBuffer(w.swapSize)
+			w.exitCallback()
+		} else {
+			pcb.pooled = false
 		}
 	}
 
-	// all bytes written or has error
-	// nil buffer still returns
-	if pcb.size == len(pcb.buffer) || ew != nil {
-		return true
+	// user buffer cannot be reused until the result is acknowledged
+	if pcb.persistBuf != nil {
+		pcb.parked = true
+		pcb.parkSeq = w.deliverSeq
+		w.parkedIdents = append(w.parkedIdents, ident)
+		atomic.StoreInt32(&w.numParked, int32(len(w.parkedIdents)))
 	}
-	return false
+	return true
 }
 
-// release connection related resources
-func (w *watcher) releaseConn(ident int) {
-	if desc, ok := w.descs[ident]; ok {
-		// delete from heap
-		for e := desc.readers.Front(); e != nil; e = e.Next() {
-			tcb := e.Value.(*aiocb)
-			if !tcb.deadline.IsZero() {
-				heap.Remove(&w.timeouts, tcb.idx)
-			}
+// unpark resumes persistent reads whose last result has been acknowledged
+func (w *watcher) unpark() {
+	parked := w.parkedIdents[:0]
+	for _, ident := range w.parkedIdents {
+		desc, ok := w.descs[ident]
+		if !ok || desc.readers.Len() == 0 {
+			continue
 		}
 
-		for e := desc.writers.Front(); e != nil; e = e.Next() {
-			tcb := e.Value.(*aiocb)
-			if !tcb.deadline.IsZero() {
-				heap.Remove(&w.timeouts, tcb.idx)
-			}
+		pcb := desc.readers.Front().Value.(*aiocb)
+		if !pcb.parked {
+			continue
 		}
 
-		delete(w.descs, ident)
-		delete(w.connIdents, desc.ptr)
-		// close socket file descriptor duplicated from net.Conn
-		syscall.Close(ident)
+		if pcb.parkSeq <= atomic.LoadUint64(&w.queueOf(ident).acked) {
+			pcb.parked = false
+			w.requeue(ident, EV_READ)
+		} else {
+			parked = append(parked, ident)
+		}
 	}
+	w.parkedIdents = parked
+	atomic.StoreInt32(&w.numParked, int32(len(w.parkedIdents)))
 }
 
-// deliver function will try best to aggregate results for batch delivery
-func (w *watcher) deliver(pcb *aiocb) {
-	if pcb.idx != -1 {
-		heap.Remove(&w.timeouts, pcb.idx)
+// cancelContext removes and delivers all pending operations with context ctx
+func (w *watcher) cancelContext(ctx interface{}) {
+	match := func(pcb *aiocb) bool { return pcb.ctx == ctx }
+	for ident, desc := range w.descs {
+		w.cancelDesc(ident, desc, match, ErrCanceled)
 	}
+}
 
-	select {
-	case w.chResults <- pcb:
-	case <-w.die:
+// cancelDesc cancels the operations matched in all queues of the descriptor
+func (w *watcher) cancelDesc(ident int, desc *fdDesc, match func(*aiocb) bool, cause error) {
+	w.cancelOps(ident, &desc.readers, EV_READ, match, cause)
+	w.cancelOps(ident, &desc.writers, EV_WRITE, match, cause)
+	w.cancelOps(ident, &desc.oobReaders, EV_OOB, match, cause)
+}
+
+// cancelOps removes and delivers the operations matched in list 'l' of 'ident'
+// with 'cause'.
+func (w *watcher) cancelOps(ident int, l *list.List, ev int, match func(*aiocb) bool, cause error) {
+	var next *list.Element
+	var cancelled bool
+	for elem := l.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		pcb := elem.Value.(*aiocb)
+		if match(pcb) {
+			l.Remove(elem)
+			pcb.err = cause
+			w.deliver(pcb)
+			cancelled = true
+		}
+	}
+
+	// the operations behind may be ready already, as the
+	// poller is edge-triggered, retry them explicitly.
+	if cancelled && l.Len() > 0 {
+		w.requeue(ident, ev)
+	}
+	if cancelled {
+		w.markDirty(ident)
+		if ev == EV_WRITE {
+			w.flushCloseWrite(ident, w.descs[ident])
+		}
 	}
 }
 
@@ -400,8 +4235,12 @@ func (w *watcher) loop() {
 		for ident := range w.descs {
 			w.releaseConn(ident)
 		}
+		if w.ring != nil {
+			w.closeRing()
+		}
 	}()
 
+	w.loopGoid = goid()
 	var reqs []*aiocb
 	for {
 		select {
@@ -416,32 +4255,60 @@ func (w *watcher) loop() {
 		case pe := <-w.chEventNotify: // poller events
 			w.handleEvents(pe)
 
+		case <-w.chRequeue: // synthetic events
+			pe := w.requeued
+			w.requeued = w.requeuedProcessing[:0]
+			w.requeuedProcessing = pe
+			w.handleEvents(pe)
+
+		case <-w.chUnpark: // results acknowledged
+			w.unpark()
+
 		case <-w.timer.C: // timeout heap
+			w.timerDeadline = time.Time{}
+			now := time.Now()
 			for w.timeouts.Len() > 0 {
-				now := time.Now()
 				pcb := w.timeouts[0]
-				if now.After(pcb.deadline) {
-					// ErrDeadline
+				w.timeouts.check(pcb)
+				if !now.Before(pcb.deadline) {
+					// ErrDeadline, the bytes read so far remain valid in Buffer[:Size],
+					// reads on the internal buffer never keep partial data across
+					// events, so the swap buffer is not touched here.
 					pcb.err = ErrDeadline
+					if pcb.ctxDeadline {
+						pcb.err = context.DeadlineExceeded
+					}
+					atomic.AddInt64(&w.stats.timeouts, 1)
 					// remove from list
-					pcb.l.Remove(pcb.elem)
+					l := pcb.l
+					l.Remove(pcb.elem)
+					ident := w.connIdents[pcb.ptr]
+					w.markDirty(ident)
 					w.deliver(pcb)
+					if desc, ok := w.descs[ident]; ok && l == &desc.writers {
+						w.flushCloseWrite(ident, desc)
+					}
 				} else {
-					w.timer.Reset(pcb.deadline.Sub(now))
 					break
 				}
 			}
+			w.armTimer()
+
+		case <-w.idleTimer.C: // idle connections
+			w.checkIdle()
+
+		case <-w.rateTimer.C: // rate-limited connections
+			w.unthrottle()
 
 		case <-w.gcNotify: // gc recycled net.Conn
 			w.gcMutex.Lock()
-			for i, c := range w.gc {
-				ptr := reflect.ValueOf(c).Pointer()
+			for _, ptr := range w.gc {
 				if ident, ok := w.connIdents[ptr]; ok {
 					// since it's gc-ed, queue is impossible to hold net.Conn
 					// we don't have to send to chIOCompletion,just release here
 					w.releaseConn(ident)
 				}
-				w.gc[i] = nil
+				delete(w.freed, ptr)
 			}
 			w.gc = w.gc[:0]
 			w.gcMutex.Unlock()
@@ -449,72 +4316,263 @@ func (w *watcher) loop() {
 		case cpuid := <-w.chCPUID:
 			setAffinity(cpuid)
 
+		case f := <-w.chCommand:
+			// requests submitted before the command take effect first
+			for len(w.chPending) > 0 {
+				reqs = append(reqs, <-w.chPending)
+			}
+			w.handlePending(reqs)
+			reqs = reqs[:0]
+			f()
+
 		case <-w.die:
 			return
 		}
+
+		// requests submitted from the callbacks in this round
+		for reentrant := w.takeReentrant(); len(reentrant) > 0; reentrant = w.takeReentrant() {
+			w.handlePending(reentrant)
+		}
+
+		if w.ring != nil {
+			w.flushRing()
+		}
+		w.flushBatched()
+		w.updateInterests()
 	}
 }
 
 // for loop handling pending requests
 func (w *watcher) handlePending(pending []*aiocb) {
 	for _, pcb := range pending {
+		if pcb.op == opBatch {
+			w.handlePending(pcb.batch)
+			aiocbPool.Put(pcb)
+			continue
+		}
+
+		if pcb.op == opCancelContext {
+			w.cancelContext(pcb.ctx)
+			aiocbPool.Put(pcb)
+			continue
+		}
+
 		ident, ok := w.connIdents[pcb.ptr]
-		// resource releasing operation
-		if pcb.op == opDelete && ok {
-			w.releaseConn(ident)
+		// resource releasing operation, nothing to release on an unknown conn
+		if pcb.op == opDelete {
+			// pending operations are returned to the user before the conn is
+			// released, the gc-ed conns are released silently in loop.
+			if ok {
+				all := func(*aiocb) bool { return true }
+				w.cancelDesc(ident, w.descs[ident], all, ErrConnClosed)
+				borrowed := w.descs[ident].borrowed
+				w.releaseConn(ident)
+				if !borrowed {
+					w.freed[pcb.ptr] = nil
+				}
+			}
+			atomic.AddInt64(&w.stats.pending, -1)
+			aiocbPool.Put(pcb)
+			continue
+		}
+
+		// deadline modification on the oldest operation, the type of
+		// operation is carried in ctx.
+		if pcb.op == opSetDeadline {
+			if ok {
+				desc := w.descs[ident]
+				l := &desc.readers
+				if pcb.ctx.(OpType) == OpWrite {
+					l = &desc.writers
+				}
+				if l.Len() > 0 {
+					tcb := l.Front().Value.(*aiocb)
+					tcb.ctxDeadline = false
+					w.setDeadline(tcb, pcb.deadline)
+				}
+			}
+			atomic.AddInt64(&w.stats.pending, -1)
+			aiocbPool.Put(pcb)
+			continue
+		}
+
+		// cancelling operation, nothing to cancel on an unknown conn
+		if pcb.op == opCancel {
+			if ok {
+				desc := w.descs[ident]
+				all := func(*aiocb) bool { return true }
+				w.cancelDesc(ident, desc, all, ErrCanceled)
+			}
+			atomic.AddInt64(&w.stats.pending, -1)
+			aiocbPool.Put(pcb)
+			continue
+		}
+
+		// cancelling an operation by context.Context, the operation is identified
+		// by its done channel carried in ctx, nothing happens if it has settled.
+		if pcb.op == opCancelOp {
+			if ok {
+				desc := w.descs[ident]
+				done := pcb.ctx.(chan struct{})
+				match := func(tcb *aiocb) bool { return tcb.done == done }
+				w.cancelDesc(ident, desc, match, pcb.err)
+			}
+			aiocbPool.Put(pcb)
 			continue
 		}
 
-		// handling new connection
+		// handling new connection, the operations racing with Free are
+		// processed after it, and fail as the conn has been closed.
 		var desc *fdDesc
 		if ok {
 			desc = w.descs[ident]
+		} else if cause, freed := w.freed[pcb.ptr]; freed {
+			pcb.err = ErrConnClosed
+			if cause != nil {
+				pcb.err = cause
+			}
+			w.deliver(pcb)
+			continue
 		} else {
-			if dupfd, err := dupconn(pcb.conn); err != nil {
+			var err error
+			if ident, desc, err = w.watch(pcb.conn, pcb.ptr); err != nil {
 				pcb.err = err
 				w.deliver(pcb)
 				continue
+			}
+		}
+
+		// idle timeout of the conn, carried in ctx
+		if pcb.op == opSetIdle {
+			desc.idleTimeout = pcb.ctx.(time.Duration)
+			if desc.idleTimeout > 0 {
+				desc.lastActive = time.Now()
+				desc.idleConn = pcb.conn
+				w.idleIdents[ident] = struct{}{}
+			} else {
+				desc.idleConn = nil
+				delete(w.idleIdents, ident)
+			}
+			w.resetIdleTimer()
+			atomic.AddInt64(&w.stats.pending, -1)
+			aiocbPool.Put(pcb)
+			continue
+		}
+
+		// shutdown of a direction, carried in ctx, the write direction
+		// is shut down after the writes queued are flushed.
+		if pcb.op == opShutdown {
+			if how := pcb.ctx.(int); how == syscall.SHUT_RD {
+				retryOnEINTR(func() error { return syscall.Shutdown(ident, how) })
+				w.requeue(ident, EV_READ)
 			} else {
-				// as we duplicated successfully, we're safe to
-				// close the original connection
-				pcb.conn.Close()
-				// assign idents
-				ident = dupfd
-
-				// unexpected situation, should notify caller if we cannot dup(2)
-				werr := w.pfd.Watch(ident)
-				if werr != nil {
-					pcb.err = werr
+				desc.closeWrite = true
+				w.flushCloseWrite(ident, desc)
+			}
+			atomic.AddInt64(&w.stats.pending, -1)
+			aiocbPool.Put(pcb)
+			continue
+		}
+
+		// liveness check, ahead of the operations queued
+		if pcb.op == OpProbe {
+			w.probe(ident, desc, pcb)
+			w.deliver(pcb)
+			continue
+		}
+
+		// byte-rate limit of the conn, carried in ctx, starts with a full bucket
+		if pcb.op == opSetRate {
+			desc.rate = pcb.ctx.(int)
+			desc.tokens = desc.rate
+			desc.lastRefill = time.Now()
+			if desc.rate <= 0 {
+				desc.rate = 0
+			}
+			if desc.throttled != 0 {
+				w.requeue(ident, desc.throttled)
+				desc.throttled = 0
+				delete(w.throttledIdents, ident)
+				w.markDirty(ident)
+				w.resetRateTimer()
+			}
+			atomic.AddInt64(&w.stats.pending, -1)
+			aiocbPool.Put(pcb)
+			continue
+		}
+
+		// fds can only be passed over unix domain sockets
+		if pcb.withFds && !desc.unix {
+			pcb.err = ErrSocketType
+			w.deliver(pcb)
+			continue
+		}
+
+		// the destination of splice is watched like the source
+		if pcb.op == OpSplice {
+			if _, ok := w.connIdents[pcb.dstPtr]; !ok {
+				if _, _, err := w.watch(pcb.dstConn, pcb.dstPtr); err != nil {
+					pcb.err = err
 					w.deliver(pcb)
 					continue
 				}
-
-				// file description bindings
-				desc = &fdDesc{ptr: pcb.ptr}
-				w.descs[ident] = desc
-				w.connIdents[pcb.ptr] = ident
-
-				// the conn is still useful for GC finalizer.
-				// note finalizer function cannot hold reference to net.Conn,
-				// if not it will never be GC-ed.
-				runtime.SetFinalizer(pcb.conn, func(c net.Conn) {
-					w.gcMutex.Lock()
-					w.gc = append(w.gc, c)
-					w.gcMutex.Unlock()
-
-					// notify gc processor
-					select {
-					case w.gcNotify <- struct{}{}:
-					default:
-					}
-				})
 			}
 		}
 
+		// reads on nil buffer take one from the pool
+		if pcb.buffer == nil && !pcb.readable && w.getBuffer != nil && (pcb.op == OpRead || pcb.op == OpReadOOB) {
+			w.enterCallback()
+			pcb.buffer = w.getBuffer(w.swapSize)
+			w.exitCallback()
+			pcb.pooled = true
+		}
+
 		// operations splitted into different buckets
-		if pcb.op == OpRead {
-			// try immediately queue is empty
+		if pcb.op == OpAccept {
+			// accepts the connections pending, and stays armed
+			if desc.readers.Len() == 0 {
+				if w.tryAccept(ident, pcb) {
+					w.deliver(pcb)
+					continue
+				}
+			}
+			pcb.l = &desc.readers
+			pcb.elem = pcb.l.PushBack(pcb)
+			w.markDirty(ident)
+		} else if pcb.op == OpConnect {
+			// completes once writable, the adapter is released then
+			if w.tryConnect(ident, pcb) {
+				w.deliver(pcb)
+				w.releaseConnect(ident)
+				continue
+			}
+			pcb.l = &desc.writers
+			pcb.elem = pcb.l.PushBack(pcb)
+			w.markDirty(ident)
+		} else if pcb.op == OpSplice {
+			// ordered with the reads on the source, queued by trySplice if not ready
 			if desc.readers.Len() == 0 {
+				if w.trySplice(pcb) {
+					w.deliver(pcb)
+					continue
+				}
+			} else {
+				w.waitSplice(pcb, ident, &desc.readers, false, ident, EV_READ)
+			}
+		} else if pcb.op == OpReadOOB {
+			if desc.oobReaders.Len() == 0 {
+				if w.tryReadOOB(ident, pcb) {
+					w.deliver(pcb)
+					continue
+				}
+			}
+			pcb.l = &desc.oobReaders
+			pcb.elem = pcb.l.PushBack(pcb)
+			w.markDirty(ident)
+		} else if pcb.op == OpRead {
+			pcb.datagram = desc.datagram
+			// try immediately queue is empty, rate-limited reads are served by events
+			if desc.readers.Len() == 0 && !pcb.persist && desc.rate == 0 {
 				if w.tryRead(ident, pcb) {
 					w.deliver(pcb)
 					continue
@@ -522,30 +4580,195 @@ func (w *watcher) handlePending(pending []*aiocb) {
 			}
 			// enqueue for poller events
 			pcb.l = &desc.readers
-			pcb.elem = pcb.l.PushBack(pcb)
+			if pcb.priority {
+				pcb.elem = pushPriority(pcb.l, pcb)
+			} else {
+				pcb.elem = pcb.l.PushBack(pcb)
+			}
+			w.markDirty(ident)
+
+			// persistent or rate-limited read starts in next round
+			if pcb.persist || desc.rate > 0 {
+				w.requeue(ident, EV_READ)
+			}
 		} else {
-			if desc.writers.Len() == 0 {
+			// writes after CloseWrite fail like on the shut down socket
+			if desc.closeWrite && pcb.op != OpFlush {
+				pcb.err = syscall.EPIPE
+				w.deliver(pcb)
+				continue
+			}
+
+			// replace the buffer of the oldest unstarted write
+			if pcb.replace && desc.writers.Len() > 0 {
+				tcb := desc.writers.Front().Value.(*aiocb)
+				if tcb.size == 0 && tcb.ringID == 0 && !tcb.ringDone && tcb.op != OpSplice && tcb.op != OpFlush {
+					w.releaseMem(tcb)
+					w.recycleBuffer(tcb)
+					tcb.track = pcb.track
+					tcb.buffer = pcb.buffer
+					tcb.bufs = pcb.bufs
+					tcb.bufsLen = pcb.bufsLen
+					tcb.op = pcb.op
+					tcb.file = pcb.file
+					tcb.withFds = pcb.withFds
+					tcb.fds = pcb.fds
+					tcb.ctx = pcb.ctx
+					tcb.charge = pcb.charge
+					atomic.AddInt64(&w.stats.pending, -1)
+					aiocbPool.Put(pcb)
+					continue
+				}
+			}
+
+			if desc.writers.Len() == 0 && desc.rate == 0 {
 				if w.tryWrite(ident, pcb) {
 					w.deliver(pcb)
 					continue
 				}
 			}
 			pcb.l = &desc.writers
-			pcb.elem = pcb.l.PushBack(pcb)
+			if pcb.priority {
+				pcb.elem = pushPriority(pcb.l, pcb)
+			} else {
+				pcb.elem = pcb.l.PushBack(pcb)
+			}
+			w.markDirty(ident)
+			if desc.rate > 0 {
+				w.requeue(ident, EV_WRITE)
+			}
+		}
+
+		if pcb.priority {
+			w.usePriority = true
 		}
 
 		// push to heap for timeout operation
 		if !pcb.deadline.IsZero() {
-			heap.Push(&w.timeouts, pcb)
-			if w.timeouts.Len() == 1 {
-				w.timer.Reset(time.Until(pcb.deadline))
-			}
+			w.timeouts.push(pcb)
+			w.armTimer()
+		}
+	}
+}
+
+// watch starts watching a new connection, the file descriptor duplicated from 'conn'
+// is registered to the poller, and the original one is closed.
+func (w *watcher) watch(conn net.Conn, ptr uintptr) (int, *fdDesc, error) {
+	if max := atomic.LoadInt32(&w.maxConns); max > 0 && len(w.descs) >= int(max) {
+		return 0, nil, ErrTooManyConns
+	}
+
+	// the socket of a connecting adapter is owned by the watcher, never borrowed
+	borrow := w.noDup
+	if _, ok := conn.(*connectConn); ok {
+		borrow = false
+	}
+
+	var ident int
+	var err error
+	if borrow {
+		ident, err = borrowfd(conn)
+	} else {
+		ident, err = dupconn(conn)
+	}
+	if err != nil {
+		// running out of fds is reported distinctly, to shed load
+		if errno, ok := err.(syscall.Errno); ok && (errno == syscall.EMFILE || errno == syscall.ENFILE) {
+			return 0, nil, &noFdsError{errno, len(w.descs)}
+		}
+		return 0, nil, err
+	}
+	// as we duplicated successfully, we're safe to
+	// close the original connection
+	laddr, raddr := conn.LocalAddr(), conn.RemoteAddr()
+	if !borrow {
+		conn.Close()
+	}
+
+	// unexpected situation, should notify caller if we cannot dup(2)
+	if err := w.pfd.Watch(ident); err != nil {
+		return 0, nil, err
+	}
+
+	// file description bindings, datagram sockets are read
+	// by datagram
+	desc := &fdDesc{ptr: ptr, laddr: laddr, raddr: raddr, lastActive: time.Now(), borrowed: borrow}
+	if sotype, err := syscall.GetsockoptInt(ident, syscall.SOL_SOCKET, syscall.SO_TYPE); err == nil && sotype == syscall.SOCK_DGRAM {
+		desc.datagram = true
+	}
+	if sa, err := syscall.Getsockname(ident); err == nil {
+		_, desc.unix = sa.(*syscall.SockaddrUnix)
+	}
+	w.descs[ident] = desc
+	w.connIdents[ptr] = ident
+	atomic.AddInt32(&w.stats.conns, 1)
+
+	// the conn is still useful for GC finalizer, the listener is for Accept.
+	// note finalizer function cannot hold reference to net.Conn,
+	// if not it will never be GC-ed.
+	var obj interface{} = conn
+	if lc, ok := conn.(*listenerConn); ok {
+		obj = lc.ln
+	}
+	if borrow {
+		// the conn is watched again after Free
+		runtime.SetFinalizer(obj, nil)
+	}
+	runtime.SetFinalizer(obj, func(interface{}) {
+		w.gcMutex.Lock()
+		w.gc = append(w.gc, ptr)
+		w.gcMutex.Unlock()
+
+		// notify gc processor
+		select {
+		case w.gcNotify <- struct{}{}:
+		default:
+		}
+	})
+	return ident, desc, nil
+}
+
+// pushPriority queues a priority operation ahead of the normal ones, behind the priority
+// ones queued earlier, and the one in progress at the head.
+func pushPriority(l *list.List, pcb *aiocb) *list.Element {
+	var mark *list.Element
+	for e := l.Front(); e != nil; e = e.Next() {
+		tcb := e.Value.(*aiocb)
+		inProgress := e == l.Front() && (tcb.size > 0 || tcb.persist || tcb.op == OpSplice || tcb.ringID != 0 || tcb.ringDone)
+		if !tcb.priority && !inProgress {
+			break
+		}
+		mark = e
+	}
+
+	if mark == nil {
+		return l.PushFront(pcb)
+	}
+	return l.InsertAfter(pcb, mark)
+}
+
+// prioritize moves the events of the descriptors with priority operations at the head
+// of their queues to the front, so they're processed first.
+func (w *watcher) prioritize(pe pollerEvents) {
+	isPriority := func(l *list.List) bool {
+		return l.Len() > 0 && l.Front().Value.(*aiocb).priority
+	}
+
+	k := 0
+	for i := range pe {
+		if desc, ok := w.descs[pe[i].ident]; ok && (isPriority(&desc.readers) || isPriority(&desc.writers)) {
+			pe[k], pe[i] = pe[i], pe[k]
+			k++
 		}
 	}
 }
 
 // handle poller events
 func (w *watcher) handleEvents(pe pollerEvents) {
+	if w.usePriority {
+		w.prioritize(pe)
+	}
+
 	// suppose fd(s) being polled is closed by conn.Close() from outside after chanrecv,
 	// and a new conn has re-opened with the same handler number(fd). The read and write
 	// on this fd is fatal.
@@ -556,33 +4779,161 @@ func (w *watcher) handleEvents(pe pollerEvents) {
 	// then IO operation is impossible to misread or miswrite on re-created fd.
 	//log.Println(e)
 	for _, e := range pe {
+		// completions of io_uring
+		if w.ring != nil && e.ident == w.ring.efd {
+			w.wakeRing()
+			continue
+		}
+
 		if desc, ok := w.descs[e.ident]; ok {
+			w.markDirty(e.ident)
+
+			if w.onPollerError != nil && e.ev&(EV_HUP|EV_ERR) != 0 {
+				w.reportPollerError(e)
+			}
+
+			// rate-limited conn with budget spent waits for the tokens to refill
+			if desc.rate > 0 {
+				desc.refill(time.Now())
+				if desc.tokens <= 0 {
+					if throttled := e.ev & (EV_READ | EV_WRITE); throttled != 0 {
+						w.throttle(e.ident, desc, throttled)
+						e.ev &^= throttled
+					}
+				}
+			}
+
+			if e.ev&EV_OOB != 0 {
+				var next *list.Element
+				for elem := desc.oobReaders.Front(); elem != nil; elem = next {
+					next = elem.Next()
+					pcb := elem.Value.(*aiocb)
+					if w.tryReadOOB(e.ident, pcb) {
+						w.deliver(pcb)
+						desc.oobReaders.Remove(elem)
+					} else {
+						break
+					}
+				}
+			}
+
 			if e.ev&EV_READ != 0 {
+				var released bool
 				var next *list.Element
+				budget := int(atomic.LoadInt32(&w.readBudget))
+				var nread int
 				for elem := desc.readers.Front(); elem != nil; elem = next {
 					next = elem.Next()
 					pcb := elem.Value.(*aiocb)
-					if w.tryRead(e.ident, pcb) {
+					if pcb.parked {
+						break
+					}
+
+					// budget used up, the socket may not be drained, and edge-triggered
+					// poller will not report it again, resume in next round.
+					if budget > 0 && nread >= budget {
+						w.requeue(e.ident, EV_READ)
+						break
+					}
+
+					// rate limit reached
+					if desc.rate > 0 && desc.tokens <= 0 {
+						break
+					}
+
+					w.limit(desc)
+					prev := pcb.size
+					completed := w.tryRead(e.ident, pcb)
+					w.limited = false
+					w.spend(desc, pcb.size-prev)
+					if completed {
+						nread += pcb.size
+						// persistent read keeps on reading
+						if w.rearmPersist(e.ident, pcb) {
+							next = elem
+							continue
+						}
+
+						freeConn := pcb.persist && pcb.err == io.EOF && atomic.LoadInt32(&w.freeOnEOF) == 1
 						w.deliver(pcb)
 						desc.readers.Remove(elem)
+						if freeConn {
+							if !desc.borrowed {
+								w.freed[desc.ptr] = nil
+							}
+							w.releaseConn(e.ident)
+							released = true
+							break
+						}
 					} else {
 						break
 					}
 				}
+
+				if released {
+					continue
+				}
+
+				if desc.rate > 0 && desc.tokens <= 0 && desc.readers.Len() > 0 {
+					w.throttle(e.ident, desc, EV_READ)
+				}
 			}
 
-			if e.ev&EV_WRITE != 0 {
+			// writes on rate-limited conn are not coalesced, to be capped one by one
+			if e.ev&EV_WRITE != 0 && (atomic.LoadInt32(&w.coalesce) == 0 || desc.rate > 0 || w.writeCoalesced(e.ident, desc)) {
+				var released bool
 				var next *list.Element
 				for elem := desc.writers.Front(); elem != nil; elem = next {
 					next = elem.Next()
 					pcb := elem.Value.(*aiocb)
-					if w.tryWrite(e.ident, pcb) {
+					if desc.rate > 0 && desc.tokens <= 0 {
+						break
+					}
+
+					w.limit(desc)
+					prev := pcb.size
+					completed := w.tryWrite(e.ident, pcb)
+					w.limited = false
+					w.spend(desc, pcb.size-prev)
+					if completed {
+						connected := pcb.op == OpConnect
 						w.deliver(pcb)
 						desc.writers.Remove(elem)
+						// the connecting adapter is done
+						if connected {
+							w.releaseConnect(e.ident)
+							released = true
+							break
+						}
 					} else {
 						break
 					}
 				}
+
+				if released {
+					continue
+				}
+
+				if desc.rate > 0 && desc.tokens <= 0 && desc.writers.Len() > 0 {
+					w.throttle(e.ident, desc, EV_WRITE)
+				}
+				w.flushCloseWrite(e.ident, desc)
+			}
+
+			// the connection has hung up, operations left after the attempts
+			// above, like parked persistent reads, can never complete, the
+			// conn is released like Free, and later operations on it fail.
+			// EPOLLRDHUP alone is not a hangup, the peer has only shut down
+			// writing and still reads, the writes blocked on a peer gone
+			// are reset, which is EPOLLHUP|EPOLLERR.
+			if e.ev&EV_HUP != 0 {
+				cause := w.hangupError(e)
+				all := func(*aiocb) bool { return true }
+				w.cancelDesc(e.ident, desc, all, cause)
+				if !desc.borrowed {
+					w.freed[desc.ptr] = cause
+				}
+				w.releaseConn(e.ident)
 			}
 		}
 	}